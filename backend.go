@@ -0,0 +1,416 @@
+package mqmq
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// QueueBackend stores the messages of a single queue. The server keeps
+// track of the consumers waiting for messages and calls the backend methods
+// of a queue one at a time, so the backend needs no locking of its own.
+//
+// Messages are opaque byte slices in the server storage format (see
+// SetStorageCodec). The server doesn't modify the slices passed to the backend,
+// and the backend must not modify the slices it returns.
+type QueueBackend interface {
+	// PushBack appends the message to the end of the queue.
+	PushBack(message []byte) error
+	// PushFront inserts the message into the front of the queue.
+	PushFront(message []byte) error
+	// PopFront removes the first message from the queue and returns it.
+	// It returns false if the queue is empty.
+	PopFront() ([]byte, bool, error)
+	// Len returns the number of the messages in the queue.
+	Len() int
+	// Messages returns all the messages in the queue order.
+	Messages() ([][]byte, error)
+	// Close releases the backend when the queue is no longer used.
+	Close() error
+}
+
+// QueueFrontBackend is a QueueBackend that reads the first messages of the queue
+// without reading all of them. The server uses it to copy the messages between
+// the queues (see Client.Copy); the other backends are read with Messages.
+type QueueFrontBackend interface {
+	QueueBackend
+	// Front returns up to n first messages in the queue order.
+	Front(n int) ([][]byte, error)
+}
+
+// QueueFactory returns the backend of the named queue. It is called once
+// for every queue when the queue is used for the first time. If the backend
+// already has messages, e.g. stored in a database, they are served first.
+type QueueFactory func(name string) (QueueBackend, error)
+
+// SetQueueFactory makes the server keep the messages in the backends created
+// by the factory. The factory overrides the queue type (see SetQueueType).
+// It can't be used with the write-ahead log or the snapshot restored before
+// the start (see SetWAL and Restore).
+// Use the mqmqtest package to check a backend implementation.
+func (s *Server) SetQueueFactory(factory QueueFactory) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != ServerStateNew {
+		return errServerState
+	}
+	if s.walOptions.Path != "" {
+		return errWALQueueFactory
+	}
+	if s.queues != nil {
+		// The queues are restored from a snapshot (see Restore).
+		return errRestoreSource
+	}
+	s.queueFactory = factory
+	return nil
+}
+
+// OpenQueues creates the named queues with the queue factory (see SetQueueFactory).
+// It can be called before the server is started, so the messages the backends
+// already keep, e.g. in a database, are shown in the server information, written
+// to the snapshots and replicated before the queues are used by the clients.
+func (s *Server) OpenQueues(names ...string) error {
+	s.mu.Lock()
+	if s.state == ServerStateStopped {
+		s.mu.Unlock()
+		return errServerState
+	}
+	if s.queueFactory == nil {
+		s.mu.Unlock()
+		return errors.New("mqmq: no queue factory")
+	}
+	if s.queues == nil {
+		s.queues = make(map[string]queue)
+	}
+	s.mu.Unlock()
+
+	for _, name := range names {
+		if !ValidQueueName(name) {
+			return errors.New("mqmq: bad queue name: " + name)
+		}
+		_, err := s.getQueue(name, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backendQueue is a queue that keeps the messages in a QueueBackend
+// guarded by a mutex. Unlike memoryQueue, it doesn't need its own goroutine
+// and none of its operations block.
+type backendQueue struct {
+	mu      sync.Mutex
+	backend QueueBackend
+	waiters list.List
+	journal func(queueOp)
+	onError func(msg string, err error)
+	seq     uint64
+}
+
+// newBackendQueue creates a new queue on top of the backend. The journal works
+// like in newMemoryQueue. The backend errors that can't be returned to the caller
+// are passed to onError unless it's nil.
+func newBackendQueue(backend QueueBackend, journal func(queueOp), onError func(msg string, err error)) *backendQueue {
+	return &backendQueue{backend: backend, journal: journal, onError: onError}
+}
+
+// newMutexQueue creates a new queue that keeps the messages in the memory backend.
+func newMutexQueue(journal func(queueOp)) *backendQueue {
+	return newBackendQueue(NewMemoryBackend(), journal, nil)
+}
+
+func (q *backendQueue) enqueue(message []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.backend.PushBack(message)
+	if err != nil {
+		return err
+	}
+	q.record(queueOpEnqueue, message)
+	q.handOff()
+	return nil
+}
+
+func (q *backendQueue) requeue(message []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.backend.PushFront(message)
+	if err != nil {
+		return err
+	}
+	q.record(queueOpRequeue, message)
+	q.handOff()
+	return nil
+}
+
+// dequeue removes the first message from the queue unless it's empty.
+func (q *backendQueue) dequeue() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.popFront()
+}
+
+// wait registers a consumer waiting for the next message.
+func (q *backendQueue) wait() *queueWaiter {
+	w := &queueWaiter{ch: make(chan []byte, 1)}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w.elem = q.waiters.PushBack(w)
+	q.handOff()
+	return w
+}
+
+// cancel unregisters the waiting consumer. The message already passed to
+// the consumer is put back to the front of the queue.
+func (q *backendQueue) cancel(w *queueWaiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.elem != nil {
+		q.waiters.Remove(w.elem)
+		w.elem = nil
+		return
+	}
+	select {
+	case v := <-w.ch:
+		err := q.backend.PushFront(v)
+		if err != nil {
+			q.logError("failed to put message back", err)
+			return
+		}
+		q.record(queueOpRequeue, v)
+		q.handOff()
+	default:
+	}
+}
+
+func (q *backendQueue) waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiters.Len()
+}
+
+func (q *backendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.backend.Len()
+}
+
+// purge removes all the messages and returns their number.
+// Every removal is recorded as a separate dequeue operation.
+func (q *backendQueue) purge() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for {
+		if _, ok := q.popFront(); !ok {
+			return n
+		}
+		n++
+	}
+}
+
+func (q *backendQueue) snapshot() (queueSnapshot, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	messages, err := q.backend.Messages()
+	if err != nil {
+		return queueSnapshot{}, err
+	}
+	return queueSnapshot{messages: messages, seq: q.seq}, nil
+}
+
+// front returns up to n first messages of the queue.
+func (q *backendQueue) front(n int) ([][]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.frontLocked(n)
+}
+
+// dequeueTo works like memoryQueue.dequeueTo. The message is removed from
+// the backend only after it is stored in dst.
+func (q *backendQueue) dequeueTo(dst queue) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Nobody is waiting if there are messages.
+	front, err := q.frontLocked(1)
+	if err != nil || len(front) == 0 {
+		return false, err
+	}
+	v := front[0]
+	if dst == queue(q) {
+		err = q.backend.PushBack(v)
+		if err != nil {
+			return false, err
+		}
+		q.record(queueOpEnqueue, v)
+	} else {
+		err = appendTo(dst, v)
+		if err != nil {
+			return false, err
+		}
+	}
+	if _, ok := q.popFront(); !ok {
+		return true, errors.New("mqmq: failed to remove moved message")
+	}
+	return true, nil
+}
+
+// frontLocked returns up to n first messages. The q.mu must be held.
+func (q *backendQueue) frontLocked(n int) ([][]byte, error) {
+	if b, ok := q.backend.(QueueFrontBackend); ok {
+		return b.Front(n)
+	}
+	messages, err := q.backend.Messages()
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > n {
+		messages = messages[:n]
+	}
+	return messages, nil
+}
+
+func (q *backendQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.backend.Close()
+	if err != nil {
+		q.logError("failed to close queue backend", err)
+	}
+}
+
+// handOff passes the messages to the longest waiting consumers.
+// The q.mu must be held.
+func (q *backendQueue) handOff() {
+	for q.waiters.Len() > 0 {
+		v, ok := q.popFront()
+		if !ok {
+			return
+		}
+		w := q.waiters.Remove(q.waiters.Front()).(*queueWaiter)
+		w.elem = nil
+		w.ch <- v
+	}
+}
+
+// popFront removes the first message and records the change.
+// The q.mu must be held.
+func (q *backendQueue) popFront() ([]byte, bool) {
+	v, ok, err := q.backend.PopFront()
+	if err != nil {
+		q.logError("failed to remove message", err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	q.record(queueOpDequeue, nil)
+	return v, true
+}
+
+func (q *backendQueue) record(kind queueOpKind, message []byte) {
+	q.seq++
+	if q.journal != nil {
+		q.journal(queueOp{kind: kind, message: message, seq: q.seq})
+	}
+}
+
+func (q *backendQueue) logError(msg string, err error) {
+	if q.onError != nil {
+		q.onError(msg, err)
+	}
+}
+
+// memoryBackend is a QueueBackend that keeps the messages in a ring buffer.
+type memoryBackend struct {
+	buf  [][]byte
+	head int // Index of the first message in buf.
+	n    int // Number of messages.
+}
+
+// memoryBackendMinSize is the initial size of the memoryBackend ring buffer.
+const memoryBackendMinSize = 16
+
+// NewMemoryBackend creates a new QueueBackend that keeps the messages in memory.
+// It is the backend of the QueueTypeMutex queues, and custom backends can use it
+// as a cache in front of a slower storage.
+func NewMemoryBackend() QueueBackend {
+	return &memoryBackend{}
+}
+
+func (b *memoryBackend) PushBack(message []byte) error {
+	if b.n == len(b.buf) {
+		b.resize(2 * len(b.buf))
+	}
+	b.buf[(b.head+b.n)%len(b.buf)] = message
+	b.n++
+	return nil
+}
+
+func (b *memoryBackend) PushFront(message []byte) error {
+	if b.n == len(b.buf) {
+		b.resize(2 * len(b.buf))
+	}
+	b.head = (b.head + len(b.buf) - 1) % len(b.buf)
+	b.buf[b.head] = message
+	b.n++
+	return nil
+}
+
+func (b *memoryBackend) PopFront() ([]byte, bool, error) {
+	if b.n == 0 {
+		return nil, false, nil
+	}
+	v := b.buf[b.head]
+	b.buf[b.head] = nil
+	b.head = (b.head + 1) % len(b.buf)
+	b.n--
+	// The buffer shrinks when it's mostly empty, so a burst of
+	// messages doesn't hold the memory forever.
+	if len(b.buf) > memoryBackendMinSize && b.n <= len(b.buf)/4 {
+		b.resize(len(b.buf) / 2)
+	}
+	return v, true, nil
+}
+
+func (b *memoryBackend) Len() int {
+	return b.n
+}
+
+func (b *memoryBackend) Messages() ([][]byte, error) {
+	messages := make([][]byte, b.n)
+	for i := range messages {
+		messages[i] = b.buf[(b.head+i)%len(b.buf)]
+	}
+	return messages, nil
+}
+
+func (b *memoryBackend) Front(n int) ([][]byte, error) {
+	if n > b.n {
+		n = b.n
+	}
+	messages := make([][]byte, n)
+	for i := range messages {
+		messages[i] = b.buf[(b.head+i)%len(b.buf)]
+	}
+	return messages, nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+// resize moves the messages to a new buffer of the given size.
+func (b *memoryBackend) resize(size int) {
+	if size < memoryBackendMinSize {
+		size = memoryBackendMinSize
+	}
+	buf := make([][]byte, size)
+	for i := 0; i < b.n; i++ {
+		buf[i] = b.buf[(b.head+i)%len(b.buf)]
+	}
+	b.buf = buf
+	b.head = 0
+}
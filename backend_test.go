@@ -0,0 +1,108 @@
+package mqmq
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingBackend is a memory backend that fails to store the messages
+// after the given number of them.
+type failingBackend struct {
+	QueueBackend
+	left int
+}
+
+func (b *failingBackend) PushBack(message []byte) error {
+	if b.left == 0 {
+		return errors.New("backend is full")
+	}
+	b.left--
+	return b.QueueBackend.PushBack(message)
+}
+
+func TestQueueFactory(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	s, addr := startServerWith(func(s *Server) error {
+		return s.SetQueueFactory(func(name string) (QueueBackend, error) {
+			mu.Lock()
+			names = append(names, name)
+			mu.Unlock()
+			if name == "broken-queue" {
+				return nil, errors.New("broken")
+			}
+			return &failingBackend{QueueBackend: NewMemoryBackend(), left: 1}, nil
+		})
+	})
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	err = c.Put("test-queue", []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+
+	// The backend errors are reported to the clients.
+	err = c.Put("test-queue", []byte("test-message"))
+	if !errors.Is(err, ErrServerInternal) {
+		t.Fatalf("failed c.Put: expected error %v, got %v", ErrServerInternal, err)
+	}
+	err = c.Put("broken-queue", []byte("test-message"))
+	if !errors.Is(err, ErrServerInternal) {
+		t.Fatalf("failed c.Put: expected error %v, got %v", ErrServerInternal, err)
+	}
+
+	out, err := c.Get("test-queue", 1*time.Minute)
+	if err != nil || string(out) != "test-message" {
+		t.Fatalf("failed c.Get: expected %#v, %#v, got %#v, %#v", "test-message", nil, string(out), err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(names) != 2 || names[0] != "test-queue" || names[1] != "broken-queue" {
+		t.Fatalf("failed factory: unexpected calls %q", names)
+	}
+	if _, ok := s.Info().Queues["broken-queue"]; ok {
+		t.Fatalf("failed s.Info: unexpected broken-queue")
+	}
+}
+
+func TestSetQueueFactory(t *testing.T) {
+	s, _ := startServer()
+	defer s.Stop()
+
+	err := s.SetQueueFactory(func(name string) (QueueBackend, error) { return NewMemoryBackend(), nil })
+	if err != errServerState {
+		t.Fatalf("failed s.SetQueueFactory: expected error %v, got %v", errServerState, err)
+	}
+}
+
+func TestOpenQueues(t *testing.T) {
+	s := NewServer()
+	err := s.OpenQueues("test-queue")
+	if err == nil {
+		t.Fatalf("failed s.OpenQueues: expected error for no queue factory")
+	}
+
+	s.SetQueueFactory(func(name string) (QueueBackend, error) {
+		b := NewMemoryBackend()
+		b.PushBack([]byte("stored-message"))
+		return b, nil
+	})
+	err = s.OpenQueues("test-queue", "bad queue")
+	if err == nil {
+		t.Fatalf("failed s.OpenQueues: expected error for bad queue name")
+	}
+	info := s.Info()
+	if info.NumQueues != 1 || info.Queues["test-queue"].NumMessages != 1 {
+		t.Fatalf("failed s.OpenQueues: unexpected info %+v", info)
+	}
+}
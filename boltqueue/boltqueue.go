@@ -0,0 +1,234 @@
+// Package boltqueue implements the mqmq queue backend that keeps the messages
+// in a bbolt database file, so they survive the server restarts.
+//
+// Every queue is stored in a separate bucket of the database. Every change of
+// a queue is a separate transaction committed to the disk before the server
+// acknowledges it, e.g. a Put request is answered after the message is stored,
+// and the message put back after a failed delivery is stored again before it
+// can be delivered to another consumer.
+package boltqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/disintegration/mqmq"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DB is a database of the queues.
+type DB struct {
+	db *bolt.DB
+
+	mu     sync.Mutex
+	queues map[string]*backend
+}
+
+// Open opens the database file, creating it if necessary.
+func Open(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{db: db, queues: make(map[string]*backend)}, nil
+}
+
+// Close closes the database file. The backends of the queues must not be used afterwards.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Queues returns the names of the queues stored in the database.
+func (d *DB) Queues() ([]string, error) {
+	var names []string
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	return names, err
+}
+
+var errQueueOpen = errors.New("boltqueue: queue is already open")
+
+// Backend returns the backend of the named queue with the messages stored
+// in the database. It can be passed to mqmq.Server.SetQueueFactory directly
+// or used by a factory for some of the queues. A queue can only have one open
+// backend at a time.
+func (d *DB) Backend(name string) (mqmq.QueueBackend, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.queues[name]; ok {
+		return nil, errQueueOpen
+	}
+
+	b := &backend{db: d, name: []byte(name)}
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(b.name)
+		if err != nil {
+			return err
+		}
+		// The messages are stored under the sequential keys starting in
+		// the middle of the key space, so they can be added at both ends.
+		b.head, b.tail = keyMiddle, keyMiddle
+		cursor := bucket.Cursor()
+		if k, _ := cursor.First(); k != nil {
+			b.head = binary.BigEndian.Uint64(k)
+			k, _ = cursor.Last()
+			b.tail = binary.BigEndian.Uint64(k) + 1
+		}
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			b.n++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d.queues[name] = b
+	return b, nil
+}
+
+// Attach makes the server keep the queues matching the pattern, e.g. "orders.*",
+// in the database and the other queues in memory. The queues already stored in
+// the database are opened before the server starts (see mqmq.Server.OpenQueues).
+func (d *DB) Attach(s *mqmq.Server, pattern string) error {
+	if !mqmq.ValidQueuePattern(pattern) {
+		return errors.New("boltqueue: bad queue pattern: " + pattern)
+	}
+	err := s.SetQueueFactory(func(name string) (mqmq.QueueBackend, error) {
+		if mqmq.MatchQueue(pattern, name) {
+			return d.Backend(name)
+		}
+		return mqmq.NewMemoryBackend(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	names, err := d.Queues()
+	if err != nil {
+		return err
+	}
+	var stored []string
+	for _, name := range names {
+		if mqmq.MatchQueue(pattern, name) {
+			stored = append(stored, name)
+		}
+	}
+	return s.OpenQueues(stored...)
+}
+
+// keyMiddle is the key of the first message put to an empty queue.
+const keyMiddle = 1 << 63
+
+// backend is the QueueBackend of a single queue.
+type backend struct {
+	db   *DB
+	name []byte
+	head uint64 // Key of the first message.
+	tail uint64 // Key following the last message.
+	n    int    // Number of messages.
+}
+
+func key(k uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], k)
+	return b[:]
+}
+
+func (b *backend) PushBack(message []byte) error {
+	err := b.db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.name).Put(key(b.tail), message)
+	})
+	if err != nil {
+		return err
+	}
+	b.tail++
+	b.n++
+	return nil
+}
+
+func (b *backend) PushFront(message []byte) error {
+	err := b.db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.name).Put(key(b.head-1), message)
+	})
+	if err != nil {
+		return err
+	}
+	b.head--
+	b.n++
+	return nil
+}
+
+func (b *backend) PopFront() ([]byte, bool, error) {
+	if b.n == 0 {
+		return nil, false, nil
+	}
+
+	var message []byte
+	err := b.db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.name)
+		k := key(b.head)
+		// The value is only valid during the transaction.
+		message = append([]byte{}, bucket.Get(k)...)
+		return bucket.Delete(k)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	b.head++
+	b.n--
+	if b.n == 0 {
+		b.head, b.tail = keyMiddle, keyMiddle
+	}
+	return message, true, nil
+}
+
+func (b *backend) Len() int {
+	return b.n
+}
+
+func (b *backend) Messages() ([][]byte, error) {
+	messages := make([][]byte, 0, b.n)
+	err := b.db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.name).ForEach(func(_, v []byte) error {
+			messages = append(messages, append([]byte{}, v...))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// Front returns up to n first messages of the queue.
+func (b *backend) Front(n int) ([][]byte, error) {
+	if n > b.n {
+		n = b.n
+	}
+	messages := make([][]byte, 0, n)
+	err := b.db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(b.name).Cursor()
+		for k, v := c.First(); k != nil && len(messages) < n; k, v = c.Next() {
+			messages = append(messages, append([]byte{}, v...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// Close closes the backend of the queue. The messages are kept in the database.
+func (b *backend) Close() error {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+	delete(b.db.queues, string(b.name))
+	return nil
+}
@@ -0,0 +1,113 @@
+package boltqueue
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/mqmq"
+	"github.com/disintegration/mqmq/mqmqtest"
+)
+
+func openDB(t *testing.T, path string) *DB {
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("failed Open: %s", err)
+	}
+	return d
+}
+
+func TestBackend(t *testing.T) {
+	d := openDB(t, filepath.Join(t.TempDir(), "queues.db"))
+	defer d.Close()
+
+	mqmqtest.TestQueueBackend(t, d.Backend)
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queues.db")
+	d := openDB(t, path)
+
+	b, err := d.Backend("test-queue")
+	if err != nil {
+		t.Fatalf("failed d.Backend: %s", err)
+	}
+	_, err = d.Backend("test-queue")
+	if err != errQueueOpen {
+		t.Fatalf("failed d.Backend: expected error %v, got %v", errQueueOpen, err)
+	}
+
+	for i := 1; i < 5; i++ {
+		b.PushBack([]byte(fmt.Sprintf("message-%d", i)))
+	}
+	b.PopFront()
+	b.PushFront([]byte("message-0"))
+	b.Close()
+	d.Close()
+
+	// The messages are restored in the same order.
+	d = openDB(t, path)
+	defer d.Close()
+
+	names, err := d.Queues()
+	if err != nil || len(names) != 1 || names[0] != "test-queue" {
+		t.Fatalf("failed d.Queues: expected [test-queue], got %q, %v", names, err)
+	}
+
+	b, err = d.Backend("test-queue")
+	if err != nil {
+		t.Fatalf("failed d.Backend: %s", err)
+	}
+	defer b.Close()
+
+	want := []string{"message-0", "message-2", "message-3", "message-4"}
+	if n := b.Len(); n != len(want) {
+		t.Fatalf("failed b.Len: expected %d, got %d", len(want), n)
+	}
+	b.PushBack([]byte("message-5"))
+	want = append(want, "message-5")
+	for _, w := range want {
+		v, ok, err := b.PopFront()
+		if err != nil || !ok || !bytes.Equal(v, []byte(w)) {
+			t.Fatalf("failed b.PopFront: expected %q, got %q, %v, %v", w, v, ok, err)
+		}
+	}
+}
+
+func TestAttach(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queues.db")
+	d := openDB(t, path)
+	for _, name := range []string{"orders.eu", "orders.us", "users"} {
+		b, err := d.Backend(name)
+		if err != nil {
+			t.Fatalf("failed d.Backend: %s", err)
+		}
+		b.PushBack([]byte("message"))
+		b.Close()
+	}
+	d.Close()
+
+	// The stored queues matching the pattern are opened before the server starts.
+	d = openDB(t, path)
+	defer d.Close()
+	s := mqmq.NewServer()
+	err := d.Attach(s, "orders.*")
+	if err != nil {
+		t.Fatalf("failed d.Attach: %s", err)
+	}
+
+	info := s.Info()
+	want := map[string]mqmq.ServerQueueInfo{
+		"orders.eu": {NumMessages: 1},
+		"orders.us": {NumMessages: 1},
+	}
+	if !reflect.DeepEqual(info.Queues, want) {
+		t.Fatalf("failed s.Info: expected %+v, got %+v", want, info.Queues)
+	}
+
+	if err := d.Attach(mqmq.NewServer(), "orders*"); err == nil {
+		t.Fatalf("failed d.Attach: expected error for bad pattern")
+	}
+}
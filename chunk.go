@@ -0,0 +1,325 @@
+package mqmq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+// messageChunkSize is the maximum size of a message part sent in a single frame.
+const messageChunkSize = 256 * 1024
+
+var (
+	bPutStream  = []byte("PutStream")
+	bGetStream  = []byte("GetStream")
+	bChunk      = []byte("Chunk")
+	bChunkEnd   = []byte("ChunkEnd")
+	bChunkAbort = []byte("ChunkAbort")
+)
+
+var errChunkedNotSupported = errors.New("mqmq: server does not support chunked messages")
+
+// Request handler: PutStream <queue>
+//
+// The request is followed by the Chunk <data> frames with the consecutive
+// message parts and the ChunkEnd frame (or the ChunkAbort frame to cancel
+// the message). The server responds once all the chunks are received.
+func (c *connection) handlePutStream(f frame) {
+	maxSize := c.server.limits.MaxMessageSize
+	if len(f) >= 2 {
+		maxSize = c.server.maxMessageSize(string(f[1]))
+	}
+	message, errf, ok := c.receiveChunks(maxSize)
+	if !ok {
+		return
+	}
+
+	if errf == nil && len(f) < 2 {
+		errf = errorFrame(ErrBadParams, "PutStream requires queue name")
+	}
+	if errf == nil {
+		errf = c.checkQueueName(string(f[1]))
+	}
+	if errf != nil {
+		c.sendOrStop(errf)
+		return
+	}
+
+	term, stepDown, ok := c.acceptRequest(f, false)
+	if !ok {
+		return
+	}
+
+	c.putMessage(string(f[1]), c.server.storeOwnedMessage(message), term, stepDown)
+}
+
+// receiveChunks reads the message sent in chunks. Messages larger than maxSize
+// are rejected. All the chunks are read even if the message is rejected, so
+// that the following requests are read correctly. It reports false if the
+// connection is stopped.
+func (c *connection) receiveChunks(maxSize int) (message []byte, errf frame, ok bool) {
+	for {
+		var b *frameBuffer
+		select {
+		case <-c.done:
+			return nil, nil, false
+		case b = <-c.requests:
+		}
+
+		f := b.f
+		switch {
+		case len(f) == 2 && bytes.Equal(f[0], bChunk):
+			if errf == nil && len(message)+len(f[1]) > maxSize {
+				errf = errorFrame(ErrMessageTooLarge, "message is larger than "+strconv.Itoa(maxSize)+" bytes")
+				message = nil
+			}
+			if errf == nil {
+				message = append(message, f[1]...)
+			}
+			b.release()
+		case len(f) == 1 && bytes.Equal(f[0], bChunkEnd):
+			b.release()
+			return message, errf, true
+		case len(f) == 1 && bytes.Equal(f[0], bChunkAbort):
+			b.release()
+			return nil, errorFrame(ErrRequestCanceled, "message is canceled by the client"), true
+		default:
+			// The client is out of sync, so there is no way to respond properly.
+			b.release()
+			c.sendOrStop(errorFrame(ErrBadParams, "unexpected frame in message chunks"))
+			c.stop()
+			return nil, nil, false
+		}
+	}
+}
+
+// Request handler: GetStream <queue> <timeout>
+//
+// The server responds like to the Get request, but the OK response is
+// followed by the Chunk <data> frames with the message parts and
+// the ChunkEnd frame.
+func (c *connection) handleGetStream(f frame) {
+	c.get(f, true)
+}
+
+// sendChunks sends the OK response and the message in chunks.
+func (c *connection) sendChunks(message []byte) error {
+	err := c.send(frame{bOK})
+	if err != nil {
+		return err
+	}
+
+	for len(message) > 0 {
+		n := len(message)
+		if n > messageChunkSize {
+			n = messageChunkSize
+		}
+		err = c.send(frame{bChunk, message[:n]})
+		if err != nil {
+			return err
+		}
+		message = message[n:]
+	}
+
+	return c.send(frame{bChunkEnd})
+}
+
+// writeChunked writes the frame with the message at the item 2. Large messages
+// are split: the leading parts are written as the Chunk frames followed by
+// the frame with the rest of the message.
+func writeChunked(w io.Writer, f frame) error {
+	message := f[2]
+	for len(message) > messageChunkSize {
+		err := writeFrame(w, frame{bChunk, message[:messageChunkSize]}, maxFrameLen)
+		if err != nil {
+			return err
+		}
+		message = message[messageChunkSize:]
+	}
+
+	last := append(frame(nil), f...)
+	last[2] = message
+	return writeFrame(w, last, maxFrameLen)
+}
+
+// PutReader appends the message read from r until EOF to the end of the given
+// queue. The message is sent in chunks, so it may be larger than the memory
+// available to the client and the maximum frame size. The server accepts
+// messages up to its maximum message size (see ServerLimits).
+// The message is not compressed.
+func (c *Client) PutReader(queue string, r io.Reader) error {
+	return c.PutReaderContext(context.Background(), queue, r)
+}
+
+// PutReaderContext appends the message read from r to the end of the given queue.
+// It works like PutReader but the request can be abandoned early by canceling the context.
+func (c *Client) PutReaderContext(ctx context.Context, queue string, r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.checkQueueName(queue)
+	if err != nil {
+		return err
+	}
+
+	if c.conn != nil && !c.capabilities[CapabilityChunked] {
+		return errChunkedNotSupported
+	}
+
+	var response frame
+	var readErr, ioErr error
+	err = c.exchangeLocked(ctx, func() error {
+		ioErr = c.send(frame{bPutStream, []byte(queue)})
+		if ioErr != nil {
+			return ioErr
+		}
+
+		buf := make([]byte, messageChunkSize)
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				ioErr = c.send(frame{bChunk, buf[:n]})
+				if ioErr != nil {
+					return ioErr
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				readErr = err
+				break
+			}
+		}
+
+		end := bChunkEnd
+		if readErr != nil {
+			end = bChunkAbort
+		}
+		ioErr = c.send(frame{end})
+		if ioErr != nil {
+			return ioErr
+		}
+
+		response, ioErr = c.recv()
+		return ioErr
+	})
+	if ioErr != nil && c.conn != nil {
+		// The chunks may be partially sent, so the connection is out of sync.
+		c.closeConn()
+	}
+	if err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	if len(response) < 1 {
+		return ErrBadResponse
+	}
+	if bytes.Equal(response[0], bError) {
+		return responseError(response)
+	}
+	if !bytes.Equal(response[0], bOK) {
+		return ErrBadResponse
+	}
+	return nil
+}
+
+// GetWriter receives the next message from the given queue and writes it to w.
+// The message is received in chunks, so it may be larger than the memory
+// available to the client and the maximum frame size. The timeout parameter
+// works like in Get. GetWriter returns the number of bytes written to w.
+// If writing to w fails, the rest of the message is discarded and the message
+// is removed from the queue anyway.
+func (c *Client) GetWriter(queue string, w io.Writer, timeout time.Duration) (int64, error) {
+	return c.GetWriterContext(context.Background(), queue, w, timeout)
+}
+
+// GetWriterContext receives the next message from the given queue and writes it to w.
+// It works like GetWriter but the wait can be abandoned early by canceling the context.
+func (c *Client) GetWriterContext(ctx context.Context, queue string, w io.Writer, timeout time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.checkQueueName(queue)
+	if err != nil {
+		return 0, err
+	}
+	timeoutValue, err := c.checkGetTimeout(timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.conn != nil && !c.capabilities[CapabilityChunked] {
+		return 0, errChunkedNotSupported
+	}
+
+	response, written, err := c.streamLocked(ctx, frame{bGetStream, []byte(queue), timeoutValue}, w)
+	if err != nil {
+		return written, err
+	}
+
+	if len(response) < 1 {
+		return 0, ErrBadResponse
+	}
+	if bytes.Equal(response[0], bError) {
+		return 0, responseError(response)
+	}
+	if bytes.Equal(response[0], bTimeout) {
+		return 0, ErrTimeout
+	}
+	if !bytes.Equal(response[0], bOK) {
+		return 0, ErrBadResponse
+	}
+	return written, nil
+}
+
+// streamLocked sends the request and writes the data of the Chunk frames
+// following the OK response to w until the ChunkEnd frame. If writing to w
+// fails, the rest of the data is discarded and the write error is returned.
+// The c.mu must be held.
+func (c *Client) streamLocked(ctx context.Context, request frame, w io.Writer) (frame, int64, error) {
+	var response frame
+	var written int64
+	var writeErr, ioErr error
+	err := c.exchangeLocked(ctx, func() error {
+		response, ioErr = c.roundTrip(request)
+		if ioErr != nil || len(response) != 1 || !bytes.Equal(response[0], bOK) {
+			return ioErr
+		}
+
+		for {
+			var f frame
+			f, ioErr = c.recv()
+			if ioErr != nil {
+				return ioErr
+			}
+
+			switch {
+			case len(f) == 2 && bytes.Equal(f[0], bChunk):
+				if writeErr == nil {
+					var n int
+					n, writeErr = w.Write(f[1])
+					written += int64(n)
+				}
+			case len(f) == 1 && bytes.Equal(f[0], bChunkEnd):
+				return nil
+			default:
+				ioErr = ErrBadResponse
+				return ioErr
+			}
+		}
+	})
+	if ioErr != nil && c.conn != nil {
+		c.closeConn()
+	}
+	if err != nil {
+		return response, written, err
+	}
+	return response, written, writeErr
+}
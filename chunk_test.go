@@ -0,0 +1,197 @@
+package mqmq
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// largeMessage returns a message larger than the maximum frame size.
+func largeMessage() []byte {
+	message := make([]byte, maxMsgLen+3*messageChunkSize/2)
+	for i := range message {
+		message[i] = byte(i % 251)
+	}
+	return message
+}
+
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("read failed")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestPutReaderGetWriter(t *testing.T) {
+	s := NewServer()
+	s.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	maxMessageSize := maxMsgLen + 2*messageChunkSize
+	limits := DefaultServerLimits()
+	limits.MaxMessageSize = maxMessageSize
+	err := s.SetLimits(limits)
+	if err != nil {
+		t.Fatalf("failed s.SetLimits: %s", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed net.Listen: %s", err)
+	}
+	go s.Serve(listener)
+	defer s.Stop()
+	for s.State() == ServerStateNew {
+		time.Sleep(time.Millisecond)
+	}
+
+	replica, _ := startReplica(listener.Addr().String())
+	defer replica.Stop()
+
+	c := NewClient()
+	err = c.Connect(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	if !c.HasCapability(CapabilityChunked) {
+		t.Fatalf("failed c.HasCapability: chunked messages are not supported")
+	}
+
+	large := largeMessage()
+	for _, message := range [][]byte{{}, []byte("test-message"), large} {
+		err = c.PutReader("test-queue", bytes.NewReader(message))
+		if err != nil {
+			t.Fatalf("failed c.PutReader: %s", err)
+		}
+	}
+
+	// Regular messages can be received in chunks and vice versa.
+	err = c.Put("test-queue", []byte("test-message-2"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+
+	out, err := c.Get("test-queue", time.Second)
+	if err != nil || len(out) != 0 {
+		t.Fatalf("failed c.Get: expected empty message, got %d bytes, %v", len(out), err)
+	}
+	out, err = c.Get("test-queue", time.Second)
+	if err != nil || string(out) != "test-message" {
+		t.Fatalf("failed c.Get: expected %q, got %q, %v", "test-message", out, err)
+	}
+
+	waitInSync(t, s, replica)
+	if messages := queueContents(replica)["test-queue"]; len(messages) != 2 || !bytes.Equal(messages[0], large) {
+		t.Fatalf("failed replication: large message is not replicated")
+	}
+
+	// The large message doesn't fit into a frame and stays in the queue.
+	_, err = c.Get("test-queue", time.Second)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("failed c.Get: expected %v, got %v", ErrMessageTooLarge, err)
+	}
+
+	var buf bytes.Buffer
+	n, err := c.GetWriter("test-queue", &buf, time.Second)
+	if err != nil || n != int64(len(large)) || !bytes.Equal(buf.Bytes(), large) {
+		t.Fatalf("failed c.GetWriter: got %d bytes, %v", n, err)
+	}
+
+	buf.Reset()
+	n, err = c.GetWriter("test-queue", &buf, time.Second)
+	if err != nil || buf.String() != "test-message-2" {
+		t.Fatalf("failed c.GetWriter: expected %q, got %q, %v", "test-message-2", buf.String(), err)
+	}
+
+	_, err = c.GetWriter("test-queue", &buf, 10*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("failed c.GetWriter: expected %v, got %v", ErrTimeout, err)
+	}
+
+	// Messages larger than the maximum message size are rejected.
+	err = c.PutReader("test-queue", io.LimitReader(zeroReader{}, int64(maxMessageSize)+1))
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("failed c.PutReader: expected %v, got %v", ErrMessageTooLarge, err)
+	}
+
+	// The message is canceled if the reader fails.
+	err = c.PutReader("test-queue", &failingReader{n: 3 * messageChunkSize / 2})
+	if err == nil || err.Error() != "read failed" {
+		t.Fatalf("failed c.PutReader: expected read error, got %v", err)
+	}
+
+	// The connection is still usable.
+	info, err := c.Info()
+	if err != nil || info.NumMessages != 0 {
+		t.Fatalf("failed c.Info: expected no messages, got %#v, %v", info, err)
+	}
+}
+
+func TestGetWriterFailedWrite(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	message := bytes.Repeat([]byte("X"), 3*messageChunkSize)
+	err = c.PutReader("test-queue", bytes.NewReader(message))
+	if err != nil {
+		t.Fatalf("failed c.PutReader: %s", err)
+	}
+	err = c.Put("test-queue", []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+
+	w := &failingWriter{n: messageChunkSize}
+	n, err := c.GetWriter("test-queue", w, time.Second)
+	if err == nil || n != messageChunkSize {
+		t.Fatalf("failed c.GetWriter: expected write error after %d bytes, got %d, %v", messageChunkSize, n, err)
+	}
+
+	// The rest of the message is discarded and the next one is received.
+	out, err := c.Get("test-queue", time.Second)
+	if err != nil || string(out) != "test-message" {
+		t.Fatalf("failed c.Get: expected %q, got %q, %v", "test-message", out, err)
+	}
+}
+
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errors.New("write failed")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
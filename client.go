@@ -3,10 +3,10 @@ package mqmq
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -17,41 +17,123 @@ var ErrBadResponse = errors.New("mqmq: bad server response")
 // ErrTimeout means that the given queue timeout expired and no message is received.
 var ErrTimeout = errors.New("mqmq: timeout expired")
 
+var errNotConnected = errors.New("mqmq: client is not connected")
+
 // Client is the mqmq client struct.
 type Client struct {
-	mu     sync.Mutex
-	conn   net.Conn
-	reader *bufio.Reader
-	writer *bufio.Writer
+	mu            sync.Mutex
+	addr          string
+	conn          net.Conn
+	reader        *bufio.Reader
+	protocol      int
+	serverVersion string
+	capabilities  map[string]bool
+	codec         Codec
+	limits        ServerLimits
+	replyQueue    string // Temporary reply queue of the connection.
+
+	requestMu sync.Mutex // Serializes the requests (see Client.Request).
+	requestID uint64
+
+	compressThreshold int
+	compressCodecs    []string
+	compressDisabled  bool
 }
 
 // NewClient creates a new mqmq client.
+// The client offers all the registered codecs to compress the message bodies.
 func NewClient() *Client {
-	return &Client{}
+	return &Client{
+		compressThreshold: DefaultCompressionThreshold,
+		limits:            DefaultServerLimits(),
+	}
+}
+
+// SetCompression sets the minimum size of the message body that is compressed
+// and the names of the codecs offered to the server in the order of preference.
+// If no codecs are given, the compression is disabled. The settings are applied
+// on the next Connect.
+func (c *Client) SetCompression(threshold int, codecs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compressThreshold = threshold
+	c.compressCodecs = append([]string(nil), codecs...)
+	c.compressDisabled = len(codecs) == 0
+}
+
+// compressionCodecs returns the names of the codecs to offer. The c.mu must be held.
+func (c *Client) compressionCodecs() []string {
+	if c.compressDisabled {
+		return nil
+	}
+	if c.compressCodecs == nil {
+		return codecNames()
+	}
+	return c.compressCodecs
 }
 
 // Connect connects to the server using TCP address addr.
 // If addr is blank, DefaultAddr is used.
 func (c *Client) Connect(addr string) error {
+	return c.ConnectContext(context.Background(), addr)
+}
+
+// ConnectContext connects to the server using TCP address addr.
+// The provided context is used to cancel the dial and the handshake
+// or to limit their duration.
+func (c *Client) ConnectContext(ctx context.Context, addr string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if addr == "" {
 		addr = DefaultAddr
 	}
-	conn, err := net.Dial("tcp", addr)
+
+	err := c.dial(ctx, addr)
 	if err != nil {
 		return err
 	}
 
-	c.conn = conn
-	c.reader = bufio.NewReader(conn)
-	c.writer = bufio.NewWriter(conn)
+	err = c.hello(ctx)
+	if err == errLegacyServer {
+		// Servers that don't know the Hello command close the connection.
+		return c.dial(ctx, addr)
+	}
+	if err != nil && c.conn != nil {
+		c.closeConn()
+	}
+	return err
+}
+
+func (c *Client) dial(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	c.addr = addr
+	c.setConn(conn)
 
 	return nil
 }
 
+// setConn makes the client use the new connection. The state negotiated on
+// the previous connection is reset: no handshake is done on the new connection yet.
+func (c *Client) setConn(conn net.Conn) {
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.protocol = 0
+	c.serverVersion = ""
+	c.capabilities = nil
+	c.codec = nil
+	c.limits = DefaultServerLimits()
+	c.replyQueue = ""
+}
+
 // SetConnection provides the client with an established net connection.
+// The connection is used as a connection without the handshake, like one to
+// a legacy server.
 func (c *Client) SetConnection(conn net.Conn) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -60,33 +142,109 @@ func (c *Client) SetConnection(conn net.Conn) error {
 		return errors.New("mqmq: nil conn")
 	}
 
-	c.conn = conn
-	c.reader = bufio.NewReader(conn)
-	c.writer = bufio.NewWriter(conn)
+	c.setConn(conn)
 
 	return nil
 }
 
 func (c *Client) send(f frame) error {
-	err := writeFrame(c.writer, f, maxFrameLen)
-	if err != nil {
-		return err
-	}
-	return c.writer.Flush()
+	return writeFrame(c.conn, f, uint32(c.limits.MaxFrameSize))
 }
 
 func (c *Client) recv() (frame, error) {
-	return readFrame(c.reader, maxFrameLen)
+	return readFrame(c.reader, uint32(c.limits.MaxFrameSize))
 }
 
-func (c *Client) cmd(request frame) (frame, error) {
+func (c *Client) cmd(ctx context.Context, request frame) (frame, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.cmdLocked(ctx, request)
+}
 
+// cmdLocked sends the request and receives the response. The c.mu must be held.
+func (c *Client) cmdLocked(ctx context.Context, request frame) (frame, error) {
+	var response frame
+	err := c.exchangeLocked(ctx, func() error {
+		var err error
+		response, err = c.roundTrip(request)
+		return err
+	})
+	return response, err
+}
+
+// exchangeLocked runs the exchange of frames with the server within the context.
+// The c.mu must be held.
+func (c *Client) exchangeLocked(ctx context.Context, exchange func() error) error {
 	if c.conn == nil {
-		return nil, errors.New("mqmq: client is not connected")
+		return errNotConnected
+	}
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	conn := c.conn
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	stopWatch := watchContext(ctx, conn)
+	err = exchange()
+	stopWatch()
+
+	if err != nil {
+		ctxErr := ctx.Err()
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() && ctxErr == nil {
+			// The connection deadline may expire slightly before the context one.
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline.Add(-time.Millisecond)) {
+				ctxErr = context.DeadlineExceeded
+			}
+		}
+		if ctxErr != nil {
+			// The request was abandoned mid-flight and the response may still
+			// arrive later, so the connection is out of sync and can't be reused.
+			c.closeConn()
+			return ctxErr
+		}
+		return err
+	}
+
+	// The context may be canceled after the exchange succeeds, so the watcher
+	// may have set the expired deadline even if the context has no deadline.
+	if ctx.Done() != nil {
+		conn.SetDeadline(time.Time{})
+	}
+
+	return nil
+}
+
+// watchContext interrupts any blocked read or write on conn as soon as ctx is
+// canceled. The returned function stops watching and must be called before
+// the connection is used again.
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	finished := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-finished:
+		}
+	}()
+
+	return func() {
+		close(finished)
+		<-watcherDone
 	}
+}
 
+func (c *Client) roundTrip(request frame) (frame, error) {
 	err := c.send(request)
 	if err != nil {
 		return nil, err
@@ -100,15 +258,40 @@ func (c *Client) cmd(request frame) (frame, error) {
 	return response, nil
 }
 
+func (c *Client) closeConn() error {
+	err := c.conn.Close()
+	c.conn = nil
+	c.reader = nil
+	c.replyQueue = ""
+	return err
+}
+
 // Put appends the message to the end of the given queue.
 func (c *Client) Put(queue string, message []byte) error {
-	if len(queue) > MaxQueueNameLen {
-		return errors.New("mqmq: queue name length is larger than MaxQueueNameLen")
-	}
+	return c.PutContext(context.Background(), queue, message)
+}
 
-	request := frame{bPut, []byte(queue), message}
+// PutContext appends the message to the end of the given queue.
+// If the context is canceled or its deadline is exceeded before the server
+// responds, the connection is closed and the context error is returned.
+func (c *Client) PutContext(ctx context.Context, queue string, message []byte) error {
+	return c.put(ctx, queue, message, "")
+}
 
-	response, err := c.cmd(request)
+// put sends the Put request with the optional dedup key.
+func (c *Client) put(ctx context.Context, queue string, message []byte, key string) error {
+	c.mu.Lock()
+	err := c.checkQueueName(queue)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	request := frame{bPut, []byte(queue), encodeMessage(c.codec, c.compressThreshold, message)}
+	if key != "" {
+		request = append(request, []byte(key))
+	}
+	response, err := c.cmdLocked(ctx, request)
+	c.mu.Unlock()
 	if err != nil {
 		return err
 	}
@@ -117,10 +300,7 @@ func (c *Client) Put(queue string, message []byte) error {
 		return ErrBadResponse
 	}
 	if bytes.Equal(response[0], bError) {
-		if len(response) < 2 {
-			return ErrBadResponse
-		}
-		return errors.New("mqmq: server error response: " + string(response[1]))
+		return responseError(response)
 	}
 	if !bytes.Equal(response[0], bOK) {
 		return ErrBadResponse
@@ -131,22 +311,33 @@ func (c *Client) Put(queue string, message []byte) error {
 // Get receives the next message from the given queue.
 // The timeout parameter specifies how much time to wait for the next message.
 // The ErrTimeout error is returned if no new messages received from the queue
-// for the given timeout. The maximum timeout value allowed is MaxGetTimeout.
+// for the given timeout. The maximum timeout value allowed is advertised by
+// the server (see Client.Limits) and is MaxGetTimeout by default.
 func (c *Client) Get(queue string, timeout time.Duration) ([]byte, error) {
-	if len(queue) > MaxQueueNameLen {
-		return nil, errors.New("mqmq: queue name length is larger than MaxQueueNameLen")
-	}
+	return c.GetContext(context.Background(), queue, timeout)
+}
 
-	if timeout < 0 {
-		timeout = 0
-	} else if timeout > MaxGetTimeout {
-		return nil, errors.New("mqmq: timeout is larger than MaxGetTimeout")
+// GetContext receives the next message from the given queue.
+// It works like Get but the wait can be abandoned early by canceling the context.
+// If the context is canceled or its deadline is exceeded before the server
+// responds, the connection is closed and the context error is returned.
+func (c *Client) GetContext(ctx context.Context, queue string, timeout time.Duration) ([]byte, error) {
+	c.mu.Lock()
+	err := c.checkQueueName(queue)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	timeoutValue, err := c.checkGetTimeout(timeout)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
 	}
-	timeoutStr := strconv.Itoa(int(timeout / time.Millisecond))
-
-	request := frame{bGet, []byte(queue), []byte(timeoutStr)}
 
-	response, err := c.cmd(request)
+	request := frame{bGet, []byte(queue), timeoutValue}
+	codec := c.codec
+	response, err := c.cmdLocked(ctx, request)
+	c.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
@@ -155,10 +346,7 @@ func (c *Client) Get(queue string, timeout time.Duration) ([]byte, error) {
 		return nil, ErrBadResponse
 	}
 	if bytes.Equal(response[0], bError) {
-		if len(response) < 2 {
-			return nil, ErrBadResponse
-		}
-		return nil, errors.New("mqmq: server error response: " + string(response[1]))
+		return nil, responseError(response)
 	}
 	if bytes.Equal(response[0], bTimeout) {
 		return nil, ErrTimeout
@@ -166,25 +354,51 @@ func (c *Client) Get(queue string, timeout time.Duration) ([]byte, error) {
 	if !bytes.Equal(response[0], bOK) || len(response) < 2 {
 		return nil, ErrBadResponse
 	}
-	return response[1], nil
+
+	message, err := decodeMessage(codec, response[1])
+	if err != nil {
+		return nil, ErrBadResponse
+	}
+	return message, nil
 }
 
 // Info requests the server information.
 func (c *Client) Info() (*ServerInfo, error) {
-	request := frame{bInfo}
+	return c.InfoContext(context.Background())
+}
+
+// InfoContext requests the server information.
+// If the context is canceled or its deadline is exceeded before the server
+// responds, the connection is closed and the context error is returned.
+func (c *Client) InfoContext(ctx context.Context) (*ServerInfo, error) {
+	return c.info(ctx, frame{bInfo})
+}
 
-	response, err := c.cmd(request)
+// InfoQueues requests the server information that includes only the queues
+// matching the pattern (see ValidQueuePattern), e.g. "orders.*".
+func (c *Client) InfoQueues(pattern string) (*ServerInfo, error) {
+	return c.InfoQueuesContext(context.Background(), pattern)
+}
+
+// InfoQueuesContext requests the server information that includes only the
+// queues matching the pattern. It works like InfoContext.
+func (c *Client) InfoQueuesContext(ctx context.Context, pattern string) (*ServerInfo, error) {
+	return c.info(ctx, frame{bInfo, []byte(pattern)})
+}
+
+func (c *Client) info(ctx context.Context, request frame) (*ServerInfo, error) {
+	response, err := c.cmd(ctx, request)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(response) < 2 {
+	if len(response) < 1 {
 		return nil, ErrBadResponse
 	}
 	if bytes.Equal(response[0], bError) {
-		return nil, errors.New("mqmq: server error response: " + string(response[1]))
+		return nil, responseError(response)
 	}
-	if !bytes.Equal(response[0], bOK) {
+	if !bytes.Equal(response[0], bOK) || len(response) < 2 {
 		return nil, ErrBadResponse
 	}
 
@@ -197,6 +411,56 @@ func (c *Client) Info() (*ServerInfo, error) {
 	return info, nil
 }
 
+// Promote makes the replica server a primary one.
+func (c *Client) Promote() error {
+	response, err := c.cmd(context.Background(), frame{bPromote})
+	if err != nil {
+		return err
+	}
+
+	if len(response) < 1 {
+		return ErrBadResponse
+	}
+	if bytes.Equal(response[0], bError) {
+		return responseError(response)
+	}
+	if !bytes.Equal(response[0], bOK) {
+		return ErrBadResponse
+	}
+	return nil
+}
+
+// watchIdle starts watching the idle connection for being closed by the server.
+// The returned function stops watching and reports whether the connection is
+// still healthy. The client must not be used until the function is called.
+func (c *Client) watchIdle() func() bool {
+	c.mu.Lock()
+	conn := c.conn
+	reader := c.reader
+	c.mu.Unlock()
+
+	if conn == nil {
+		return func() bool { return false }
+	}
+
+	// No data is expected from the server between requests, so the read
+	// only returns when the connection is closed or gets out of sync.
+	result := make(chan error, 1)
+	go func() {
+		_, err := reader.Peek(1)
+		result <- err
+	}()
+
+	return func() bool {
+		conn.SetReadDeadline(time.Unix(1, 0))
+		err := <-result
+		conn.SetReadDeadline(time.Time{})
+
+		nerr, ok := err.(net.Error)
+		return ok && nerr.Timeout()
+	}
+}
+
 // Disconnect disconnects from the server.
 func (c *Client) Disconnect() error {
 	c.mu.Lock()
@@ -207,5 +471,5 @@ func (c *Client) Disconnect() error {
 	}
 
 	c.send(frame{bQuit})
-	return c.conn.Close()
+	return c.closeConn()
 }
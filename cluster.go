@@ -0,0 +1,185 @@
+package mqmq
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// clusterReplicas is the number of points each server gets on the hash ring.
+const clusterReplicas = 128
+
+// ClusterClient is a client for a set of independent mqmq servers.
+// Each queue lives on exactly one server chosen by consistent hashing
+// of the queue name, so adding or removing a server only moves a small
+// part of the queues. It is safe for concurrent use by multiple goroutines.
+type ClusterClient struct {
+	addrs  []string
+	pools  map[string]*Pool
+	hashes []uint32
+	ring   map[uint32]string
+}
+
+// NewClusterClient creates a new client for the servers at the given TCP addresses.
+// If addrs is empty, DefaultAddr is used. Each server gets its own connection
+// pool with at most poolSize connections (see NewPool).
+func NewClusterClient(addrs []string, poolSize int) *ClusterClient {
+	if len(addrs) == 0 {
+		addrs = []string{DefaultAddr}
+	}
+
+	c := &ClusterClient{
+		pools: make(map[string]*Pool),
+		ring:  make(map[uint32]string),
+	}
+
+	for _, addr := range addrs {
+		if addr == "" {
+			addr = DefaultAddr
+		}
+		if _, ok := c.pools[addr]; ok {
+			continue
+		}
+		c.addrs = append(c.addrs, addr)
+		c.pools[addr] = NewPool(addr, poolSize)
+
+		for i := 0; i < clusterReplicas; i++ {
+			h := ringHash(addr + "#" + strconv.Itoa(i))
+			if _, ok := c.ring[h]; ok {
+				continue
+			}
+			c.ring[h] = addr
+			c.hashes = append(c.hashes, h)
+		}
+	}
+
+	sort.Slice(c.hashes, func(i, j int) bool { return c.hashes[i] < c.hashes[j] })
+
+	return c
+}
+
+// Addrs returns the server addresses.
+func (c *ClusterClient) Addrs() []string {
+	return append([]string(nil), c.addrs...)
+}
+
+// Addr returns the address of the server the given queue is routed to.
+func (c *ClusterClient) Addr(queue string) string {
+	h := ringHash(queue)
+	i := sort.Search(len(c.hashes), func(i int) bool { return c.hashes[i] >= h })
+	if i == len(c.hashes) {
+		i = 0
+	}
+	return c.ring[c.hashes[i]]
+}
+
+// ringHash returns the hash ring point of the key. Similar keys, like numbered
+// queue names, must be spread evenly around the ring, so a cryptographic
+// hash is used instead of a checksum.
+func ringHash(key string) uint32 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func (c *ClusterClient) pool(queue string) *Pool {
+	return c.pools[c.Addr(queue)]
+}
+
+// Put appends the message to the end of the given queue on the server the queue is routed to.
+func (c *ClusterClient) Put(queue string, message []byte) error {
+	return c.PutContext(context.Background(), queue, message)
+}
+
+// PutContext appends the message to the end of the given queue on the server the queue is routed to.
+func (c *ClusterClient) PutContext(ctx context.Context, queue string, message []byte) error {
+	return c.pool(queue).PutContext(ctx, queue, message)
+}
+
+// Get receives the next message from the given queue on the server the queue is routed to.
+// See Client.Get for the timeout parameter description.
+func (c *ClusterClient) Get(queue string, timeout time.Duration) ([]byte, error) {
+	return c.GetContext(context.Background(), queue, timeout)
+}
+
+// GetContext receives the next message from the given queue on the server the queue is routed to.
+func (c *ClusterClient) GetContext(ctx context.Context, queue string, timeout time.Duration) ([]byte, error) {
+	return c.pool(queue).GetContext(ctx, queue, timeout)
+}
+
+// Info requests the information from all the servers and returns the aggregated result.
+func (c *ClusterClient) Info() (*ServerInfo, error) {
+	return c.InfoContext(context.Background())
+}
+
+// InfoContext requests the information from all the servers and returns the aggregated result.
+func (c *ClusterClient) InfoContext(ctx context.Context) (*ServerInfo, error) {
+	infos, err := c.NodesInfoContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ServerInfo{Queues: make(map[string]ServerQueueInfo)}
+	for _, addr := range c.addrs {
+		nodeInfo := infos[addr]
+		info.NumConnections += nodeInfo.NumConnections
+		info.NumMessages += nodeInfo.NumMessages
+		for qname, q := range nodeInfo.Queues {
+			qinfo := info.Queues[qname]
+			qinfo.NumMessages += q.NumMessages
+			qinfo.NumWaiting += q.NumWaiting
+			qinfo.NumDedupHits += q.NumDedupHits
+			info.Queues[qname] = qinfo
+		}
+	}
+	info.NumQueues = len(info.Queues)
+
+	return info, nil
+}
+
+// NodesInfoContext requests the information from all the servers concurrently.
+// The result is keyed by server address.
+func (c *ClusterClient) NodesInfoContext(ctx context.Context) (map[string]*ServerInfo, error) {
+	type result struct {
+		addr string
+		info *ServerInfo
+		err  error
+	}
+
+	results := make(chan result, len(c.addrs))
+	for _, addr := range c.addrs {
+		go func(addr string) {
+			info, err := c.pools[addr].InfoContext(ctx)
+			results <- result{addr, info, err}
+		}(addr)
+	}
+
+	infos := make(map[string]*ServerInfo)
+	var err error
+	for range c.addrs {
+		r := <-results
+		if r.err != nil {
+			if err == nil {
+				err = fmt.Errorf("mqmq: server %s: %w", r.addr, r.err)
+			}
+			continue
+		}
+		infos[r.addr] = r.info
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+// Close closes the connections to all the servers.
+func (c *ClusterClient) Close() error {
+	for _, addr := range c.addrs {
+		c.pools[addr].Close()
+	}
+	return nil
+}
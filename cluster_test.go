@@ -0,0 +1,83 @@
+package mqmq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClusterClient(t *testing.T) {
+	servers := make(map[string]*Server)
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		s, addr := startServer()
+		defer s.Stop()
+		servers[addr] = s
+		addrs = append(addrs, addr)
+	}
+
+	c := NewClusterClient(addrs, 2)
+	defer c.Close()
+
+	numQueues := 30
+	for i := 0; i < numQueues; i++ {
+		qname := fmt.Sprintf("test-queue-%d", i)
+		err := c.Put(qname, []byte(qname))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+
+	used := make(map[string]bool)
+	for i := 0; i < numQueues; i++ {
+		qname := fmt.Sprintf("test-queue-%d", i)
+		addr := c.Addr(qname)
+		used[addr] = true
+		info := servers[addr].Info()
+		if info.Queues[qname].NumMessages != 1 {
+			t.Fatalf("failed: queue %s is expected on server %s", qname, addr)
+		}
+	}
+	if len(used) != len(addrs) {
+		t.Fatalf("failed: expected queues on %d servers, got %d", len(addrs), len(used))
+	}
+
+	info, err := c.Info()
+	if err != nil {
+		t.Fatalf("failed c.Info: %s", err)
+	}
+	if info.NumQueues != numQueues || info.NumMessages != numQueues || len(info.Queues) != numQueues {
+		t.Fatalf("failed c.Info: unexpected info %#v", info)
+	}
+
+	for i := 0; i < numQueues; i++ {
+		qname := fmt.Sprintf("test-queue-%d", i)
+		out, err := c.Get(qname, 1*time.Minute)
+		if err != nil || string(out) != qname {
+			t.Fatalf("failed c.Get: expected %#v, %#v, got %#v, %#v", qname, nil, string(out), err)
+		}
+	}
+}
+
+func TestClusterClientConsistentHashing(t *testing.T) {
+	addrs := []string{"10.0.0.1:47774", "10.0.0.2:47774", "10.0.0.3:47774", "10.0.0.4:47774"}
+	c1 := NewClusterClient(addrs, 1)
+	c2 := NewClusterClient(addrs[:3], 1)
+
+	moved := 0
+	numQueues := 1000
+	for i := 0; i < numQueues; i++ {
+		qname := fmt.Sprintf("test-queue-%d", i)
+		a1, a2 := c1.Addr(qname), c2.Addr(qname)
+		if a1 != a2 {
+			if a1 != addrs[3] {
+				t.Fatalf("failed: queue %s moved from %s to %s", qname, a1, a2)
+			}
+			moved++
+		}
+	}
+
+	if moved == 0 || moved > numQueues/2 {
+		t.Fatalf("failed: unexpected number of moved queues: %d", moved)
+	}
+}
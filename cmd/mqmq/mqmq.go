@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/disintegration/mqmq"
+	"github.com/disintegration/mqmq/boltqueue"
 )
 
 func main() {
@@ -20,22 +29,137 @@ func main() {
 
 	flagset := &flag.FlagSet{Usage: printUsageAndExit}
 	addr := flagset.String("addr", mqmq.DefaultAddr, "TCP address of the server")
+	replicaOf := flagset.String("replicaof", "", "TCP address of the primary server")
+	cluster := flagset.String("cluster", "", "comma-separated TCP addresses of the cluster members")
+	storageCodec := flagset.String("storagecodec", "", "codec to compress the stored messages")
+	queueType := flagset.String("queuetype", string(mqmq.QueueTypeChannel), "queue implementation: channel or mutex")
+	boltDB := flagset.String("boltdb", "", "database file to store the queues in")
+	boltQueues := flagset.String("boltqueues", "*", "pattern of the queues stored in the database")
+	dedupWindow := flagset.Duration("dedupwindow", mqmq.DefaultDedupWindow, "time the dedup keys of the messages are remembered")
+	var walOptions mqmq.WALOptions
+	flagset.StringVar(&walOptions.Path, "wal", "", "write-ahead log file")
+	flagset.StringVar((*string)(&walOptions.Sync), "walsync", string(mqmq.WALSyncAlways), "write-ahead log sync policy: always, batch or os")
+	flagset.DurationVar(&walOptions.Interval, "walinterval", mqmq.DefaultWALInterval, "interval of the batch write-ahead log syncs")
+	queue := flagset.String("queue", "", "queue to export or import")
+	in := flagset.String("in", "", "file to import the messages from")
+	out := flagset.String("out", "", "file to export the messages to")
+	src := flagset.String("src", "", "queue to move or copy the messages from")
+	dst := flagset.String("dst", "", "queue to move or copy the messages to")
+	count := flagset.Int("count", 1, "number of the messages to move or copy")
+	peek := flagset.Bool("peek", false, "export the messages without removing them")
+	snapshot := flagset.String("snapshot", "", "snapshot file to restore and save the queues")
+	queues := flagset.String("queues", "*", "pattern of the queues to show, purge or dump")
+	limits := mqmq.DefaultServerLimits()
+	flagset.IntVar(&limits.MaxMessageSize, "maxmessagesize", limits.MaxMessageSize, "maximum message size in bytes")
+	flagset.IntVar(&limits.MaxFrameSize, "maxframesize", limits.MaxFrameSize, "maximum frame size in bytes")
+	flagset.IntVar(&limits.MaxQueueNameLen, "maxqueuenamelen", limits.MaxQueueNameLen, "maximum queue name length in bytes")
+	flagset.DurationVar(&limits.MaxGetTimeout, "maxgettimeout", limits.MaxGetTimeout, "maximum Get request timeout")
+	flagset.IntVar(&limits.MaxConnections, "maxconnections", 0, "maximum number of connections")
+	flagset.IntVar(&limits.MaxConnectionsPerIP, "maxconnectionsperip", 0, "maximum number of connections from a single IP address")
+	flagset.IntVar(&limits.MaxQueues, "maxqueues", 0, "maximum number of queues")
 	flagset.Parse(os.Args[2:])
 
 	switch cmd {
 	case "start":
-		processStart(*addr)
+		processStart(*addr, *replicaOf, *cluster, *storageCodec, mqmq.QueueType(*queueType), *boltDB, *boltQueues, walOptions, *dedupWindow, *snapshot, limits)
 	case "info":
-		processInfo(*addr)
+		processInfo(*addr, *queues)
+	case "purge":
+		processPurge(*addr, *queues)
+	case "promote":
+		processPromote(*addr)
+	case "dump":
+		processDump(*addr, *queues, *snapshot)
+	case "load":
+		processLoad(*addr, *snapshot)
+	case "move":
+		processTransfer(*addr, *src, *dst, *count, true)
+	case "copy":
+		processTransfer(*addr, *src, *dst, *count, false)
+	case "export":
+		processExport(*addr, *queue, *out, *peek)
+	case "import":
+		processImport(*addr, *queue, *in)
 	default:
 		printUsageAndExit()
 	}
 }
 
-func processStart(addr string) {
+func processStart(addr, replicaOf, cluster, storageCodec string, queueType mqmq.QueueType, boltDB, boltQueues string, walOptions mqmq.WALOptions, dedupWindow time.Duration, snapshot string, limits mqmq.ServerLimits) {
 	log.Printf("INFO: starting server: %s", addr)
 	server := mqmq.NewServer()
 
+	if walOptions.Path != "" && boltDB != "" {
+		log.Fatalf("FATAL: -wal can't be used with -boltdb")
+	}
+	if snapshot != "" && (walOptions.Path != "" || boltDB != "") {
+		log.Fatalf("FATAL: -snapshot can't be used with -wal or -boltdb")
+	}
+
+	err := server.SetLimits(limits)
+	if err != nil {
+		log.Fatalf("FATAL: failed to set server limits: %s", err)
+	}
+
+	err = server.SetQueueType(queueType)
+	if err != nil {
+		log.Fatalf("FATAL: failed to set queue type: %s", err)
+	}
+
+	err = server.SetDedupWindow("*", dedupWindow)
+	if err != nil {
+		log.Fatalf("FATAL: failed to set dedup window: %s", err)
+	}
+
+	if walOptions.Path != "" {
+		log.Printf("INFO: writing queue changes to write-ahead log: %s (sync %s)", walOptions.Path, walOptions.Sync)
+		err = server.SetWAL(walOptions)
+		if err != nil {
+			log.Fatalf("FATAL: failed to set write-ahead log: %s", err)
+		}
+	}
+
+	if storageCodec != "" {
+		log.Printf("INFO: compressing stored messages: %s", storageCodec)
+		err := server.SetStorageCodec(storageCodec)
+		if err != nil {
+			log.Fatalf("FATAL: failed to set storage codec: %s", err)
+		}
+	}
+
+	var db *boltqueue.DB
+	if boltDB != "" {
+		log.Printf("INFO: storing queues %s in database: %s", boltQueues, boltDB)
+		db, err = boltqueue.Open(boltDB)
+		if err != nil {
+			log.Fatalf("FATAL: failed to open database: %s", err)
+		}
+		err = db.Attach(server, boltQueues)
+		if err != nil {
+			log.Fatalf("FATAL: failed to attach database: %s", err)
+		}
+	}
+
+	if replicaOf != "" {
+		log.Printf("INFO: replicating from primary server: %s", replicaOf)
+		err := server.SetReplicaOf(replicaOf)
+		if err != nil {
+			log.Fatalf("FATAL: failed to set primary server: %s", err)
+		}
+	}
+
+	if cluster != "" {
+		log.Printf("INFO: joining cluster: %s", cluster)
+		err := server.SetCluster(addr, strings.Split(cluster, ","))
+		if err != nil {
+			log.Fatalf("FATAL: failed to join cluster: %s", err)
+		}
+	}
+
+	if snapshot != "" {
+		restoreSnapshot(server, snapshot)
+	}
+
 	go func() {
 		err := server.ListenAndServe(addr)
 		if err != nil {
@@ -48,39 +172,467 @@ func processStart(addr string) {
 	s := <-c
 	log.Printf("INFO: received signal: %v", s)
 
-	server.Stop()
+	if snapshot != "" {
+		stopSnapshot(server, snapshot)
+	} else {
+		server.Stop()
+	}
+	if db != nil {
+		db.Close()
+	}
 	log.Printf("INFO: server stopped: %s", addr)
 }
 
-func processInfo(addr string) {
-	client := mqmq.NewClient()
+// restoreSnapshot restores the queues from the snapshot file if it exists.
+func restoreSnapshot(server *mqmq.Server, path string) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("FATAL: failed to open snapshot: %s", err)
+	}
+	defer f.Close()
 
-	err := client.Connect(addr)
+	log.Printf("INFO: restoring queues from snapshot: %s", path)
+	err = server.Restore(f)
 	if err != nil {
-		fmt.Printf("Failed to connect to the server: %s\n", err)
-		os.Exit(1)
+		log.Fatalf("FATAL: failed to restore snapshot: %s", err)
 	}
+}
 
-	info, err := client.Info()
+// stopSnapshot stops the server and writes the snapshot of the queues to
+// a temporary file and renames it, so the previous snapshot is kept if
+// the server fails to save it.
+func stopSnapshot(server *mqmq.Server, path string) {
+	log.Printf("INFO: saving queues to snapshot: %s", path)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		fmt.Printf("Failed get the server information: %s\n", err)
+		log.Printf("ERROR: failed to save snapshot: %s", err)
+		server.Stop()
+		return
+	}
+	err = server.StopSnapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		log.Printf("ERROR: failed to save snapshot: %s", err)
+	}
+}
+
+func processInfo(addr, queues string) {
+	if !mqmq.ValidQueuePattern(queues) {
+		fmt.Printf("Bad queue pattern: %q\n", queues)
 		os.Exit(1)
 	}
 
-	client.Disconnect()
+	var info *mqmq.ServerInfo
+	if strings.Contains(addr, ",") {
+		info = getClusterInfo(strings.Split(addr, ","), queues)
+	} else {
+		info = getServerInfo(addr, queues)
+	}
 
+	if info.Role != "" {
+		fmt.Printf("Role: %s\n", info.Role)
+	}
 	fmt.Printf("Number of connections: %d\n", info.NumConnections)
+	fmt.Printf("Number of replicas: %d\n", info.NumReplicas)
 	fmt.Printf("Number of queues: %d\n", info.NumQueues)
 	fmt.Printf("Number of messages: %d\n", info.NumMessages)
 
+	if info.Cluster != nil {
+		fmt.Printf("Cluster state: %s\n", info.Cluster.State)
+		fmt.Printf("Cluster term: %d\n", info.Cluster.Term)
+		fmt.Printf("Cluster leader: %s\n", info.Cluster.Leader)
+		fmt.Println("Cluster members:")
+		for _, member := range info.Cluster.Members {
+			fmt.Printf("        %s\n", member)
+		}
+	}
+
 	if info.NumQueues > 0 {
 		fmt.Println("Queues:")
 		for qname, q := range info.Queues {
-			fmt.Printf("        %s: %d\n", qname, q.NumMessages)
+			fmt.Printf("        %s: %d (%d waiting, %d duplicates discarded)\n", qname, q.NumMessages, q.NumWaiting, q.NumDedupHits)
 		}
 	}
 }
 
+func processPromote(addr string) {
+	client := mqmq.NewClient()
+
+	err := client.Connect(addr)
+	if err != nil {
+		fmt.Printf("Failed to connect to the server: %s\n", err)
+		os.Exit(1)
+	}
+
+	err = client.Promote()
+	if err != nil {
+		fmt.Printf("Failed to promote the server: %s\n", err)
+		os.Exit(1)
+	}
+
+	client.Disconnect()
+
+	fmt.Println("The server is promoted to primary")
+}
+
+func processPurge(addr, queues string) {
+	client := mqmq.NewClient()
+
+	err := client.Connect(addr)
+	if err != nil {
+		fmt.Printf("Failed to connect to the server: %s\n", err)
+		os.Exit(1)
+	}
+
+	n, err := client.Purge(queues)
+	if err != nil {
+		fmt.Printf("Failed to purge the queues: %s\n", err)
+		os.Exit(1)
+	}
+
+	client.Disconnect()
+
+	fmt.Printf("Number of messages removed: %d\n", n)
+}
+
+func processDump(addr, queues, path string) {
+	if !mqmq.ValidQueuePattern(queues) {
+		fmt.Fprintf(os.Stderr, "Bad queue pattern: %q\n", queues)
+		os.Exit(1)
+	}
+
+	client := mqmq.NewClient()
+
+	err := client.Connect(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to the server: %s\n", err)
+		os.Exit(1)
+	}
+
+	out := os.Stdout
+	if path != "" {
+		out, err = os.Create(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create the snapshot file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	err = client.SnapshotContext(context.Background(), out, queues)
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to dump the queues: %s\n", err)
+		os.Exit(1)
+	}
+
+	client.Disconnect()
+}
+
+func processLoad(addr, path string) {
+	client := mqmq.NewClient()
+
+	err := client.Connect(addr)
+	if err != nil {
+		fmt.Printf("Failed to connect to the server: %s\n", err)
+		os.Exit(1)
+	}
+
+	in := os.Stdin
+	if path != "" {
+		in, err = os.Open(path)
+		if err != nil {
+			fmt.Printf("Failed to open the snapshot file: %s\n", err)
+			os.Exit(1)
+		}
+		defer in.Close()
+	}
+
+	n := 0
+	err = mqmq.ReadSnapshot(in, func(queue string, message []byte) error {
+		err := putMessage(client, queue, message)
+		if err == nil {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Failed to load the queues: %s\n", err)
+		fmt.Printf("Number of messages loaded: %d\n", n)
+		os.Exit(1)
+	}
+
+	client.Disconnect()
+
+	fmt.Printf("Number of messages loaded: %d\n", n)
+}
+
+func processTransfer(addr, src, dst string, count int, move bool) {
+	client := mqmq.NewClient()
+
+	err := client.Connect(addr)
+	if err != nil {
+		fmt.Printf("Failed to connect to the server: %s\n", err)
+		os.Exit(1)
+	}
+
+	if move {
+		n, err := client.Move(src, dst, count)
+		if err != nil {
+			fmt.Printf("Failed to move the messages: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Number of messages moved: %d\n", n)
+	} else {
+		n, err := client.Copy(src, dst, count)
+		if err != nil {
+			fmt.Printf("Failed to copy the messages: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Number of messages copied: %d\n", n)
+	}
+
+	client.Disconnect()
+}
+
+// exportedMessage is a line of the JSONL file written by the export command.
+// The message body is base64-encoded.
+type exportedMessage struct {
+	Queue string `json:"queue"`
+	Body  []byte `json:"body"`
+}
+
+// exportGetTimeout is the time the export command waits for the next message
+// before it decides that the queue is empty.
+const exportGetTimeout = 100 * time.Millisecond
+
+func processExport(addr, queue, path string, peek bool) {
+	if !mqmq.ValidQueueName(queue) {
+		fmt.Fprintf(os.Stderr, "Bad queue name: %q\n", queue)
+		os.Exit(1)
+	}
+
+	client := mqmq.NewClient()
+
+	err := client.Connect(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to the server: %s\n", err)
+		os.Exit(1)
+	}
+
+	out := os.Stdout
+	if path != "" {
+		out, err = os.Create(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create the export file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	bw := bufio.NewWriter(out)
+	enc := json.NewEncoder(bw)
+
+	n := 0
+	write := func(queue string, message []byte) error {
+		err := enc.Encode(exportedMessage{Queue: queue, Body: message})
+		if err == nil && !peek {
+			// The message removed from the queue must be written
+			// before the next one is taken.
+			err = bw.Flush()
+		}
+		if err == nil {
+			n++
+		}
+		return err
+	}
+	if peek {
+		err = peekMessages(client, queue, write)
+	} else {
+		err = getMessages(client, queue, write)
+	}
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	if out != os.Stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to export the messages: %s\n", err)
+		fmt.Fprintf(os.Stderr, "Number of messages exported: %d\n", n)
+		os.Exit(1)
+	}
+
+	client.Disconnect()
+
+	fmt.Fprintf(os.Stderr, "Number of messages exported: %d\n", n)
+}
+
+// getMessages removes the messages from the queue and passes them to fn until
+// the queue is empty. If fn fails, the message is put back to the end of the queue.
+func getMessages(client *mqmq.Client, queue string, fn func(queue string, message []byte) error) error {
+	for {
+		message, err := client.Get(queue, exportGetTimeout)
+		if errors.Is(err, mqmq.ErrMessageTooLarge) {
+			var buf bytes.Buffer
+			_, err = client.GetWriter(queue, &buf, exportGetTimeout)
+			message = buf.Bytes()
+		}
+		if err == mqmq.ErrTimeout {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(queue, message)
+		if err != nil {
+			if perr := putMessage(client, queue, message); perr != nil {
+				return fmt.Errorf("%s (failed to put the message back: %s)", err, perr)
+			}
+			return err
+		}
+	}
+}
+
+// peekMessages passes the messages of the queue to fn without removing them.
+// The messages are read from the snapshot of the queue while it is received.
+func peekMessages(client *mqmq.Client, queue string, fn func(queue string, message []byte) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(client.SnapshotContext(context.Background(), pw, queue))
+	}()
+	err := mqmq.ReadSnapshot(pr, fn)
+	// Unblocks the snapshot writer if fn failed.
+	pr.CloseWithError(err)
+	return err
+}
+
+func processImport(addr, queue, path string) {
+	if queue != "" && !mqmq.ValidQueueName(queue) {
+		fmt.Printf("Bad queue name: %q\n", queue)
+		os.Exit(1)
+	}
+
+	client := mqmq.NewClient()
+
+	err := client.Connect(addr)
+	if err != nil {
+		fmt.Printf("Failed to connect to the server: %s\n", err)
+		os.Exit(1)
+	}
+
+	in := os.Stdin
+	if path != "" {
+		in, err = os.Open(path)
+		if err != nil {
+			fmt.Printf("Failed to open the import file: %s\n", err)
+			os.Exit(1)
+		}
+		defer in.Close()
+	}
+
+	// The messages are put to the queue they were exported from
+	// unless the queue is given.
+	dec := json.NewDecoder(bufio.NewReader(in))
+	n := 0
+	for {
+		var m exportedMessage
+		err = dec.Decode(&m)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			break
+		}
+		if queue != "" {
+			m.Queue = queue
+		}
+		err = putMessage(client, m.Queue, m.Body)
+		if err != nil {
+			break
+		}
+		n++
+	}
+	if err != nil {
+		fmt.Printf("Failed to import the messages: %s\n", err)
+		fmt.Printf("Number of messages imported: %d\n", n)
+		os.Exit(1)
+	}
+
+	client.Disconnect()
+
+	fmt.Printf("Number of messages imported: %d\n", n)
+}
+
+// putMessage puts the message to the queue. The messages that don't fit
+// in a single frame are sent in chunks.
+func putMessage(client *mqmq.Client, queue string, message []byte) error {
+	if len(message) > client.Limits().MaxFrameSize/2 {
+		return client.PutReader(queue, bytes.NewReader(message))
+	}
+	return client.Put(queue, message)
+}
+
+func getServerInfo(addr, queues string) *mqmq.ServerInfo {
+	client := mqmq.NewClient()
+
+	err := client.Connect(addr)
+	if err != nil {
+		fmt.Printf("Failed to connect to the server: %s\n", err)
+		os.Exit(1)
+	}
+
+	info, err := client.InfoQueues(queues)
+	if err != nil {
+		fmt.Printf("Failed get the server information: %s\n", err)
+		os.Exit(1)
+	}
+
+	client.Disconnect()
+
+	return info
+}
+
+func getClusterInfo(addrs []string, queues string) *mqmq.ServerInfo {
+	client := mqmq.NewClusterClient(addrs, 1)
+	defer client.Close()
+
+	info, err := client.Info()
+	if err != nil {
+		fmt.Printf("Failed get the servers information: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Number of servers: %d\n", len(client.Addrs()))
+
+	info.NumMessages = 0
+	for qname, q := range info.Queues {
+		if !mqmq.MatchQueue(queues, qname) {
+			delete(info.Queues, qname)
+			continue
+		}
+		info.NumMessages += q.NumMessages
+	}
+	info.NumQueues = len(info.Queues)
+
+	return info
+}
+
 func printUsageAndExit() {
 	usage := fmt.Sprintf(`mqmq is a tool to start the mqmq server or get the running server information.
 
@@ -92,10 +644,80 @@ commands:
 
     start       start the server
     info        get the server information
+    purge       remove all the messages from the queues
+    promote     promote the replica server to primary
+    dump        write the snapshot of the queues
+    load        put the messages of the snapshot to the queues
+    move        move the messages from one queue to another
+    copy        copy the messages from one queue to another
+    export      get the messages of a queue and write them to a JSONL file
+    import      put the messages of a JSONL file to a queue
     
 arguments:
     
-    -addr       TCP address of the server (default is '%s')`, mqmq.DefaultAddr)
+    -addr       TCP address of the server (default is '%s'),
+                a comma-separated list of addresses for the info command
+                prints the information aggregated across all the servers
+    -replicaof  TCP address of the primary server, starts the server
+                as a standby replica of it
+    -cluster    comma-separated TCP addresses of all the cluster members,
+                starts the server as a member of the cluster
+    -queues     pattern of the queues to show, purge or dump: a queue name,
+                a namespace followed by '.*' (e.g. 'orders.*') or '*'
+                for all the queues (default)
+    -storagecodec
+                compression codec ('flate' or 'gzip'), the server keeps
+                large messages compressed in memory
+    -queuetype  queue implementation: 'channel' (default) or 'mutex',
+                the mutex-based queues handle more requests per second
+    -boltdb     database file to store the queues in, their messages
+                survive the server restarts (not with -wal)
+    -boltqueues pattern of the queues stored in the database (default
+                is '*'), the other queues are kept in memory
+    -wal        write-ahead log file, the server restores the queues
+                from it when it starts
+    -walsync    write-ahead log sync policy: 'always' (default) syncs
+                every change, 'batch' syncs the changes in batches,
+                'os' leaves it to the operating system
+    -walinterval
+                interval of the batch write-ahead log syncs (default
+                is %v)
+    -dedupwindow
+                time the server remembers the dedup keys of the messages
+                put to a queue (default is %v), 0 disables deduplication
+    -src        queue to move or copy the messages from
+    -dst        queue to move or copy the messages to
+    -count      number of the messages to move or copy (default is 1)
+    -queue      queue to export the messages from, or import them to
+                (by default the messages are imported to the queues
+                they were exported from)
+    -out        file to export the messages to (default is the standard
+                output), each line is a JSON object with the queue name
+                and the base64-encoded message body
+    -in         file to import the messages from (default is the standard
+                input)
+    -peek       export the messages without removing them from the queue
+    -snapshot   snapshot file, the server restores the queues from it
+                when it starts and saves them to it when it stops (not
+                with -wal or -boltdb), the dump and load commands write
+                and read it (default is the standard output and input)
+    -maxmessagesize
+                maximum message size in bytes (default is %d), larger
+                messages are rejected
+    -maxframesize
+                maximum frame size in bytes (default is %d), larger
+                messages can only be sent in chunks
+    -maxqueuenamelen
+                maximum queue name length in bytes (default is %d)
+    -maxgettimeout
+                maximum Get request timeout (default is %v)
+    -maxconnections
+                maximum number of connections (default is no limit)
+    -maxconnectionsperip
+                maximum number of connections from a single IP address
+                (default is no limit)
+    -maxqueues  maximum number of queues (default is no limit)`,
+		mqmq.DefaultAddr, mqmq.DefaultWALInterval, mqmq.DefaultDedupWindow, mqmq.DefaultMaxMessageSize, mqmq.DefaultMaxFrameSize, mqmq.MaxQueueNameLen, mqmq.MaxGetTimeout)
 
 	fmt.Println(usage)
 	os.Exit(1)
@@ -0,0 +1,232 @@
+package mqmq
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressionThreshold is the default minimum size of the message body
+// that is compressed. Smaller messages are sent as is.
+const DefaultCompressionThreshold = 1024
+
+// CapabilityCompressionPrefix is the prefix of the capability names that
+// negotiate the message body compression, e.g. "compress-flate".
+const CapabilityCompressionPrefix = "compress-"
+
+// Codec compresses and decompresses message bodies.
+// Codecs are negotiated by name in the handshake, so a codec must be registered
+// with the same name on both the client and the server side.
+type Codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var errBadMessageEncoding = errors.New("mqmq: bad message encoding")
+
+// Message encodings. When the compression is negotiated, every message body
+// item is prefixed with the encoding byte.
+const (
+	messageRaw        byte = 0
+	messageCompressed byte = 1
+)
+
+var codecs struct {
+	sync.RWMutex
+	names  []string
+	byName map[string]Codec
+}
+
+func init() {
+	RegisterCodec(flateCodec{})
+	RegisterCodec(gzipCodec{})
+}
+
+// RegisterCodec makes the codec available for the negotiation. Clients offer
+// the registered codecs in the order of registration. Registering a codec
+// with the name of an existing one replaces it.
+func RegisterCodec(codec Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	if codecs.byName == nil {
+		codecs.byName = make(map[string]Codec)
+	}
+	if _, ok := codecs.byName[codec.Name()]; !ok {
+		codecs.names = append(codecs.names, codec.Name())
+	}
+	codecs.byName[codec.Name()] = codec
+}
+
+// codecByName returns the registered codec or nil.
+func codecByName(name string) Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return codecs.byName[name]
+}
+
+// codecNames returns the names of the registered codecs in the order of registration.
+func codecNames() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return append([]string(nil), codecs.names...)
+}
+
+// codecCapability returns the registered codec negotiated by the capability.
+func codecCapability(capability string) (Codec, bool) {
+	if !strings.HasPrefix(capability, CapabilityCompressionPrefix) {
+		return nil, false
+	}
+	codec := codecByName(strings.TrimPrefix(capability, CapabilityCompressionPrefix))
+	return codec, codec != nil
+}
+
+// encodeMessage returns the message body item. If codec is nil, the message is
+// returned as is. Otherwise messages of at least threshold bytes are compressed
+// unless the compression doesn't make them smaller. Messages larger than
+// maxMsgLen are never compressed, as they can't be decompressed (see readDecompressed).
+func encodeMessage(codec Codec, threshold int, message []byte) []byte {
+	if codec == nil {
+		return message
+	}
+
+	if len(message) >= threshold && len(message) <= maxMsgLen {
+		compressed, err := codec.Compress(message)
+		if err == nil && len(compressed) < len(message) {
+			return append([]byte{messageCompressed}, compressed...)
+		}
+	}
+
+	return append([]byte{messageRaw}, message...)
+}
+
+// decodeMessage returns the message body from the item made by encodeMessage.
+func decodeMessage(codec Codec, item []byte) ([]byte, error) {
+	if codec == nil {
+		return item, nil
+	}
+
+	if len(item) < 1 {
+		return nil, errBadMessageEncoding
+	}
+
+	switch item[0] {
+	case messageRaw:
+		return item[1:], nil
+	case messageCompressed:
+		message, err := codec.Decompress(item[1:])
+		if err != nil {
+			return nil, errBadMessageEncoding
+		}
+		return message, nil
+	}
+	return nil, errBadMessageEncoding
+}
+
+// flateCodec is the DEFLATE codec (RFC 1951).
+type flateCodec struct{}
+
+func (flateCodec) Name() string { return "flate" }
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readDecompressed(r)
+}
+
+// gzipCodec is the gzip codec (RFC 1952).
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readDecompressed(r)
+}
+
+// readDecompressed reads the decompressed message limiting its size
+// to the maximum message length.
+func readDecompressed(r io.Reader) ([]byte, error) {
+	message, err := ioutil.ReadAll(io.LimitReader(r, maxMsgLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > maxMsgLen {
+		return nil, errors.New("mqmq: decompressed message is too large")
+	}
+	return message, nil
+}
+
+// sameCodec reports whether both codecs are set and have the same name.
+func sameCodec(a, b Codec) bool {
+	return a != nil && b != nil && a.Name() == b.Name()
+}
+
+// receiveMessage converts the message body item received from the client
+// to the queue storage format. The result never shares memory with the item.
+func (c *connection) receiveMessage(item []byte) ([]byte, error) {
+	if sameCodec(c.codec, c.server.storageCodec) {
+		if len(item) < 1 || item[0] > messageCompressed {
+			return nil, errBadMessageEncoding
+		}
+		return append([]byte(nil), item...), nil
+	}
+
+	message, err := decodeMessage(c.codec, item)
+	if err != nil {
+		return nil, err
+	}
+	return c.server.storeMessage(message), nil
+}
+
+// messageItem converts the stored message to the message body item sent to the client.
+func (c *connection) messageItem(stored []byte) ([]byte, error) {
+	if sameCodec(c.codec, c.server.storageCodec) {
+		return stored, nil
+	}
+
+	message, err := c.server.loadMessage(stored)
+	if err != nil {
+		return nil, err
+	}
+	return encodeMessage(c.codec, c.server.compressThreshold, message), nil
+}
@@ -0,0 +1,175 @@
+package mqmq
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func startServerWithCodec(codec string) (*Server, string) {
+	s := NewServer()
+	s.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	if codec != "" {
+		err := s.SetStorageCodec(codec)
+		if err != nil {
+			panic("Test server start failed: SetStorageCodec: " + err.Error())
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("Test server start failed: net.Listen: " + err.Error())
+	}
+	go s.Serve(listener)
+
+	for s.State() == ServerStateNew {
+		time.Sleep(time.Millisecond)
+	}
+
+	return s, listener.Addr().String()
+}
+
+func jsonMessage(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"id":%d,"name":"item-%d","tags":["alpha","beta"],"active":true}`, i, i)
+	}
+	buf.WriteString("]")
+	return buf.Bytes()
+}
+
+func TestCodecs(t *testing.T) {
+	message := jsonMessage(100)
+	for _, name := range []string{"flate", "gzip"} {
+		codec := codecByName(name)
+		if codec == nil {
+			t.Fatalf("failed codecByName: codec %q is not registered", name)
+		}
+
+		item := encodeMessage(codec, 1, message)
+		if item[0] != messageCompressed || len(item) > len(message)/5 {
+			t.Fatalf("failed encodeMessage %s: %d bytes compressed to %d", name, len(message), len(item))
+		}
+		out, err := decodeMessage(codec, item)
+		if err != nil || !bytes.Equal(out, message) {
+			t.Fatalf("failed decodeMessage %s: %v", name, err)
+		}
+
+		// Small messages are not compressed.
+		item = encodeMessage(codec, len(message)+1, message)
+		if item[0] != messageRaw || !bytes.Equal(item[1:], message) {
+			t.Fatalf("failed encodeMessage %s: message below the threshold is compressed", name)
+		}
+
+		_, err = decodeMessage(codec, []byte{messageCompressed, 1, 2, 3})
+		if err == nil {
+			t.Fatalf("failed decodeMessage %s: expected error for corrupted data", name)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	small := []byte("test-message")
+	large := jsonMessage(100)
+
+	for _, storageCodec := range []string{"", "flate", "gzip"} {
+		s, addr := startServerWithCodec(storageCodec)
+
+		var clients []*Client
+		for _, codecs := range [][]string{nil, {}, {"gzip", "flate"}, {"unknown"}} {
+			c := NewClient()
+			if codecs != nil {
+				c.SetCompression(DefaultCompressionThreshold, codecs...)
+			}
+			err := c.Connect(addr)
+			if err != nil {
+				t.Fatalf("failed c.Connect: %s", err)
+			}
+			defer c.Disconnect()
+
+			// By default all the registered codecs are offered.
+			want := "flate"
+			if codecs != nil {
+				want = ""
+				if len(codecs) > 0 && codecs[0] != "unknown" {
+					want = codecs[0]
+				}
+			}
+			if c.Compression() != want {
+				t.Fatalf("failed c.Compression: expected %q, got %q", want, c.Compression())
+			}
+			clients = append(clients, c)
+		}
+
+		// Every client gets the messages put by every other client.
+		for i, putClient := range clients {
+			for j, getClient := range clients {
+				for _, message := range [][]byte{small, large} {
+					err := putClient.Put("test-queue", message)
+					if err != nil {
+						t.Fatalf("failed c.Put (client %d -> %d): %s", i, j, err)
+					}
+					out, err := getClient.Get("test-queue", time.Second)
+					if err != nil || !bytes.Equal(out, message) {
+						t.Fatalf("failed c.Get (client %d -> %d, storage %q): %v", i, j, storageCodec, err)
+					}
+				}
+			}
+		}
+
+		// The stored large messages are compressed if the storage codec is set.
+		err := clients[1].Put("test-queue", large)
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+		stored := queueContents(s)["test-queue"][0]
+		if compressed := len(stored) < len(large)/5; compressed != (storageCodec != "") {
+			t.Fatalf("failed Put: storage codec %q, stored %d of %d bytes", storageCodec, len(stored), len(large))
+		}
+
+		s.Stop()
+	}
+}
+
+func TestCompressionReplication(t *testing.T) {
+	s, addr := startServerWithCodec("flate")
+	defer s.Stop()
+
+	replica, _ := startReplica(addr)
+	defer replica.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	large := jsonMessage(100)
+	err = c.Put("test-queue", large)
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+
+	// The replica stores the messages uncompressed.
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		messages := queueContents(replica)["test-queue"]
+		if len(messages) == 1 {
+			if !bytes.Equal(messages[0], large) {
+				t.Fatalf("failed replication: unexpected replica message")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("failed replication: replica is not in sync")
+}
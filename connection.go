@@ -3,6 +3,7 @@ package mqmq
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"net"
 	"strconv"
@@ -10,16 +11,21 @@ import (
 	"time"
 )
 
-// MaxGetTimeout is the maximum timeout value allowed for Get request.
+// MaxGetTimeout is the default maximum timeout value allowed for Get request
+// (see ServerLimits).
 const MaxGetTimeout = 1 * time.Hour
 
-// MaxQueueNameLen is the maximum queue name length allowed.
+// MaxQueueNameLen is the default maximum queue name length allowed
+// (see ServerLimits).
 const MaxQueueNameLen = 1024
 
+// DefaultMaxMessageSize is the default maximum message size allowed.
+// Messages larger than 32 MB can only be sent in chunks (see Client.PutReader).
+const DefaultMaxMessageSize = maxMsgLen
+
 const (
-	maxGetTimeoutMsec = int(MaxGetTimeout / time.Millisecond)
-	maxMsgLen         = 32 * 1024 * 1024
-	maxFrameLen       = 4 + 3 + 4 + MaxQueueNameLen + 4 + maxMsgLen
+	maxMsgLen   = 32 * 1024 * 1024
+	maxFrameLen = 4 + 3 + 4 + MaxQueueNameLen + 4 + maxMsgLen
 )
 
 var (
@@ -33,27 +39,111 @@ var (
 )
 
 type connection struct {
-	server  *Server
-	conn    net.Conn
-	reader  *bufio.Reader
-	writer  *bufio.Writer
-	stopped int32
-	done    chan struct{}
+	server   *Server
+	conn     net.Conn
+	ip       string
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	requests chan *frameBuffer
+	stopped  int32
+	done     chan struct{}
+	proxy    *Client
+	// Name of the temporary reply queue (see handleReplyQueue).
+	replyQueue string
+
+	// Compression codec negotiated by the Hello request.
+	codec Codec
 }
 
 func newConnection(server *Server, conn net.Conn) *connection {
 	return &connection{
-		server: server,
-		conn:   conn,
-		reader: bufio.NewReader(conn),
-		writer: bufio.NewWriter(conn),
-		done:   make(chan struct{}),
+		server:   server,
+		conn:     conn,
+		ip:       remoteIP(conn),
+		reader:   bufio.NewReader(conn),
+		writer:   bufio.NewWriter(conn),
+		requests: make(chan *frameBuffer),
+		done:     make(chan struct{}),
 	}
 }
 
 func (c *connection) run() {
+	// Frames are read in a separate goroutine so that a client disconnect
+	// is noticed while a request (e.g. a blocking Get) is being handled.
+	go c.readLoop()
+
+	defer func() {
+		if c.proxy != nil {
+			c.proxy.Disconnect()
+		}
+	}()
+
 	for c.running() {
-		f, err := c.recv()
+		var b *frameBuffer
+		select {
+		case <-c.done:
+			return
+		case b = <-c.requests:
+		}
+
+		// The request frame items are valid until the buffer is released,
+		// so the handlers copy the items they keep.
+		if b.skipped {
+			c.sendOrStop(errorFrame(ErrRequestTooLarge, "request is larger than "+strconv.Itoa(c.server.limits.MaxFrameSize)+" bytes"))
+		} else {
+			c.handle(b.f)
+		}
+		b.release()
+	}
+}
+
+// handle dispatches the request to its handler.
+func (c *connection) handle(f frame) {
+	switch {
+	case len(f) == 0:
+		c.sendOrStop(errorFrame(ErrBadParams, "request is empty"))
+	case bytes.Equal(f[0], bHello):
+		c.handleHello(f)
+	case bytes.Equal(f[0], bGet):
+		c.handleGet(f)
+	case bytes.Equal(f[0], bPut):
+		c.handlePut(f)
+	case bytes.Equal(f[0], bGetAny):
+		c.handleGetAny(f)
+	case bytes.Equal(f[0], bPutStream):
+		c.handlePutStream(f)
+	case bytes.Equal(f[0], bGetStream):
+		c.handleGetStream(f)
+	case bytes.Equal(f[0], bPurge):
+		c.handlePurge(f)
+	case bytes.Equal(f[0], bSnapshot):
+		c.handleSnapshot(f)
+	case bytes.Equal(f[0], bReplyQueue):
+		c.handleReplyQueue(f)
+	case bytes.Equal(f[0], bMove):
+		c.handleTransfer(f, true)
+	case bytes.Equal(f[0], bCopy):
+		c.handleTransfer(f, false)
+	case bytes.Equal(f[0], bInfo):
+		c.handleInfo(f)
+	case bytes.Equal(f[0], bQuit):
+		c.handleQuit(f)
+	case bytes.Equal(f[0], bReplicate):
+		c.handleReplicate(f)
+	case bytes.Equal(f[0], bPromote):
+		c.handlePromote(f)
+	case bytes.Equal(f[0], bVote):
+		c.handleVote(f)
+	case bytes.Equal(f[0], bFollow):
+		c.handleFollow(f)
+	default:
+		c.handleUnknownCmd(f)
+	}
+}
+
+func (c *connection) readLoop() {
+	for {
+		b, err := readFrameBufferOrSkip(c.reader, uint32(c.server.limits.MaxFrameSize))
 		if err != nil {
 			if c.running() {
 				c.server.logf("ERROR: failed to read frame (%s): %s", c.conn.RemoteAddr(), err)
@@ -62,17 +152,11 @@ func (c *connection) run() {
 			return
 		}
 
-		switch {
-		case bytes.Equal(f[0], bGet):
-			c.handleGet(f)
-		case bytes.Equal(f[0], bPut):
-			c.handlePut(f)
-		case bytes.Equal(f[0], bInfo):
-			c.handleInfo(f)
-		case bytes.Equal(f[0], bQuit):
-			c.handleQuit(f)
-		default:
-			c.handleUnknownCmd(f)
+		select {
+		case <-c.done:
+			b.release()
+			return
+		case c.requests <- b:
 		}
 	}
 }
@@ -89,21 +173,87 @@ func (c *connection) stop() {
 	c.conn.Close()
 }
 
-func (c *connection) send(f frame) error {
-	err := writeFrame(c.writer, f, maxFrameLen)
+// proxyToLeader forwards the request to the cluster leader and sends the leader response back.
+func (c *connection) proxyToLeader(f frame) {
+	leader := c.server.raft.leaderAddr()
+	if leader == "" || leader == c.server.raft.self {
+		c.sendOrStop(errorFrame(ErrClusterNoLeader, "cluster leader is not elected"))
+		return
+	}
+
+	if c.proxy != nil && c.proxy.addr != leader {
+		c.proxy.Disconnect()
+		c.proxy = nil
+	}
+
+	if c.proxy == nil {
+		c.proxy = NewClient()
+		c.proxy.SetCompression(0)
+		err := c.proxy.Connect(leader)
+		if err != nil {
+			c.proxy = nil
+			c.sendOrStop(errorFrame(ErrClusterNoLeader, "failed to connect to cluster leader "+leader))
+			return
+		}
+	}
+
+	// The leader connection doesn't use compression,
+	// so the message bodies are decoded and encoded here.
+	if bytes.Equal(f[0], bPut) && len(f) >= 3 {
+		message, err := decodeMessage(c.codec, f[2])
+		if err != nil {
+			c.sendOrStop(errorFrame(ErrBadParams, "failed to decode message: "+err.Error()))
+			return
+		}
+		// The dedup key, if any, follows the message.
+		f = append(frame{f[0], f[1], message}, f[3:]...)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	response, err := c.proxy.cmd(ctx, f)
+	cancel()
+
 	if err != nil {
-		return err
+		c.proxy.Disconnect()
+		c.proxy = nil
+		if c.running() {
+			c.sendOrStop(errorFrame(ErrClusterNoLeader, "request to cluster leader "+leader+" failed"))
+		}
+		return
+	}
+
+	if bytes.Equal(f[0], bGet) && len(response) >= 2 && bytes.Equal(response[0], bOK) {
+		response = frame{bOK, encodeMessage(c.codec, c.server.compressThreshold, response[1])}
 	}
-	return c.writer.Flush()
+	if bytes.Equal(f[0], bGetAny) && len(response) >= 3 && bytes.Equal(response[0], bOK) {
+		response = frame{bOK, response[1], encodeMessage(c.codec, c.server.compressThreshold, response[2])}
+	}
+
+	c.sendOrStop(response)
 }
 
-func (c *connection) recv() (frame, error) {
-	return readFrame(c.reader, maxFrameLen)
+// send writes the frame to the connection directly. The writer buffer is
+// used only for the replication streams and is flushed after each batch.
+func (c *connection) send(f frame) error {
+	return writeFrame(c.conn, f, uint32(c.server.limits.MaxFrameSize))
 }
 
 func (c *connection) sendOrStop(f frame) {
 	err := c.send(f)
-	if err != nil && c.running() {
+	if err != nil {
+		c.stopOnWriteError(err)
+	}
+}
+
+func (c *connection) stopOnWriteError(err error) {
+	if c.running() {
 		c.server.logf("ERROR: failed to write frame (%s): %s", c.conn.RemoteAddr(), err)
 		c.stop()
 	}
@@ -112,99 +262,336 @@ func (c *connection) sendOrStop(f frame) {
 // Request handler: Put <queue> <message>
 func (c *connection) handlePut(f frame) {
 	if len(f) < 3 {
-		c.sendOrStop(frame{bError, []byte("REQUEST_BAD_PARAMS")})
+		c.sendOrStop(errorFrame(ErrBadParams, "Put requires queue name and message"))
 		return
 	}
 
 	qname := string(f[1])
-	if len(qname) > MaxQueueNameLen {
-		c.sendOrStop(frame{bError, []byte("REQUEST_BAD_QUEUE_NAME")})
+	if errf := c.checkQueueName(qname); errf != nil {
+		c.sendOrStop(errf)
 		return
 	}
 
-	message := f[2]
+	if max := c.server.maxMessageSize(qname); len(f[2]) > max {
+		c.sendOrStop(errorFrame(ErrMessageTooLarge, "message is larger than "+strconv.Itoa(max)+" bytes"))
+		return
+	}
+
+	term, stepDown, ok := c.acceptRequest(f, true)
+	if !ok {
+		return
+	}
 
-	q, err := c.server.getQueue(qname)
+	message, err := c.receiveMessage(f[2])
 	if err != nil {
+		c.sendOrStop(errorFrame(ErrBadParams, "failed to decode message: "+err.Error()))
 		return
 	}
 
+	var key string
+	if len(f) >= 4 {
+		key = string(f[3])
+	}
+	if key == "" {
+		c.putMessage(qname, message, term, stepDown)
+		return
+	}
+
+	// The duplicate is discarded as if it was put. The duplicate of the message
+	// being put waits for the outcome of the put.
+	for {
+		ok, pending := c.server.dedup.add(qname, key, c.server.dedupWindow(qname), time.Now())
+		if ok {
+			break
+		}
+		if pending == nil {
+			c.sendOrStop(frame{bOK})
+			return
+		}
+		select {
+		case <-pending:
+		case <-c.done:
+			return
+		}
+	}
+
+	appended := c.putMessage(qname, message, term, stepDown)
+	c.server.dedup.finish(qname, key, appended)
+}
+
+// acceptRequest checks that the server handles Put and Get requests. Cluster
+// followers proxy the request f to the leader if proxy is set or reject it
+// otherwise. It reports false if the request is already responded to.
+func (c *connection) acceptRequest(f frame, proxy bool) (term uint64, stepDown <-chan struct{}, ok bool) {
+	if c.server.Role() != ServerRolePrimary {
+		c.sendOrStop(errorFrame(ErrServerReplica, "server is a standby replica"))
+		return 0, nil, false
+	}
+
+	if r := c.server.raft; r != nil {
+		var leader bool
+		term, stepDown, leader = r.leaderTerm()
+		if !leader {
+			if proxy {
+				c.proxyToLeader(f)
+			} else {
+				c.sendOrStop(errorFrame(ErrClusterNotLeader, "request must be sent to cluster leader "+r.leaderAddr()))
+			}
+			return 0, nil, false
+		}
+	}
+
+	return term, stepDown, true
+}
+
+// putMessage appends the stored message to the queue and responds to the client.
+// It reports whether the message is appended to the queue.
+func (c *connection) putMessage(qname string, message []byte, term uint64, stepDown <-chan struct{}) bool {
+	q, errf := c.queue(qname)
+	if errf != nil {
+		c.sendOrStop(errf)
+		return false
+	}
+
 	select {
 	case <-c.done:
-		return
-	case q.enqueue() <- message:
-		c.sendOrStop(frame{bOK})
+		return false
+	case <-stepDown:
+		c.sendOrStop(errorFrame(ErrClusterNotLeader, "server stopped being cluster leader"))
+		return false
+	default:
 	}
+
+	err := q.enqueue(message)
+	if err != nil {
+		c.server.logf("ERROR: failed to store message (%s): %s", qname, err)
+		c.sendOrStop(errorFrame(ErrServerInternal, "failed to store message"))
+		return false
+	}
+
+	if c.server.wal != nil {
+		err := c.server.wal.wait(c.done, q)
+		if err == errWALAborted {
+			return true
+		}
+		if err != nil {
+			c.server.logf("ERROR: failed to write message to write-ahead log (%s): %s", qname, err)
+			c.sendOrStop(errorFrame(ErrServerInternal, "failed to write message to write-ahead log"))
+			return true
+		}
+	}
+
+	if c.server.raft != nil {
+		err := c.server.raft.commit(q, term, c.done)
+		if err != nil {
+			c.sendOrStop(errorFrame(ErrClusterNotLeader, "server stopped being cluster leader"))
+			return true
+		}
+	}
+
+	c.sendOrStop(frame{bOK})
+	return true
+}
+
+// checkQueueName returns the error response frame if the queue name is too long
+// or doesn't satisfy the queue name grammar (see ValidQueueName).
+func (c *connection) checkQueueName(qname string) frame {
+	if max := c.server.limits.MaxQueueNameLen; len(qname) > max {
+		return errorFrame(ErrBadQueueName, "queue name is longer than "+strconv.Itoa(max)+" bytes")
+	}
+	if !ValidQueueName(qname) {
+		return errorFrame(ErrBadQueueName, "queue name must consist of dot-separated segments of letters, digits, '_' and '-'")
+	}
+	return nil
+}
+
+// queue returns the queue for the client request or the error response frame.
+func (c *connection) queue(qname string) (queue, frame) {
+	if isReplyQueue(qname) {
+		return c.lookupReplyQueue(qname, false)
+	}
+	q, err := c.server.getQueue(qname, false)
+	if err == errMaxQueues {
+		return nil, errorFrame(ErrLimitQueues, "server has reached the maximum of "+strconv.Itoa(c.server.limits.MaxQueues)+" queues")
+	}
+	if err == errQueueBackend {
+		return nil, errorFrame(ErrServerInternal, "failed to create queue")
+	}
+	if err != nil {
+		return nil, errorFrame(ErrServerStopping, "server is stopping")
+	}
+	return q, nil
+}
+
+// consumerQueue returns the queue the client takes the messages from or
+// the error response frame. Only the owner takes the messages from a reply queue.
+func (c *connection) consumerQueue(qname string) (queue, frame) {
+	if isReplyQueue(qname) {
+		return c.lookupReplyQueue(qname, true)
+	}
+	return c.queue(qname)
 }
 
 // Request handler: Get <queue> <timeout>
 func (c *connection) handleGet(f frame) {
+	c.get(f, false)
+}
+
+// get handles the Get and GetStream requests.
+// If chunked is set, the message is sent in chunks.
+func (c *connection) get(f frame, chunked bool) {
 	if len(f) < 2 {
-		c.sendOrStop(frame{bError, []byte("REQUEST_BAD_PARAMS")})
+		c.sendOrStop(errorFrame(ErrBadParams, string(f[0])+" requires queue name"))
 		return
 	}
 
 	qname := string(f[1])
-	if len(qname) > MaxQueueNameLen {
-		c.sendOrStop(frame{bError, []byte("REQUEST_BAD_QUEUE_NAME")})
+	if errf := c.checkQueueName(qname); errf != nil {
+		c.sendOrStop(errf)
 		return
 	}
 
-	timeoutMsec := 1
+	var timeoutValue []byte
 	if len(f) >= 3 {
+		timeoutValue = f[2]
+	}
+	timeout, errf := c.parseTimeout(timeoutValue)
+	if errf != nil {
+		c.sendOrStop(errf)
+		return
+	}
+
+	term, stepDown, ok := c.acceptRequest(f, !chunked)
+	if !ok {
+		return
+	}
+
+	q, errf := c.consumerQueue(qname)
+	if errf != nil {
+		c.sendOrStop(errf)
+		return
+	}
+
+	// The consumers waiting for the queue get the messages in turn.
+	w := q.wait()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.done:
+		q.cancel(w)
+	case <-stepDown:
+		q.cancel(w)
+		c.sendOrStop(errorFrame(ErrClusterNotLeader, "server stopped being cluster leader"))
+	case message := <-w.message():
+		c.deliver(q, qname, message, term, stepDown, chunked, frame{bOK})
+	case <-timer.C:
+		q.cancel(w)
+		c.sendOrStop(frame{bTimeout})
+	}
+}
+
+// parseTimeout parses the Get timeout in milliseconds. The timeout is
+// 1 millisecond if the value is missing. It returns the error response
+// frame if the timeout is invalid.
+func (c *connection) parseTimeout(value []byte) (time.Duration, frame) {
+	timeoutMsec := 1
+	if value != nil {
 		var err error
-		timeoutMsec, err = strconv.Atoi(string(f[2]))
+		timeoutMsec, err = strconv.Atoi(string(value))
 		if err != nil {
-			c.sendOrStop(frame{bError, []byte("REQUEST_BAD_TIMEOUT")})
-			return
+			return 0, errorFrame(ErrBadTimeout, "timeout is not an integer number of milliseconds")
 		}
 	}
 
-	if timeoutMsec > maxGetTimeoutMsec {
-		c.sendOrStop(frame{bError, []byte("REQUEST_BAD_TIMEOUT")})
-		return
+	if max := c.server.limits.MaxGetTimeout; timeoutMsec > int(max/time.Millisecond) {
+		return 0, errorFrame(ErrBadTimeout, "timeout is longer than "+max.String())
 	}
 
 	if timeoutMsec < 1 {
 		timeoutMsec = 1
 	}
-	timeout := time.Duration(timeoutMsec) * time.Millisecond
+	return time.Duration(timeoutMsec) * time.Millisecond, nil
+}
+
+// deliver sends the message dequeued from the queue to the client. Unless
+// the message is sent in chunks, the response is the head frame followed by
+// the message. The message is put back if it can't be delivered.
+func (c *connection) deliver(q queue, qname string, message []byte, term uint64, stepDown <-chan struct{}, chunked bool, head frame) {
+	var err error
+	if c.server.raft != nil {
+		err = c.server.raft.commit(q, term, c.done)
+		if err == errCommitAborted {
+			// The client is gone, so the leader puts the message back.
+			select {
+			case <-stepDown:
+			default:
+				c.requeue(q, qname, message)
+			}
+			return
+		}
+		if err != nil {
+			c.sendOrStop(errorFrame(ErrClusterNotLeader, "server stopped being cluster leader"))
+			return
+		}
+	}
 
-	q, err := c.server.getQueue(qname)
+	var item []byte
+	if chunked {
+		item, err = c.server.loadMessage(message)
+	} else {
+		item, err = c.messageItem(message)
+	}
 	if err != nil {
+		c.server.logf("ERROR: failed to decode stored message (%s): %s", qname, err)
+		c.sendOrStop(errorFrame(ErrServerInternal, "failed to decode stored message"))
 		return
 	}
 
-	select {
-	case <-c.done:
+	if chunked {
+		err = c.sendChunks(item)
+	} else {
+		err = c.send(append(head, item))
+	}
+	if err == ErrFrameLen {
+		// The message doesn't fit into a frame, so it is left for GetStream.
+		c.requeue(q, qname, message)
+		c.sendOrStop(errorFrame(ErrMessageTooLarge, "message doesn't fit into "+strconv.Itoa(c.server.limits.MaxFrameSize)+" bytes frame, use GetStream"))
 		return
-	case message := <-q.dequeue():
-		err = c.send(frame{bOK, []byte(message)})
-		if err != nil {
-			// Failed to send this message so lets put it back into the queue.
-			select {
-			case <-c.done:
-				return
-			case q.requeue() <- message:
-			}
-			if c.running() {
-				c.server.logf("ERROR: failed to write frame (%s): %s", c.conn.RemoteAddr(), err)
-				c.stop()
-			}
-		}
-	case <-time.After(timeout):
-		c.sendOrStop(frame{bTimeout})
+	}
+	if err != nil {
+		// Failed to send this message so lets put it back into the queue.
+		c.requeue(q, qname, message)
+		c.stopOnWriteError(err)
 	}
 }
 
-// Request handler: Info
+// requeue puts the undelivered message back to the front of the queue.
+func (c *connection) requeue(q queue, qname string, message []byte) {
+	err := q.requeue(message)
+	if err != nil {
+		c.server.logf("ERROR: failed to put message back (%s): %s", qname, err)
+	}
+}
+
+// Request handler: Info [<queue pattern>]
+//
+// Only the queues matching the pattern are included in the queue information.
 func (c *connection) handleInfo(f frame) {
-	info := c.server.Info()
+	pattern := "*"
+	if len(f) >= 2 {
+		pattern = string(f[1])
+		if !ValidQueuePattern(pattern) {
+			c.sendOrStop(errorFrame(ErrBadQueueName, "bad queue pattern "+strconv.Quote(pattern)))
+			return
+		}
+	}
+	info := c.server.info(pattern)
 
 	infoJSON, err := json.Marshal(info)
 	if err != nil {
 		c.server.logf("ERROR: failed to marshal json info (%s): %s", c.conn.RemoteAddr(), err)
-		c.stop()
+		c.sendOrStop(errorFrame(ErrServerInternal, "failed to marshal server info"))
 		return
 	}
 
@@ -213,11 +600,11 @@ func (c *connection) handleInfo(f frame) {
 
 // Request handler: Quit
 func (c *connection) handleQuit(f frame) {
+	c.send(frame{bOK})
 	c.stop()
 }
 
 // Request handler: unknown command
 func (c *connection) handleUnknownCmd(f frame) {
-	c.send(frame{bError, []byte("REQUEST_UNKNOWN_COMMAND")})
-	c.stop()
+	c.sendOrStop(errorFrame(ErrUnknownCommand, "unknown command "+strconv.Quote(string(f[0]))))
 }
@@ -0,0 +1,167 @@
+package mqmq
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// replyCase is a request and the expected response result and error code.
+type replyCase struct {
+	request frame
+	result  []byte
+	err     error
+}
+
+// checkReplies sends each request followed by Info to a raw server connection
+// and checks that the request gets exactly one response of the expected kind.
+func checkReplies(t *testing.T, addr string, requests []replyCase) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed net.Dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	for _, r := range requests {
+		err = writeFrame(conn, r.request, maxFrameLen)
+		if err == nil {
+			err = writeFrame(conn, frame{bInfo}, maxFrameLen)
+		}
+		if err != nil {
+			t.Fatalf("failed writeFrame: %s", err)
+		}
+
+		response, err := readFrame(reader, maxFrameLen)
+		if err != nil {
+			t.Fatalf("failed readFrame for %q: %s", r.request, err)
+		}
+		if len(response) < 1 || !bytes.Equal(response[0], r.result) {
+			t.Fatalf("failed %q: expected %q response, got %q", r.request, r.result, response)
+		}
+		if r.err != nil {
+			if err := responseError(response); !errors.Is(err, r.err) {
+				t.Fatalf("failed %q: expected %v, got %v", r.request, r.err, err)
+			}
+		}
+
+		// The next response must belong to the Info request.
+		response, err = readFrame(reader, maxFrameLen)
+		if err != nil {
+			t.Fatalf("failed readFrame for Info after %q: %s", r.request, err)
+		}
+		if len(response) != 2 || !bytes.Equal(response[0], bOK) || !bytes.HasPrefix(response[1], []byte("{")) {
+			t.Fatalf("failed Info after %q: unexpected response %q", r.request, response)
+		}
+	}
+
+	// Quit is answered before the connection is closed.
+	err = writeFrame(conn, frame{bQuit}, maxFrameLen)
+	if err != nil {
+		t.Fatalf("failed writeFrame: %s", err)
+	}
+	response, err := readFrame(reader, maxFrameLen)
+	if err != nil || len(response) != 1 || !bytes.Equal(response[0], bOK) {
+		t.Fatalf("failed Quit: expected OK, got %q, %v", response, err)
+	}
+	_, err = readFrame(reader, maxFrameLen)
+	if err == nil {
+		t.Fatalf("failed Quit: connection is not closed")
+	}
+}
+
+func TestRequestReplies(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	longName := bytes.Repeat([]byte("q"), MaxQueueNameLen+1)
+
+	checkReplies(t, addr, []replyCase{
+		{frame{}, bError, ErrBadParams},
+		{frame{[]byte("Unknown")}, bError, ErrUnknownCommand},
+		{frame{bHello}, bError, ErrBadParams},
+		{frame{bHello, []byte("x")}, bError, ErrBadParams},
+		{frame{bHello, []byte("1")}, bOK, nil},
+		{frame{bPut}, bError, ErrBadParams},
+		{frame{bPut, []byte("test-queue")}, bError, ErrBadParams},
+		{frame{bPut, longName, []byte("test-message")}, bError, ErrBadQueueName},
+		{frame{bPut, []byte("test..queue"), []byte("test-message")}, bError, ErrBadQueueName},
+		{frame{bPut, []byte("test-queue"), []byte("test-message")}, bOK, nil},
+		{frame{bGet}, bError, ErrBadParams},
+		{frame{bGet, longName}, bError, ErrBadQueueName},
+		{frame{bGet, []byte("test-queue"), []byte("x")}, bError, ErrBadTimeout},
+		{frame{bGet, []byte("test-queue"), []byte("999999999999")}, bError, ErrBadTimeout},
+		{frame{bGet, []byte("test-queue"), []byte("100")}, bOK, nil},
+		{frame{bGet, []byte("test-queue"), []byte("1")}, bTimeout, nil},
+		{frame{bGet, []byte("test-queue")}, bTimeout, nil},
+		{frame{bGetAny, []byte("1")}, bError, ErrBadParams},
+		{frame{bGetAny, []byte("x"), []byte("test-queue")}, bError, ErrBadTimeout},
+		{frame{bGetAny, []byte("1"), []byte("test-queue"), longName}, bError, ErrBadQueueName},
+		{frame{bGetAny, []byte("1"), []byte("test-queue"), []byte("test-queue-2")}, bTimeout, nil},
+		{frame{bInfo}, bOK, nil},
+		{frame{bInfo, []byte("test.*")}, bOK, nil},
+		{frame{bInfo, []byte("test*")}, bError, ErrBadQueueName},
+		{frame{bPurge}, bError, ErrBadParams},
+		{frame{bPurge, []byte("*.test")}, bError, ErrBadQueueName},
+		{frame{bPurge, []byte("*")}, bOK, nil},
+		{frame{bSnapshot, []byte("test*")}, bError, ErrBadQueueName},
+		{frame{bReplyQueue}, bOK, nil},
+		{frame{bGet, []byte("_reply.test")}, bError, ErrReplyQueue},
+		{frame{bPut, []byte("_reply.test"), []byte("test-message")}, bError, ErrReplyQueue},
+		{frame{bMove, []byte("test-queue"), []byte("test-queue-2")}, bError, ErrBadParams},
+		{frame{bMove, []byte("test-queue"), longName, []byte("1")}, bError, ErrBadQueueName},
+		{frame{bMove, []byte("test-queue"), []byte("test-queue-2"), []byte("0")}, bError, ErrBadParams},
+		{frame{bMove, []byte("test-queue"), []byte("test-queue-2"), []byte("1")}, bOK, nil},
+		{frame{bCopy, []byte("test..queue"), []byte("test-queue-2"), []byte("1")}, bError, ErrBadQueueName},
+		{frame{bCopy, []byte("test-queue"), []byte("test-queue-2"), []byte("x")}, bError, ErrBadParams},
+		{frame{bCopy, []byte("test-queue"), []byte("test-queue-2"), []byte("1")}, bOK, nil},
+		{frame{bPromote}, bError, ErrServerNotReplica},
+		{frame{bVote, []byte("1"), []byte("candidate"), []byte("0"), []byte("0")}, bError, ErrServerNotClustered},
+		{frame{bFollow, []byte("1"), []byte("leader")}, bError, ErrServerNotClustered},
+	})
+}
+
+func TestRequestRepliesReplica(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	replica, replicaAddr := startReplica(addr)
+	defer replica.Stop()
+
+	checkReplies(t, replicaAddr, []replyCase{
+		{frame{bPut, []byte("test-queue"), []byte("test-message")}, bError, ErrServerReplica},
+		{frame{bGet, []byte("test-queue"), []byte("1")}, bError, ErrServerReplica},
+		{frame{bPurge, []byte("*")}, bError, ErrServerReplica},
+		{frame{bMove, []byte("test-queue"), []byte("test-queue-2"), []byte("1")}, bError, ErrServerReplica},
+		{frame{bReplyQueue}, bError, ErrServerReplica},
+		{frame{bReplicate}, bError, ErrServerReplica},
+		{frame{bInfo}, bOK, nil},
+	})
+}
+
+func TestRequestRepliesCluster(t *testing.T) {
+	servers, addrs := startCluster(1)
+	defer servers[0].Stop()
+	waitLeader(t, servers)
+
+	checkReplies(t, addrs[0], []replyCase{
+		{frame{bVote}, bError, ErrBadParams},
+		{frame{bVote, []byte("x"), []byte("candidate"), []byte("0"), []byte("0")}, bError, ErrBadParams},
+		{frame{bVote, []byte("0"), []byte("candidate"), []byte("0"), []byte("0")}, bOK, nil},
+		{frame{bFollow}, bError, ErrBadParams},
+		{frame{bFollow, []byte("x"), []byte("leader")}, bError, ErrBadParams},
+		{frame{bFollow, []byte("0"), []byte("leader")}, bError, ErrClusterStaleTerm},
+		{frame{bPromote}, bError, ErrServerNotReplica},
+		{frame{bPut, []byte("test-queue"), []byte("test-message")}, bOK, nil},
+		{frame{bGet, []byte("test-queue"), []byte("100")}, bOK, nil},
+		{frame{bPut, []byte("test-queue"), []byte("test-message")}, bOK, nil},
+		{frame{bGetAny, []byte("100"), []byte("test-queue-2"), []byte("test-queue")}, bOK, nil},
+		{frame{bPut, []byte("test-queue"), []byte("test-message")}, bOK, nil},
+		{frame{bCopy, []byte("test-queue"), []byte("test-queue-2"), []byte("1")}, bOK, nil},
+		{frame{bMove, []byte("test-queue"), []byte("test-queue-2"), []byte("1")}, bOK, nil},
+	})
+}
@@ -0,0 +1,182 @@
+package mqmq
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultDedupWindow is the default time the server remembers the dedup keys
+// of the messages put to a queue (see Client.PutDedup).
+const DefaultDedupWindow = 5 * time.Minute
+
+// dedupWindow is the dedup window set for a queue pattern.
+type dedupWindow struct {
+	pattern string
+	window  time.Duration
+}
+
+// SetDedupWindow sets the time the server remembers the dedup keys of the
+// messages put to the queues matching the pattern, e.g. "orders.*". A message
+// with the key already seen within the window is not put to the queue again.
+// The zero window disables the deduplication. If several patterns match
+// a queue, the longest one applies. The default is DefaultDedupWindow.
+//
+// The dedup keys are only kept in the memory of the primary server or the
+// cluster leader, so they are forgotten when the server restarts or fails over.
+func (s *Server) SetDedupWindow(pattern string, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != ServerStateNew {
+		return errServerState
+	}
+	if !ValidQueuePattern(pattern) {
+		return errBadQueuePattern
+	}
+	if window < 0 {
+		return errors.New("mqmq: negative dedup window")
+	}
+
+	for i := range s.dedupWindows {
+		if s.dedupWindows[i].pattern == pattern {
+			s.dedupWindows[i].window = window
+			return nil
+		}
+	}
+	s.dedupWindows = append(s.dedupWindows, dedupWindow{pattern: pattern, window: window})
+	return nil
+}
+
+// dedupWindow returns the dedup window of the queue.
+func (s *Server) dedupWindow(qname string) time.Duration {
+	window := DefaultDedupWindow
+	longest := -1
+	for _, w := range s.dedupWindows {
+		if len(w.pattern) > longest && MatchQueue(w.pattern, qname) {
+			window = w.window
+			longest = len(w.pattern)
+		}
+	}
+	return window
+}
+
+// dedupTable is the table of the recently seen dedup keys of the queues.
+type dedupTable struct {
+	mu     sync.Mutex
+	queues map[string]*dedupKeys
+}
+
+// dedupKeys are the dedup keys of a queue.
+type dedupKeys struct {
+	window  time.Duration
+	expires map[string]time.Time     // Expiration time of each key.
+	order   *list.List               // Keys in the order they expire (*dedupEntry).
+	pending map[string]chan struct{} // Keys of the messages being put, closed when the put is finished.
+	hits    int                      // Number of the duplicates discarded.
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+// add records the dedup key of the message put to the queue. It reports false
+// if the key is already seen within the window and the message is a duplicate.
+// If the message with the key is still being put, add also returns the channel
+// closed when the put is finished (see finish), so the duplicate can be added
+// again once the outcome of the put is known.
+func (t *dedupTable) add(qname, key string, window time.Duration, now time.Time) (bool, <-chan struct{}) {
+	if window <= 0 {
+		return true, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.queues == nil {
+		t.queues = make(map[string]*dedupKeys)
+	}
+	d := t.queues[qname]
+	if d == nil {
+		d = &dedupKeys{
+			window:  window,
+			expires: make(map[string]time.Time),
+			order:   list.New(),
+			pending: make(map[string]chan struct{}),
+		}
+		t.queues[qname] = d
+	}
+
+	// The queue has a single window, so the keys expire in the order they are added.
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		entry := e.Value.(*dedupEntry)
+		if entry.expires.After(now) {
+			break
+		}
+		if d.expires[entry.key] == entry.expires {
+			delete(d.expires, entry.key)
+		}
+		d.order.Remove(e)
+	}
+
+	if pending, ok := d.pending[key]; ok {
+		return false, pending
+	}
+	if _, ok := d.expires[key]; ok {
+		d.hits++
+		return false, nil
+	}
+	expires := now.Add(d.window)
+	d.expires[key] = expires
+	d.order.PushBack(&dedupEntry{key: key, expires: expires})
+	d.pending[key] = make(chan struct{})
+	return true, nil
+}
+
+// finish finishes the put of the message with the dedup key added to the queue.
+// Unless the message is appended, the key is forgotten, so the message can be
+// put again.
+func (t *dedupTable) finish(qname, key string, appended bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.queues[qname]
+	if d == nil {
+		return
+	}
+	if pending, ok := d.pending[key]; ok {
+		delete(d.pending, key)
+		close(pending)
+	}
+	if !appended {
+		delete(d.expires, key)
+	}
+}
+
+// hits returns the number of the duplicates discarded from the queue.
+func (t *dedupTable) hits(qname string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.queues[qname]; d != nil {
+		return d.hits
+	}
+	return 0
+}
+
+// PutDedup appends the message to the end of the given queue unless a message
+// with the same dedup key was put to the queue within the server dedup window
+// (see Server.SetDedupWindow). The duplicates are discarded but the server
+// responds to them as usual, so the producers can safely retry the failed puts.
+// The duplicate of the message that is still being put is responded to after
+// the first put: if it fails, the duplicate is put instead. The blank key
+// disables the deduplication.
+func (c *Client) PutDedup(queue string, message []byte, key string) error {
+	return c.PutDedupContext(context.Background(), queue, message, key)
+}
+
+// PutDedupContext appends the message with the dedup key to the end of the given queue.
+// If the context is canceled or its deadline is exceeded before the server
+// responds, the connection is closed and the context error is returned.
+func (c *Client) PutDedupContext(ctx context.Context, queue string, message []byte, key string) error {
+	return c.put(ctx, queue, message, key)
+}
@@ -0,0 +1,213 @@
+package mqmq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupTable(t *testing.T) {
+	var d dedupTable
+	now := time.Now()
+	window := time.Minute
+
+	// add adds the key of the message that is put successfully.
+	add := func(qname, key string, window time.Duration, now time.Time) bool {
+		ok, pending := d.add(qname, key, window, now)
+		if pending != nil {
+			t.Fatalf("failed d.add: %s is pending", key)
+		}
+		if ok {
+			d.finish(qname, key, true)
+		}
+		return ok
+	}
+
+	if !add("test-queue", "key-1", window, now) {
+		t.Fatalf("failed d.add: key-1 is not new")
+	}
+	if !add("test-queue", "key-2", window, now.Add(30*time.Second)) {
+		t.Fatalf("failed d.add: key-2 is not new")
+	}
+	if !add("test-queue-2", "key-1", window, now) {
+		t.Fatalf("failed d.add: key-1 of another queue is not new")
+	}
+	if add("test-queue", "key-1", window, now.Add(59*time.Second)) {
+		t.Fatalf("failed d.add: key-1 is new within the window")
+	}
+
+	// The key is new again when the window passes.
+	if !add("test-queue", "key-1", window, now.Add(time.Minute)) {
+		t.Fatalf("failed d.add: key-1 is not new after the window")
+	}
+	if add("test-queue", "key-2", window, now.Add(time.Minute)) {
+		t.Fatalf("failed d.add: key-2 is new within the window")
+	}
+	if add("test-queue", "key-1", window, now.Add(90*time.Second)) {
+		t.Fatalf("failed d.add: key-1 added again is new within the window")
+	}
+
+	// The duplicate of the message being put waits for the put,
+	// and the key of the message that failed to be put is new.
+	if ok, _ := d.add("test-queue", "key-3", window, now.Add(90*time.Second)); !ok {
+		t.Fatalf("failed d.add: key-3 is not new")
+	}
+	ok, pending := d.add("test-queue", "key-3", window, now.Add(90*time.Second))
+	if ok || pending == nil {
+		t.Fatalf("failed d.add: key-3 is not pending")
+	}
+	d.finish("test-queue", "key-3", false)
+	select {
+	case <-pending:
+	default:
+		t.Fatalf("failed d.finish: key-3 is still pending")
+	}
+	if !add("test-queue", "key-3", window, now.Add(90*time.Second)) {
+		t.Fatalf("failed d.add: key-3 failed to be put is not new")
+	}
+
+	if !add("test-queue", "key-1", 0, now) || !add("test-queue-3", "key-1", 0, now) {
+		t.Fatalf("failed d.add: key is not new with zero window")
+	}
+	if _, ok := d.queues["test-queue-3"]; ok {
+		t.Fatalf("failed d.add: key is kept with zero window")
+	}
+
+	if n := d.hits("test-queue"); n != 3 {
+		t.Fatalf("failed d.hits: expected 3, got %d", n)
+	}
+	if n := d.hits("test-queue-2"); n != 0 {
+		t.Fatalf("failed d.hits: expected 0, got %d", n)
+	}
+	// The expired key-2 is removed.
+	if n := len(d.queues["test-queue"].expires); n != 2 {
+		t.Fatalf("failed d.add: expected 2 keys kept, got %d", n)
+	}
+}
+
+func TestPutDedup(t *testing.T) {
+	s, addr := startServerWith(func(s *Server) error {
+		err := s.SetDedupWindow("orders.*", 50*time.Millisecond)
+		if err != nil {
+			return err
+		}
+		return s.SetDedupWindow("orders.nodedup", 0)
+	})
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	puts := []struct {
+		queue string
+		key   string
+	}{
+		{"test-queue", "key-1"},
+		{"test-queue", "key-1"},
+		{"test-queue", "key-2"},
+		{"test-queue", ""},
+		{"test-queue", ""},
+		{"orders.eu", "key-1"},
+		{"orders.eu", "key-1"},
+		{"orders.nodedup", "key-1"},
+		{"orders.nodedup", "key-1"},
+	}
+	for _, p := range puts {
+		err = c.PutDedup(p.queue, []byte("test-message"), p.key)
+		if err != nil {
+			t.Fatalf("failed c.PutDedup: %s", err)
+		}
+	}
+
+	// The key is forgotten after the window.
+	time.Sleep(60 * time.Millisecond)
+	err = c.PutDedup("orders.eu", []byte("test-message"), "key-1")
+	if err != nil {
+		t.Fatalf("failed c.PutDedup: %s", err)
+	}
+	err = c.PutDedup("test-queue", []byte("test-message"), "key-1")
+	if err != nil {
+		t.Fatalf("failed c.PutDedup: %s", err)
+	}
+
+	info, err := c.Info()
+	if err != nil {
+		t.Fatalf("failed c.Info: %s", err)
+	}
+	want := map[string]ServerQueueInfo{
+		"test-queue":     {NumMessages: 4, NumDedupHits: 2},
+		"orders.eu":      {NumMessages: 2, NumDedupHits: 1},
+		"orders.nodedup": {NumMessages: 2},
+	}
+	for qname, q := range want {
+		if info.Queues[qname] != q {
+			t.Fatalf("failed c.Info: expected %s info %+v, got %+v", qname, q, info.Queues[qname])
+		}
+	}
+}
+
+func TestSetDedupWindow(t *testing.T) {
+	s := NewServer()
+	if err := s.SetDedupWindow("orders*", time.Minute); err != errBadQueuePattern {
+		t.Fatalf("failed s.SetDedupWindow: expected %v, got %v", errBadQueuePattern, err)
+	}
+	if err := s.SetDedupWindow("orders.*", -time.Minute); err == nil {
+		t.Fatalf("failed s.SetDedupWindow: expected error for negative window")
+	}
+	for _, w := range []dedupWindow{{"orders.eu.*", 0}, {"*", time.Second}, {"orders.*", time.Minute}, {"*", time.Hour}} {
+		if err := s.SetDedupWindow(w.pattern, w.window); err != nil {
+			t.Fatalf("failed s.SetDedupWindow: %s", err)
+		}
+	}
+
+	windows := map[string]time.Duration{
+		"users":            time.Hour,
+		"orders":           time.Hour,
+		"orders.us":        time.Minute,
+		"orders.eu.failed": 0,
+	}
+	for qname, want := range windows {
+		if got := s.dedupWindow(qname); got != want {
+			t.Fatalf("failed s.dedupWindow(%s): expected %v, got %v", qname, want, got)
+		}
+	}
+	if got := NewServer().dedupWindow("users"); got != DefaultDedupWindow {
+		t.Fatalf("failed s.dedupWindow: expected %v, got %v", DefaultDedupWindow, got)
+	}
+}
+
+func TestPutDedupCluster(t *testing.T) {
+	servers, addrs := startCluster(3)
+	for _, s := range servers {
+		defer s.Stop()
+	}
+
+	leader := waitLeader(t, servers)
+	follower := (leader + 1) % len(servers)
+
+	// The dedup key is proxied to the leader with the message.
+	c := NewClient()
+	err := c.Connect(addrs[follower])
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	for i := 0; i < 3; i++ {
+		err = c.PutDedup("test-queue", []byte("test-message"), "key-1")
+		if err != nil {
+			t.Fatalf("failed c.PutDedup: %s", err)
+		}
+	}
+
+	queues := queueContents(servers[leader])
+	if n := len(queues["test-queue"]); n != 1 {
+		t.Fatalf("failed c.PutDedup: expected 1 message, got %d", n)
+	}
+	if n := servers[leader].dedup.hits("test-queue"); n != 2 {
+		t.Fatalf("failed c.PutDedup: expected 2 dedup hits, got %d", n)
+	}
+}
@@ -0,0 +1,63 @@
+package mqmq
+
+// ServerError is an error response received from the server.
+// Use errors.Is with the error code values below to check for a specific error,
+// e.g. errors.Is(err, mqmq.ErrBadQueueName).
+type ServerError struct {
+	Code   string // Machine-readable error code, e.g. "REQUEST_BAD_PARAMS".
+	Detail string // Human-readable error description, may be blank.
+}
+
+func (e *ServerError) Error() string {
+	if e.Detail == "" {
+		return "mqmq: server error response: " + e.Code
+	}
+	return "mqmq: server error response: " + e.Code + ": " + e.Detail
+}
+
+// Is reports whether the target is a server error with the same code.
+func (e *ServerError) Is(target error) bool {
+	t, ok := target.(*ServerError)
+	return ok && t.Code == e.Code
+}
+
+// Server error codes.
+var (
+	ErrBadParams          = &ServerError{Code: "REQUEST_BAD_PARAMS"}        // Missing or malformed request parameters.
+	ErrBadQueueName       = &ServerError{Code: "REQUEST_BAD_QUEUE_NAME"}    // Invalid queue name.
+	ErrBadTimeout         = &ServerError{Code: "REQUEST_BAD_TIMEOUT"}       // Invalid Get timeout.
+	ErrMessageTooLarge    = &ServerError{Code: "REQUEST_MESSAGE_TOO_LARGE"} // The message is larger than allowed.
+	ErrRequestTooLarge    = &ServerError{Code: "REQUEST_TOO_LARGE"}         // The request frame is larger than allowed.
+	ErrRequestCanceled    = &ServerError{Code: "REQUEST_CANCELED"}          // The chunked message is canceled by the client.
+	ErrUnknownCommand     = &ServerError{Code: "REQUEST_UNKNOWN_COMMAND"}   // The request command is not supported.
+	ErrReplyQueue         = &ServerError{Code: "REQUEST_REPLY_QUEUE"}       // The reply queue doesn't exist or belongs to another connection.
+	ErrServerReplica      = &ServerError{Code: "SERVER_REPLICA"}            // The server is a standby replica.
+	ErrServerNotReplica   = &ServerError{Code: "SERVER_NOT_REPLICA"}        // The server is not a replica and can't be promoted.
+	ErrServerNotClustered = &ServerError{Code: "SERVER_NOT_CLUSTERED"}      // The server is not a cluster member.
+	ErrServerStopping     = &ServerError{Code: "SERVER_STOPPING"}           // The server is shutting down.
+	ErrServerInternal     = &ServerError{Code: "SERVER_INTERNAL_ERROR"}     // The server failed to handle the request.
+	ErrClusterNoLeader    = &ServerError{Code: "CLUSTER_NO_LEADER"}         // The cluster leader is unknown or unreachable.
+	ErrClusterNotLeader   = &ServerError{Code: "CLUSTER_NOT_LEADER"}        // The server stopped being the cluster leader.
+	ErrClusterStaleTerm   = &ServerError{Code: "CLUSTER_STALE_TERM"}        // The cluster leader term is outdated.
+
+	ErrLimitConnections      = &ServerError{Code: "LIMIT_CONNECTIONS"}        // The server has too many connections.
+	ErrLimitConnectionsPerIP = &ServerError{Code: "LIMIT_CONNECTIONS_PER_IP"} // The server has too many connections from the client IP address.
+	ErrLimitQueues           = &ServerError{Code: "LIMIT_QUEUES"}             // The server has too many queues to create a new one.
+)
+
+// errorFrame returns the error response frame.
+func errorFrame(code *ServerError, detail string) frame {
+	return frame{bError, []byte(code.Code), []byte(detail)}
+}
+
+// responseError returns the error from the server error response frame.
+func responseError(response frame) error {
+	if len(response) < 2 {
+		return ErrBadResponse
+	}
+	err := &ServerError{Code: string(response[1])}
+	if len(response) >= 3 {
+		err.Detail = string(response[2])
+	}
+	return err
+}
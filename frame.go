@@ -1,9 +1,13 @@
 package mqmq
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
+	"sync"
 )
 
 type frame [][]byte
@@ -11,53 +15,162 @@ type frame [][]byte
 // ErrFrameLen means that the maximum frame length is exceeded.
 var ErrFrameLen = errors.New("mqmq: frame too large")
 
-//ErrFrameFormat means that the frame is corrupted and cannot be read.
+// ErrFrameFormat means that the frame is corrupted and cannot be read.
 var ErrFrameFormat = errors.New("mqmq: bad frame format")
 
+// maxPooledFrameLen is the maximum capacity of the frame buffer kept in the pool.
+// Buffers of larger frames are left to the garbage collector.
+const maxPooledFrameLen = 64 * 1024
+
+// frameBuffer is a reusable buffer for reading frames. The frame items point
+// into the buffer, so they are valid only until the buffer is released.
+type frameBuffer struct {
+	hdr  [4]byte
+	data []byte
+	f    frame
+
+	// skipped is set if the frame is too large and is discarded unread.
+	skipped bool
+}
+
+var frameBufferPool = sync.Pool{
+	New: func() interface{} { return new(frameBuffer) },
+}
+
+// frameWriter holds the item headers and the vector of a frame being written.
+type frameWriter struct {
+	hdr  []byte
+	bufs net.Buffers
+}
+
+var frameWriterPool = sync.Pool{
+	New: func() interface{} { return new(frameWriter) },
+}
+
+// readFrame reads the frame. The frame items don't share memory with other frames.
 func readFrame(r io.Reader, maxFrameLen uint32) (frame, error) {
-	var err error
-	var buf4 [4]byte
+	b := frameBufferPool.Get().(*frameBuffer)
+	frameLen, err := b.readLen(r, maxFrameLen)
+	frameBufferPool.Put(b)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = io.ReadFull(r, buf4[:])
+	buf := make([]byte, frameLen)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return nil, err
 	}
-	frameLen := binary.BigEndian.Uint32(buf4[:])
 
-	if frameLen > maxFrameLen {
-		return nil, ErrFrameLen
+	return parseFrame(make(frame, 0, 3), buf)
+}
+
+// readFrameBuffer reads the frame into a pooled buffer.
+// The buffer must be released when the frame is no longer used.
+func readFrameBuffer(r io.Reader, maxFrameLen uint32) (*frameBuffer, error) {
+	b := frameBufferPool.Get().(*frameBuffer)
+	err := b.read(r, maxFrameLen)
+	if err != nil {
+		b.release()
+		return nil, err
 	}
+	return b, nil
+}
 
-	buf := make([]byte, frameLen, frameLen)
-	_, err = io.ReadFull(r, buf)
+// readFrameBufferOrSkip reads the frame like readFrameBuffer, but the frames
+// larger than maxFrameLen are discarded and returned empty with the skipped
+// flag set, so that the connection stays in sync.
+func readFrameBufferOrSkip(r *bufio.Reader, maxFrameLen uint32) (*frameBuffer, error) {
+	hdr, err := r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	frameLen := binary.BigEndian.Uint32(hdr)
+	if frameLen <= maxFrameLen {
+		return readFrameBuffer(r, maxFrameLen)
+	}
+
+	_, err = io.CopyN(ioutil.Discard, r, 4+int64(frameLen))
 	if err != nil {
 		return nil, err
 	}
+	b := frameBufferPool.Get().(*frameBuffer)
+	b.skipped = true
+	return b, nil
+}
+
+func (b *frameBuffer) read(r io.Reader, maxFrameLen uint32) error {
+	frameLen, err := b.readLen(r, maxFrameLen)
+	if err != nil {
+		return err
+	}
 
-	f := make(frame, 0, 3)
+	if uint32(cap(b.data)) < frameLen {
+		b.data = make([]byte, frameLen)
+	}
+	b.data = b.data[:frameLen]
+
+	_, err = io.ReadFull(r, b.data)
+	if err != nil {
+		return err
+	}
+
+	b.f, err = parseFrame(b.f[:0], b.data)
+	return err
+}
+
+// readLen reads the frame length.
+func (b *frameBuffer) readLen(r io.Reader, maxFrameLen uint32) (uint32, error) {
+	_, err := io.ReadFull(r, b.hdr[:])
+	if err != nil {
+		return 0, err
+	}
+	frameLen := binary.BigEndian.Uint32(b.hdr[:])
+
+	if frameLen > maxFrameLen {
+		return 0, ErrFrameLen
+	}
+	return frameLen, nil
+}
+
+// release returns the buffer to the pool.
+func (b *frameBuffer) release() {
+	if cap(b.data) > maxPooledFrameLen {
+		b.data = nil
+	}
+	for i := range b.f {
+		b.f[i] = nil
+	}
+	b.f = b.f[:0]
+	b.skipped = false
+	frameBufferPool.Put(b)
+}
+
+// parseFrame appends the items of the frame data to f.
+func parseFrame(f frame, data []byte) (frame, error) {
+	frameLen := uint32(len(data))
 
 	var i uint32
 	for i < frameLen {
 		if i+4 > frameLen {
 			return nil, ErrFrameFormat
 		}
-		itemLen := binary.BigEndian.Uint32(buf[i : i+4])
+		itemLen := binary.BigEndian.Uint32(data[i : i+4])
 		i += 4
 
-		if i+itemLen > frameLen {
+		if i+itemLen > frameLen || i+itemLen < i {
 			return nil, ErrFrameFormat
 		}
-		f = append(f, buf[i:i+itemLen])
+		f = append(f, data[i:i+itemLen:i+itemLen])
 		i += itemLen
 	}
 
 	return f, nil
 }
 
+// writeFrame writes the frame with a single vectored write if w supports it
+// (e.g. *net.TCPConn), so the items are not copied into intermediate buffers.
 func writeFrame(w io.Writer, f frame, maxFrameLen uint32) error {
-	var err error
-	var buf4 [4]byte
-
 	var frameLen uint32
 	for _, item := range f {
 		frameLen += 4 + uint32(len(item))
@@ -67,24 +180,45 @@ func writeFrame(w io.Writer, f frame, maxFrameLen uint32) error {
 		return ErrFrameLen
 	}
 
-	binary.BigEndian.PutUint32(buf4[:], frameLen)
-	_, err = w.Write(buf4[:])
-	if err != nil {
-		return err
-	}
+	fw := frameWriterPool.Get().(*frameWriter)
 
+	hdr := fw.hdr[:0]
+	hdr = appendUint32(hdr, frameLen)
 	for _, item := range f {
-		binary.BigEndian.PutUint32(buf4[:], uint32(len(item)))
-		_, err = w.Write(buf4[:])
-		if err != nil {
-			return err
-		}
+		hdr = appendUint32(hdr, uint32(len(item)))
+	}
 
-		_, err = w.Write(item)
-		if err != nil {
-			return err
+	// Each item header is written along with the preceding item.
+	bufs := fw.bufs[:0]
+	if len(f) == 0 {
+		bufs = append(bufs, hdr[:4:4])
+	} else {
+		bufs = append(bufs, hdr[:8:8])
+	}
+	for i, item := range f {
+		if len(item) > 0 {
+			bufs = append(bufs, item)
+		}
+		if i+1 < len(f) {
+			bufs = append(bufs, hdr[8+4*i:12+4*i:12+4*i])
 		}
 	}
 
-	return nil
+	fw.hdr = hdr
+	fw.bufs = bufs
+	_, err := fw.bufs.WriteTo(w)
+
+	// WriteTo consumes the vector, so restore it to drop the item references.
+	bufs = bufs[:cap(bufs)]
+	for i := range bufs {
+		bufs[i] = nil
+	}
+	fw.bufs = bufs[:0]
+	frameWriterPool.Put(fw)
+
+	return err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
 }
@@ -2,6 +2,9 @@ package mqmq
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"testing"
 )
@@ -49,6 +52,78 @@ func TestReadWriteFrame(t *testing.T) {
 			t.Errorf("TestReadWriteFrame #%d: DeepEqual failed: got %#v want %#v", i, got, test.want)
 			continue
 		}
+
+		b, err := readFrameBuffer(bytes.NewReader(buf.Bytes()), maxFrameLen)
+		if err != nil {
+			t.Errorf("TestReadWriteFrame #%d: readFrameBuffer failed: %s", i, err)
+			continue
+		}
+
+		if len(b.f) != len(test.want) || (len(b.f) > 0 && !reflect.DeepEqual(b.f, test.want)) {
+			t.Errorf("TestReadWriteFrame #%d: DeepEqual failed: got %#v want %#v", i, b.f, test.want)
+		}
+		b.release()
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tbl := []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte{0, 0, 0, 8, 0, 0, 0, 4, 'O', 'K'}, io.ErrUnexpectedEOF},
+		{[]byte{0, 0, 0, 6, 0, 0, 0, 4, 'O', 'K'}, ErrFrameFormat},
+		{[]byte{0, 0, 0, 2, 0, 0}, ErrFrameFormat},
+		{[]byte{0, 0, 0, 6, 0xff, 0xff, 0xff, 0xff, 'O', 'K'}, ErrFrameFormat},
+		{[]byte{0xff, 0, 0, 0}, ErrFrameLen},
+	}
+
+	for i, test := range tbl {
+		_, err := readFrame(bytes.NewReader(test.data), maxFrameLen)
+		if err != test.err {
+			t.Errorf("TestReadFrameErrors #%d: readFrame: expected %v, got %v", i, test.err, err)
+		}
+		_, err = readFrameBuffer(bytes.NewReader(test.data), maxFrameLen)
+		if err != test.err {
+			t.Errorf("TestReadFrameErrors #%d: readFrameBuffer: expected %v, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestWriteFrameConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed net.Listen: %s", err)
+	}
+	defer listener.Close()
+
+	f := frame{bPut, []byte("test-queue-1"), nil, bytes.Repeat([]byte("X"), 1<<20)}
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for i := 0; i < 3; i++ {
+			writeFrame(conn, f, maxFrameLen)
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed listener.Accept: %s", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		b, err := readFrameBuffer(conn, maxFrameLen)
+		if err != nil {
+			t.Fatalf("failed readFrameBuffer: %s", err)
+		}
+		if len(b.f) != len(f) || !bytes.Equal(b.f[1], f[1]) || len(b.f[2]) != 0 || !bytes.Equal(b.f[3], f[3]) {
+			t.Fatalf("failed readFrameBuffer: unexpected frame")
+		}
+		b.release()
 	}
 }
 
@@ -101,3 +176,61 @@ func BenchmarkReadFrameM(b *testing.B) {
 func BenchmarkReadFrameL(b *testing.B) {
 	benchReadFrame(b, frame{bPut, []byte("test-queue-1"), bytes.Repeat([]byte("X"), 10000)})
 }
+
+func benchReadFrameBuffer(b *testing.B, f frame) {
+	buf := &bytes.Buffer{}
+	writeFrame(buf, f, maxFrameLen)
+	r := bytes.NewReader(nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(buf.Bytes())
+		fb, err := readFrameBuffer(r, maxFrameLen)
+		if err != nil {
+			b.Fatalf("readFrameBuffer failed: %v", err)
+		}
+		fb.release()
+	}
+}
+
+func BenchmarkReadFrameBufferS(b *testing.B) {
+	benchReadFrameBuffer(b, frame{bOK})
+}
+
+func BenchmarkReadFrameBufferM(b *testing.B) {
+	benchReadFrameBuffer(b, frame{bPut, []byte("test-queue-1"), bytes.Repeat([]byte("X"), 100)})
+}
+
+func BenchmarkReadFrameBufferL(b *testing.B) {
+	benchReadFrameBuffer(b, frame{bPut, []byte("test-queue-1"), bytes.Repeat([]byte("X"), 10000)})
+}
+
+// benchServerFrames measures the frame handling done by the server for every
+// request: reading the request and writing the response.
+func benchServerFrames(b *testing.B, request, response frame) {
+	buf := &bytes.Buffer{}
+	writeFrame(buf, request, maxFrameLen)
+	r := bytes.NewReader(nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(buf.Bytes())
+		fb, err := readFrameBuffer(r, maxFrameLen)
+		if err != nil {
+			b.Fatalf("readFrameBuffer failed: %v", err)
+		}
+		err = writeFrame(ioutil.Discard, response, maxFrameLen)
+		if err != nil {
+			b.Fatalf("writeFrame failed: %v", err)
+		}
+		fb.release()
+	}
+}
+
+func BenchmarkServerFramesPut(b *testing.B) {
+	benchServerFrames(b, frame{bPut, []byte("test-queue-1"), bytes.Repeat([]byte("X"), 1000)}, frame{bOK})
+}
+
+func BenchmarkServerFramesGet(b *testing.B) {
+	benchServerFrames(b, frame{bGet, []byte("test-queue-1"), []byte("1000")}, frame{bOK, bytes.Repeat([]byte("X"), 1000)})
+}
@@ -0,0 +1,177 @@
+package mqmq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"time"
+)
+
+var bGetAny = []byte("GetAny")
+
+// Request handler: GetAny <timeout> <queue> <queue...>
+//
+// The server responds with the first message available in any of the queues
+// and the name of its queue: OK <queue> <message>
+// If several queues have messages, the queue listed first is preferred.
+func (c *connection) handleGetAny(f frame) {
+	if len(f) < 3 {
+		c.sendOrStop(errorFrame(ErrBadParams, "GetAny requires timeout and queue names"))
+		return
+	}
+
+	timeout, errf := c.parseTimeout(f[1])
+	if errf != nil {
+		c.sendOrStop(errf)
+		return
+	}
+
+	var qnames []string
+	listed := make(map[string]bool)
+	for _, item := range f[2:] {
+		qname := string(item)
+		if errf := c.checkQueueName(qname); errf != nil {
+			c.sendOrStop(errf)
+			return
+		}
+		if !listed[qname] {
+			listed[qname] = true
+			qnames = append(qnames, qname)
+		}
+	}
+
+	term, stepDown, ok := c.acceptRequest(f, true)
+	if !ok {
+		return
+	}
+
+	queues := make([]queue, len(qnames))
+	for i, qname := range qnames {
+		q, errf := c.consumerQueue(qname)
+		if errf != nil {
+			c.sendOrStop(errf)
+			return
+		}
+		queues[i] = q
+	}
+
+	// The messages already available are taken in the priority order.
+	for i, q := range queues {
+		if message, ok := q.dequeue(); ok {
+			c.deliver(q, qnames[i], message, term, stepDown, false, frame{bOK, []byte(qnames[i])})
+			return
+		}
+	}
+
+	// The consumer waits for all the queues in turn with the other consumers.
+	waiters := make([]*queueWaiter, len(queues))
+	for i, q := range queues {
+		waiters[i] = q.wait()
+	}
+	chosen := -1
+	defer func() {
+		for i, w := range waiters {
+			if i != chosen {
+				queues[i].cancel(w)
+			}
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	const (
+		caseDone = iota
+		caseStepDown
+		caseTimeout
+		caseQueues
+	)
+	cases := make([]reflect.SelectCase, caseQueues, caseQueues+len(queues))
+	cases[caseDone] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.done)}
+	cases[caseStepDown] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stepDown)}
+	cases[caseTimeout] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)}
+	for _, w := range waiters {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.message())})
+	}
+
+	i, value, _ := reflect.Select(cases)
+	switch i {
+	case caseDone:
+		return
+	case caseStepDown:
+		c.sendOrStop(errorFrame(ErrClusterNotLeader, "server stopped being cluster leader"))
+	case caseTimeout:
+		c.sendOrStop(frame{bTimeout})
+	default:
+		// The messages received by the other waiters are put back.
+		chosen = i - caseQueues
+		for j, w := range waiters {
+			if j != chosen {
+				queues[j].cancel(w)
+			}
+		}
+		waiters = nil
+		c.deliver(queues[chosen], qnames[chosen], value.Bytes(), term, stepDown, false, frame{bOK, []byte(qnames[chosen])})
+	}
+}
+
+// GetAny receives the next message from any of the given queues and returns
+// it along with the name of its queue. If messages are available in several
+// queues, the queue listed first takes priority. The timeout parameter works
+// like in Get.
+func (c *Client) GetAny(queues []string, timeout time.Duration) (string, []byte, error) {
+	return c.GetAnyContext(context.Background(), queues, timeout)
+}
+
+// GetAnyContext receives the next message from any of the given queues.
+// It works like GetAny but the wait can be abandoned early by canceling the context.
+func (c *Client) GetAnyContext(ctx context.Context, queues []string, timeout time.Duration) (string, []byte, error) {
+	if len(queues) == 0 {
+		return "", nil, errors.New("mqmq: no queues given")
+	}
+
+	c.mu.Lock()
+	for _, queue := range queues {
+		err := c.checkQueueName(queue)
+		if err != nil {
+			c.mu.Unlock()
+			return "", nil, err
+		}
+	}
+	timeoutValue, err := c.checkGetTimeout(timeout)
+	if err != nil {
+		c.mu.Unlock()
+		return "", nil, err
+	}
+
+	request := frame{bGetAny, timeoutValue}
+	for _, queue := range queues {
+		request = append(request, []byte(queue))
+	}
+	codec := c.codec
+	response, err := c.cmdLocked(ctx, request)
+	c.mu.Unlock()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(response) < 1 {
+		return "", nil, ErrBadResponse
+	}
+	if bytes.Equal(response[0], bError) {
+		return "", nil, responseError(response)
+	}
+	if bytes.Equal(response[0], bTimeout) {
+		return "", nil, ErrTimeout
+	}
+	if !bytes.Equal(response[0], bOK) || len(response) < 3 {
+		return "", nil, ErrBadResponse
+	}
+
+	message, err := decodeMessage(codec, response[2])
+	if err != nil {
+		return "", nil, ErrBadResponse
+	}
+	return string(response[1]), message, nil
+}
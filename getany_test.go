@@ -0,0 +1,79 @@
+package mqmq
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetAny(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	large := jsonMessage(100)
+	for _, put := range []struct {
+		queue   string
+		message []byte
+	}{
+		{"test-queue-2", []byte("message-2")},
+		{"test-queue-1", []byte("message-1")},
+		{"test-queue-2", large},
+	} {
+		err = c.Put(put.queue, put.message)
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+
+	// The queues listed first take priority.
+	queues := []string{"test-queue-1", "test-queue-2", "test-queue-1"}
+	for _, want := range []struct {
+		queue   string
+		message []byte
+	}{
+		{"test-queue-1", []byte("message-1")},
+		{"test-queue-2", []byte("message-2")},
+		{"test-queue-2", large},
+	} {
+		queue, message, err := c.GetAny(queues, time.Second)
+		if err != nil || queue != want.queue || !bytes.Equal(message, want.message) {
+			t.Fatalf("failed c.GetAny: expected %q from %s, got %d bytes from %q, %v", want.message, want.queue, len(message), queue, err)
+		}
+	}
+
+	_, _, err = c.GetAny(queues, 10*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("failed c.GetAny: expected %v, got %v", ErrTimeout, err)
+	}
+
+	// The request waits for a message in any of the queues.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c := NewClient()
+		if c.Connect(addr) == nil {
+			c.Put("test-queue-2", []byte("message-3"))
+			c.Disconnect()
+		}
+	}()
+	queue, message, err := c.GetAny(queues, 5*time.Second)
+	if err != nil || queue != "test-queue-2" || string(message) != "message-3" {
+		t.Fatalf("failed c.GetAny: expected %q from %s, got %q from %q, %v", "message-3", "test-queue-2", message, queue, err)
+	}
+
+	_, _, err = c.GetAny(nil, time.Second)
+	if err == nil {
+		t.Fatalf("failed c.GetAny: expected error for no queues")
+	}
+	_, _, err = c.GetAny([]string{"test-queue-1", "bad queue"}, time.Second)
+	if !errors.Is(err, ErrBadQueueName) {
+		t.Fatalf("failed c.GetAny: expected %v, got %v", ErrBadQueueName, err)
+	}
+}
@@ -0,0 +1,167 @@
+package mqmq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+)
+
+// Version is the mqmq server version reported in the handshake.
+const Version = "1.1.0"
+
+// ProtocolVersion is the latest protocol version supported by this package.
+// The protocol version and the optional features (capabilities) are
+// negotiated by the Hello request that Client.Connect sends to the server.
+// Servers treat clients that don't send the Hello request as the protocol
+// version 0 clients that use none of the optional features.
+const ProtocolVersion = 1
+
+// Capabilities are the names of the optional protocol features.
+const (
+	CapabilityReplication = "replication" // Replicate and Promote requests.
+	CapabilityCluster     = "cluster"     // Clustered mode with leader election.
+	CapabilityChunked     = "chunked"     // PutStream and GetStream requests.
+)
+
+var bHello = []byte("Hello")
+
+var errLegacyServer = errors.New("mqmq: server does not support handshake")
+
+// capabilities returns the optional features supported by the server.
+func (s *Server) capabilities() []string {
+	capabilities := []string{CapabilityReplication, CapabilityChunked}
+	if s.raft != nil {
+		capabilities = append(capabilities, CapabilityCluster)
+	}
+	return capabilities
+}
+
+// Request handler: Hello <protocol version> <capabilities...>
+//
+// The server responds with the negotiated protocol version (the lowest of the
+// client and server versions), the server version and the server capabilities:
+// OK <protocol version> <server version> <capabilities...>
+// The first compression codec offered by the client that the server supports
+// is negotiated and added to the server capabilities. The server limits are
+// advertised as the capabilities with the CapabilityLimitPrefix.
+func (c *connection) handleHello(f frame) {
+	if len(f) < 2 {
+		c.sendOrStop(errorFrame(ErrBadParams, "Hello requires protocol version"))
+		return
+	}
+
+	version, err := strconv.Atoi(string(f[1]))
+	if err != nil || version < 0 {
+		c.sendOrStop(errorFrame(ErrBadParams, "protocol version must be a non-negative integer"))
+		return
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	c.codec = nil
+	for _, capability := range f[2:] {
+		if codec, ok := codecCapability(string(capability)); ok && c.codec == nil {
+			c.codec = codec
+		}
+	}
+
+	response := frame{bOK, []byte(strconv.Itoa(version)), []byte(Version)}
+	for _, capability := range c.server.capabilities() {
+		response = append(response, []byte(capability))
+	}
+	for _, capability := range c.server.limitCapabilities() {
+		response = append(response, []byte(capability))
+	}
+	if c.codec != nil {
+		response = append(response, []byte(CapabilityCompressionPrefix+c.codec.Name()))
+	}
+	c.sendOrStop(response)
+}
+
+// hello performs the handshake. The c.mu must be held.
+func (c *Client) hello(ctx context.Context) error {
+	request := frame{bHello, []byte(strconv.Itoa(ProtocolVersion))}
+	offered := make(map[string]bool)
+	for _, name := range c.compressionCodecs() {
+		if codecByName(name) != nil {
+			offered[name] = true
+			request = append(request, []byte(CapabilityCompressionPrefix+name))
+		}
+	}
+
+	response, err := c.cmdLocked(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	if len(response) < 1 {
+		return ErrBadResponse
+	}
+	if bytes.Equal(response[0], bError) {
+		err = responseError(response)
+		if errors.Is(err, ErrUnknownCommand) {
+			c.closeConn()
+			return errLegacyServer
+		}
+		return err
+	}
+	if !bytes.Equal(response[0], bOK) || len(response) < 3 {
+		return ErrBadResponse
+	}
+
+	version, err := strconv.Atoi(string(response[1]))
+	if err != nil || version > ProtocolVersion {
+		return ErrBadResponse
+	}
+
+	c.protocol = version
+	c.serverVersion = string(response[2])
+	c.capabilities = make(map[string]bool)
+	for _, capability := range response[3:] {
+		if c.limits.setLimitCapability(string(capability)) {
+			continue
+		}
+		c.capabilities[string(capability)] = true
+		if codec, ok := codecCapability(string(capability)); ok && offered[codec.Name()] {
+			c.codec = codec
+		}
+	}
+
+	return nil
+}
+
+// ProtocolVersion returns the protocol version negotiated with the server.
+// It is 0 if the server does not support the handshake.
+func (c *Client) ProtocolVersion() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.protocol
+}
+
+// ServerVersion returns the server version reported in the handshake.
+// It is blank if the server does not support the handshake.
+func (c *Client) ServerVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverVersion
+}
+
+// Compression returns the name of the compression codec negotiated with the server.
+// It is blank if the message bodies are not compressed.
+func (c *Client) Compression() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.codec == nil {
+		return ""
+	}
+	return c.codec.Name()
+}
+
+// HasCapability reports whether the server supports the optional feature.
+func (c *Client) HasCapability(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capabilities[name]
+}
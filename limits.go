@@ -0,0 +1,234 @@
+package mqmq
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerLimits are the limits the server enforces on the clients and the
+// resources they use. The zero MaxConnections, MaxConnectionsPerIP and
+// MaxQueues values mean no limit, while the other limits must be positive.
+type ServerLimits struct {
+	MaxQueueNameLen     int           // Maximum queue name length in bytes.
+	MaxMessageSize      int           // Maximum message size in bytes, including the messages sent in chunks.
+	MaxFrameSize        int           // Maximum request and response frame size in bytes.
+	MaxGetTimeout       time.Duration // Maximum Get request timeout.
+	MaxConnections      int           // Maximum number of connections.
+	MaxConnectionsPerIP int           // Maximum number of connections from a single IP address.
+	MaxQueues           int           // Maximum number of queues.
+}
+
+// DefaultMaxFrameSize is the default maximum frame size allowed.
+const DefaultMaxFrameSize = maxFrameLen
+
+// minFrameSize is the smallest maximum frame size that still fits the message chunks.
+const minFrameSize = messageChunkSize + 1024
+
+// CapabilityLimitPrefix is the prefix of the server capabilities that advertise
+// the server limits, e.g. "limit-queue-name=1024".
+const CapabilityLimitPrefix = "limit-"
+
+// Names of the limits advertised to the clients.
+const (
+	limitQueueName  = "queue-name"
+	limitMessage    = "message"
+	limitFrame      = "frame"
+	limitGetTimeout = "get-timeout" // In milliseconds.
+)
+
+var (
+	errMaxQueues         = errors.New("mqmq: maximum number of queues reached")
+	errQueueNameTooLong  = errors.New("mqmq: queue name is longer than the server allows")
+	errGetTimeoutTooLong = errors.New("mqmq: timeout is longer than the server allows")
+)
+
+// DefaultServerLimits returns the limits of a new server: the queue names,
+// messages, frames and Get timeouts are limited by MaxQueueNameLen,
+// DefaultMaxMessageSize, DefaultMaxFrameSize and MaxGetTimeout,
+// and the numbers of connections and queues are not limited.
+func DefaultServerLimits() ServerLimits {
+	return ServerLimits{
+		MaxQueueNameLen: MaxQueueNameLen,
+		MaxMessageSize:  DefaultMaxMessageSize,
+		MaxFrameSize:    DefaultMaxFrameSize,
+		MaxGetTimeout:   MaxGetTimeout,
+	}
+}
+
+// SetLimits sets the server limits. The queue name, message, frame and Get
+// timeout limits are advertised to the clients in the handshake. Messages that
+// don't fit into a frame can only be sent in chunks (see Client.PutReader) and
+// received with Client.GetWriter. The connections of replicas and cluster
+// members count towards the connection limits, while the queues created by
+// the replication don't count towards the MaxQueues limit.
+func (s *Server) SetLimits(limits ServerLimits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != ServerStateNew {
+		return errServerState
+	}
+
+	switch {
+	case limits.MaxQueueNameLen <= 0:
+		return errors.New("mqmq: max queue name length must be positive")
+	case limits.MaxMessageSize <= 0:
+		return errors.New("mqmq: max message size must be positive")
+	case limits.MaxFrameSize < minFrameSize+limits.MaxQueueNameLen || int64(limits.MaxFrameSize) > math.MaxUint32:
+		return errors.New("mqmq: max frame size is too small or too large")
+	case limits.MaxGetTimeout < time.Millisecond:
+		return errors.New("mqmq: max Get timeout must be at least a millisecond")
+	case limits.MaxConnections < 0 || limits.MaxConnectionsPerIP < 0 || limits.MaxQueues < 0:
+		return errors.New("mqmq: negative connections or queues limit")
+	}
+
+	s.limits = limits
+	return nil
+}
+
+// Limits returns the server limits.
+func (s *Server) Limits() ServerLimits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.limits
+}
+
+// limitCapabilities returns the capabilities that advertise the server limits.
+func (s *Server) limitCapabilities() []string {
+	return []string{
+		CapabilityLimitPrefix + limitQueueName + "=" + strconv.Itoa(s.limits.MaxQueueNameLen),
+		CapabilityLimitPrefix + limitMessage + "=" + strconv.Itoa(s.limits.MaxMessageSize),
+		CapabilityLimitPrefix + limitFrame + "=" + strconv.Itoa(s.limits.MaxFrameSize),
+		CapabilityLimitPrefix + limitGetTimeout + "=" + strconv.FormatInt(int64(s.limits.MaxGetTimeout/time.Millisecond), 10),
+	}
+}
+
+// setLimitCapability sets the limit advertised by the server capability.
+// It reports false if the capability is not a known limit.
+func (l *ServerLimits) setLimitCapability(capability string) bool {
+	if !strings.HasPrefix(capability, CapabilityLimitPrefix) {
+		return false
+	}
+	kv := strings.SplitN(capability[len(CapabilityLimitPrefix):], "=", 2)
+	if len(kv) != 2 {
+		return false
+	}
+	n, err := strconv.ParseInt(kv[1], 10, 64)
+	if err != nil || n < 0 || n > math.MaxUint32 || int64(int(n)) != n {
+		return false
+	}
+
+	switch kv[0] {
+	case limitQueueName:
+		l.MaxQueueNameLen = int(n)
+	case limitMessage:
+		l.MaxMessageSize = int(n)
+	case limitFrame:
+		l.MaxFrameSize = int(n)
+	case limitGetTimeout:
+		l.MaxGetTimeout = time.Duration(n) * time.Millisecond
+	default:
+		return false
+	}
+	return true
+}
+
+// Limits returns the server limits advertised in the handshake. The default
+// limits are returned for the servers that don't advertise them. The
+// connections and queues limits are not advertised and are always zero.
+func (c *Client) Limits() ServerLimits {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limits
+}
+
+// checkQueueName checks the queue name length against the server limit.
+// The c.mu must be held.
+func (c *Client) checkQueueName(queue string) error {
+	if len(queue) > c.limits.MaxQueueNameLen {
+		return errQueueNameTooLong
+	}
+	return nil
+}
+
+// checkGetTimeout checks the Get timeout against the server limit and returns
+// the timeout request value. The c.mu must be held.
+func (c *Client) checkGetTimeout(timeout time.Duration) ([]byte, error) {
+	if timeout < 0 {
+		timeout = 0
+	} else if timeout > c.limits.MaxGetTimeout {
+		return nil, errGetTimeoutTooLong
+	}
+	return []byte(strconv.Itoa(int(timeout / time.Millisecond))), nil
+}
+
+// acceptConnection registers the connection unless it exceeds the connection
+// limits, in which case the error response frame is returned. The s.mu must be held.
+func (s *Server) acceptConnection(c *connection) frame {
+	if max := s.limits.MaxConnections; max > 0 && len(s.connections) >= max {
+		return errorFrame(ErrLimitConnections, "server has reached the maximum of "+strconv.Itoa(max)+" connections")
+	}
+	if max := s.limits.MaxConnectionsPerIP; max > 0 && s.connectionsPerIP[c.ip] >= max {
+		return errorFrame(ErrLimitConnectionsPerIP, "server has reached the maximum of "+strconv.Itoa(max)+" connections from "+c.ip)
+	}
+
+	s.connections[c] = struct{}{}
+	s.connectionsPerIP[c.ip]++
+	return nil
+}
+
+// removeConnection unregisters the connection that is done.
+func (s *Server) removeConnection(c *connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.connections, c)
+	s.deleteReplyQueue(c)
+	s.connectionsPerIP[c.ip]--
+	if s.connectionsPerIP[c.ip] <= 0 {
+		delete(s.connectionsPerIP, c.ip)
+	}
+}
+
+// rejectConnection sends the error response to the client and closes the
+// connection. The client requests are read and discarded for a while, so that
+// the client receives the response before the connection is closed.
+func (s *Server) rejectConnection(conn net.Conn, errf frame) {
+	defer conn.Close()
+
+	s.logf("ERROR: connection from %s rejected: %s", conn.RemoteAddr(), errf[2])
+	conn.SetDeadline(time.Now().Add(rejectLingerTime))
+	err := writeFrame(conn, errf, maxFrameLen)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 512)
+	for {
+		_, err = conn.Read(buf)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// rejectLingerTime is how long the rejected connection is kept open.
+const rejectLingerTime = 1 * time.Second
+
+// remoteIP returns the IP address of the connection peer.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,195 @@
+package mqmq
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServerWithLimits(limits ServerLimits) (*Server, string) {
+	s := NewServer()
+	s.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	err := s.SetLimits(limits)
+	if err != nil {
+		panic("Test server start failed: SetLimits: " + err.Error())
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("Test server start failed: net.Listen: " + err.Error())
+	}
+	go s.Serve(listener)
+
+	for s.State() == ServerStateNew {
+		time.Sleep(time.Millisecond)
+	}
+
+	return s, listener.Addr().String()
+}
+
+func TestSetLimits(t *testing.T) {
+	for _, change := range []func(*ServerLimits){
+		func(l *ServerLimits) { l.MaxQueueNameLen = 0 },
+		func(l *ServerLimits) { l.MaxMessageSize = -1 },
+		func(l *ServerLimits) { l.MaxMessageSize = 0 },
+		func(l *ServerLimits) { l.MaxFrameSize = messageChunkSize },
+		func(l *ServerLimits) { l.MaxGetTimeout = 0 },
+		func(l *ServerLimits) { l.MaxConnections = -1 },
+		func(l *ServerLimits) { l.MaxQueues = -1 },
+	} {
+		limits := DefaultServerLimits()
+		change(&limits)
+		err := NewServer().SetLimits(limits)
+		if err == nil {
+			t.Fatalf("failed s.SetLimits: expected error for %+v", limits)
+		}
+	}
+
+	s, _ := startServer()
+	defer s.Stop()
+	if s.Limits() != DefaultServerLimits() {
+		t.Fatalf("failed s.Limits: expected default limits, got %+v", s.Limits())
+	}
+	err := s.SetLimits(DefaultServerLimits())
+	if err != errServerState {
+		t.Fatalf("failed s.SetLimits: expected %v for active server, got %v", errServerState, err)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	limits := DefaultServerLimits()
+	limits.MaxQueueNameLen = 16
+	limits.MaxFrameSize = minFrameSize + 16
+	limits.MaxMessageSize = 4 * messageChunkSize
+	limits.MaxGetTimeout = time.Second
+	limits.MaxQueues = 2
+	s, addr := startServerWithLimits(limits)
+	defer s.Stop()
+
+	c := NewClient()
+	c.SetCompression(0)
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	// Only the request limits are advertised.
+	advertised := limits
+	advertised.MaxQueues = 0
+	if c.Limits() != advertised {
+		t.Fatalf("failed c.Limits: expected %+v, got %+v", advertised, c.Limits())
+	}
+	for capability := range c.capabilities {
+		if strings.HasPrefix(capability, CapabilityLimitPrefix) {
+			t.Fatalf("failed c.HasCapability: limit %q is reported as capability", capability)
+		}
+	}
+
+	longName := []byte(strings.Repeat("q", 17))
+	checkReplies(t, addr, []replyCase{
+		{frame{bPut, longName, []byte("m")}, bError, ErrBadQueueName},
+		{frame{bGet, longName, []byte("0")}, bError, ErrBadQueueName},
+		{frame{bGet, []byte("q1"), []byte("1001")}, bError, ErrBadTimeout},
+		{frame{bPut, []byte("q1"), make([]byte, limits.MaxFrameSize)}, bError, ErrRequestTooLarge},
+		{frame{bPut, []byte("q1"), []byte("m")}, bOK, nil},
+		{frame{bPut, []byte("q2"), []byte("m")}, bOK, nil},
+		{frame{bPut, []byte("q3"), []byte("m")}, bError, ErrLimitQueues},
+		{frame{bGet, []byte("q3"), []byte("0")}, bError, ErrLimitQueues},
+		{frame{bGet, []byte("q1"), []byte("0")}, bOK, nil},
+	})
+
+	// The client checks the advertised limits before sending the requests.
+	err = c.Put(string(longName), []byte("m"))
+	if err != errQueueNameTooLong {
+		t.Fatalf("failed c.Put: expected %v, got %v", errQueueNameTooLong, err)
+	}
+	_, err = c.Get("q1", 2*time.Second)
+	if err != errGetTimeoutTooLong {
+		t.Fatalf("failed c.Get: expected %v, got %v", errGetTimeoutTooLong, err)
+	}
+	err = c.Put("q1", make([]byte, limits.MaxFrameSize))
+	if err != ErrFrameLen {
+		t.Fatalf("failed c.Put: expected %v, got %v", ErrFrameLen, err)
+	}
+
+	// Messages that don't fit into a frame are sent in chunks.
+	message := bytes.Repeat([]byte{1}, 3*messageChunkSize)
+	err = c.PutReader("q1", bytes.NewReader(message))
+	if err != nil {
+		t.Fatalf("failed c.PutReader: %s", err)
+	}
+	_, err = c.Get("q1", time.Second)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("failed c.Get: expected %v, got %v", ErrMessageTooLarge, err)
+	}
+	var buf bytes.Buffer
+	_, err = c.GetWriter("q1", &buf, time.Second)
+	if err != nil || !bytes.Equal(buf.Bytes(), message) {
+		t.Fatalf("failed c.GetWriter: got %d bytes, %v", buf.Len(), err)
+	}
+
+	err = c.PutReader("q1", bytes.NewReader(make([]byte, limits.MaxMessageSize+1)))
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("failed c.PutReader: expected %v, got %v", ErrMessageTooLarge, err)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	for _, tc := range []struct {
+		limits ServerLimits
+		err    error
+	}{
+		{ServerLimits{MaxConnections: 2}, ErrLimitConnections},
+		{ServerLimits{MaxConnectionsPerIP: 2}, ErrLimitConnectionsPerIP},
+	} {
+		limits := DefaultServerLimits()
+		limits.MaxConnections = tc.limits.MaxConnections
+		limits.MaxConnectionsPerIP = tc.limits.MaxConnectionsPerIP
+		s, addr := startServerWithLimits(limits)
+
+		var clients []*Client
+		for i := 0; i < 2; i++ {
+			c := NewClient()
+			err := c.Connect(addr)
+			if err != nil {
+				t.Fatalf("failed c.Connect: %s", err)
+			}
+			clients = append(clients, c)
+		}
+
+		c := NewClient()
+		err := c.Connect(addr)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("failed c.Connect: expected %v, got %v", tc.err, err)
+		}
+
+		// The connection is accepted once another one is closed.
+		clients[0].Disconnect()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			err = c.Connect(addr)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, tc.err) || time.Now().After(deadline) {
+				t.Fatalf("failed c.Connect: %s", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		err = c.Put("test-queue", []byte("test-message"))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+
+		c.Disconnect()
+		clients[1].Disconnect()
+		s.Stop()
+	}
+}
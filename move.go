@@ -0,0 +1,195 @@
+package mqmq
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+)
+
+var (
+	bMove = []byte("Move")
+	bCopy = []byte("Copy")
+)
+
+// Request handler: Move <source queue> <destination queue> <count>
+// Request handler: Copy <source queue> <destination queue> <count>
+//
+// The server moves (or copies) up to count messages from the front of
+// the source queue to the end of the destination queue in the queue order
+// and responds with the number of the messages transferred: OK <count>
+// While the server runs, every moved message is in one of the queues at any
+// time, so the consumers neither miss it nor get it twice. The append to the
+// destination queue is written to the write-ahead log and the replication
+// stream before the removal from the source queue, so the message being moved
+// when the server crashes or the cluster leader changes is never lost, but it
+// can be restored in both queues.
+func (c *connection) handleTransfer(f frame, move bool) {
+	if len(f) < 4 {
+		c.sendOrStop(errorFrame(ErrBadParams, string(f[0])+" requires source queue, destination queue and count"))
+		return
+	}
+
+	srcName, dstName := string(f[1]), string(f[2])
+	for _, qname := range []string{srcName, dstName} {
+		if errf := c.checkQueueName(qname); errf != nil {
+			c.sendOrStop(errf)
+			return
+		}
+	}
+
+	count, err := strconv.Atoi(string(f[3]))
+	if err != nil || count < 1 {
+		c.sendOrStop(errorFrame(ErrBadParams, "count is not a positive integer"))
+		return
+	}
+
+	term, stepDown, ok := c.acceptRequest(f, true)
+	if !ok {
+		return
+	}
+
+	src, errf := c.consumerQueue(srcName)
+	if errf != nil {
+		c.sendOrStop(errf)
+		return
+	}
+	dst, errf := c.queue(dstName)
+	if errf != nil {
+		c.sendOrStop(errf)
+		return
+	}
+
+	select {
+	case <-c.done:
+		return
+	case <-stepDown:
+		c.sendOrStop(errorFrame(ErrClusterNotLeader, "server stopped being cluster leader"))
+		return
+	default:
+	}
+
+	var n int
+	if move {
+		n, err = c.move(src, dst, count)
+	} else {
+		n, err = c.copy(src, dst, count)
+	}
+	if err != nil {
+		c.server.logf("ERROR: failed to transfer messages (%s to %s): %s", srcName, dstName, err)
+		c.sendOrStop(errorFrame(ErrServerInternal, "failed to transfer messages"))
+		return
+	}
+
+	if c.server.wal != nil {
+		err := c.server.wal.wait(c.done, src, dst)
+		if err == errWALAborted {
+			return
+		}
+		if err != nil {
+			c.server.logf("ERROR: failed to write message to write-ahead log (%s): %s", dstName, err)
+			c.sendOrStop(errorFrame(ErrServerInternal, "failed to write message to write-ahead log"))
+			return
+		}
+	}
+
+	// The changes of both queues are numbered in order, so the destination
+	// queue change is committed after the source queue ones.
+	if c.server.raft != nil {
+		err := c.server.raft.commit(dst, term, c.done)
+		if err == errCommitAborted {
+			return
+		}
+		if err != nil {
+			c.sendOrStop(errorFrame(ErrClusterNotLeader, "server stopped being cluster leader"))
+			return
+		}
+	}
+
+	c.sendOrStop(frame{bOK, []byte(strconv.Itoa(n))})
+}
+
+// move moves up to count messages from src to dst. The moves are serialized,
+// so the queues blocked by the concurrent moves never wait for each other.
+func (c *connection) move(src, dst queue, count int) (int, error) {
+	c.server.moveMu.Lock()
+	defer c.server.moveMu.Unlock()
+
+	for n := 0; n < count; n++ {
+		ok, err := src.dequeueTo(dst)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			return n, nil
+		}
+	}
+	return count, nil
+}
+
+// copy appends up to count messages from the front of src to dst.
+func (c *connection) copy(src, dst queue, count int) (int, error) {
+	messages, err := src.front(count)
+	if err != nil {
+		return 0, err
+	}
+	for n, message := range messages {
+		err := dst.enqueue(message)
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(messages), nil
+}
+
+// Move moves up to count messages from the front of the source queue to the end
+// of the destination queue on the server and returns the number of the messages
+// moved. The consumers never get a moved message twice while the server runs.
+// The message being moved when the server crashes or the cluster leader changes
+// is never lost, but it can be restored in both queues.
+func (c *Client) Move(src, dst string, count int) (int, error) {
+	return c.MoveContext(context.Background(), src, dst, count)
+}
+
+// MoveContext moves up to count messages from the source queue to the destination queue.
+// If the context is canceled or its deadline is exceeded before the server
+// responds, the connection is closed and the context error is returned.
+func (c *Client) MoveContext(ctx context.Context, src, dst string, count int) (int, error) {
+	return c.transfer(ctx, bMove, src, dst, count)
+}
+
+// Copy appends the copies of up to count messages from the front of the source
+// queue to the end of the destination queue on the server and returns the number
+// of the messages copied. The source queue is not changed.
+func (c *Client) Copy(src, dst string, count int) (int, error) {
+	return c.CopyContext(context.Background(), src, dst, count)
+}
+
+// CopyContext copies up to count messages from the source queue to the destination queue.
+// If the context is canceled or its deadline is exceeded before the server
+// responds, the connection is closed and the context error is returned.
+func (c *Client) CopyContext(ctx context.Context, src, dst string, count int) (int, error) {
+	return c.transfer(ctx, bCopy, src, dst, count)
+}
+
+func (c *Client) transfer(ctx context.Context, cmd []byte, src, dst string, count int) (int, error) {
+	response, err := c.cmd(ctx, frame{cmd, []byte(src), []byte(dst), []byte(strconv.Itoa(count))})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response) < 1 {
+		return 0, ErrBadResponse
+	}
+	if bytes.Equal(response[0], bError) {
+		return 0, responseError(response)
+	}
+	if !bytes.Equal(response[0], bOK) || len(response) < 2 {
+		return 0, ErrBadResponse
+	}
+
+	n, err := strconv.Atoi(string(response[1]))
+	if err != nil {
+		return 0, ErrBadResponse
+	}
+	return n, nil
+}
@@ -0,0 +1,229 @@
+package mqmq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMoveAndCopy(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	replica, _ := startReplica(addr)
+	defer replica.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	for i := 0; i < 5; i++ {
+		err = c.Put("test-queue.dead", []byte(fmt.Sprintf("message-%d", i)))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+	err = c.Put("test-queue", []byte("message-x"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+
+	n, err := c.Copy("test-queue.dead", "test-queue.backup", 10)
+	if err != nil || n != 5 {
+		t.Fatalf("failed c.Copy: expected 5 messages copied, got %d, %v", n, err)
+	}
+	n, err = c.Move("test-queue.dead", "test-queue", 2)
+	if err != nil || n != 2 {
+		t.Fatalf("failed c.Move: expected 2 messages moved, got %d, %v", n, err)
+	}
+	n, err = c.Move("test-queue.dead", "test-queue", 10)
+	if err != nil || n != 3 {
+		t.Fatalf("failed c.Move: expected 3 messages moved, got %d, %v", n, err)
+	}
+	n, err = c.Move("test-queue.dead", "test-queue", 10)
+	if err != nil || n != 0 {
+		t.Fatalf("failed c.Move: expected 0 messages moved, got %d, %v", n, err)
+	}
+
+	// Moving the messages to the same queue rotates it.
+	n, err = c.Move("test-queue", "test-queue", 1)
+	if err != nil || n != 1 {
+		t.Fatalf("failed c.Move: expected 1 message moved, got %d, %v", n, err)
+	}
+
+	_, err = c.Copy("test-queue", "test..queue", 1)
+	if !errors.Is(err, ErrBadQueueName) {
+		t.Fatalf("failed c.Copy: expected %v, got %v", ErrBadQueueName, err)
+	}
+
+	want := map[string][]string{
+		"test-queue":        {"message-0", "message-1", "message-2", "message-3", "message-4", "message-x"},
+		"test-queue.dead":   nil,
+		"test-queue.backup": {"message-0", "message-1", "message-2", "message-3", "message-4"},
+	}
+	got := make(map[string][]string)
+	for name, messages := range queueContents(s) {
+		got[name] = nil
+		for _, m := range messages {
+			got[name] = append(got[name], string(m))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("failed c.Move: expected %q, got %q", want, got)
+	}
+
+	// The transfers are replicated.
+	waitInSync(t, s, replica)
+}
+
+func TestMoveConcurrent(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		err = c.Put("test-queue.dead", []byte(fmt.Sprintf("message-%d", i)))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+
+	// The consumers of both queues receive every message exactly once
+	// while the messages are moved.
+	var mu sync.Mutex
+	received := make(map[string]int)
+	var wg sync.WaitGroup
+	for _, qname := range []string{"test-queue.dead", "test-queue", "test-queue"} {
+		wg.Add(1)
+		go func(qname string) {
+			defer wg.Done()
+			c := NewClient()
+			err := c.Connect(addr)
+			if err != nil {
+				t.Errorf("failed c.Connect: %s", err)
+				return
+			}
+			defer c.Disconnect()
+			for {
+				m, err := c.Get(qname, 200*time.Millisecond)
+				if err == ErrTimeout {
+					return
+				}
+				if err != nil {
+					t.Errorf("failed c.Get: %s", err)
+					return
+				}
+				mu.Lock()
+				received[string(m)]++
+				mu.Unlock()
+			}
+		}(qname)
+	}
+
+	moved := 0
+	for moved < n {
+		k, err := c.Move("test-queue.dead", "test-queue", 7)
+		if err != nil {
+			t.Fatalf("failed c.Move: %s", err)
+		}
+		if k == 0 {
+			break
+		}
+		moved += k
+	}
+	wg.Wait()
+
+	if len(received) != n {
+		t.Fatalf("failed c.Move: expected %d messages received, got %d", n, len(received))
+	}
+	for m, k := range received {
+		if k != 1 {
+			t.Fatalf("failed c.Move: message %s received %d times", m, k)
+		}
+	}
+}
+
+func TestMoveWALTruncate(t *testing.T) {
+	for _, queueType := range []QueueType{QueueTypeChannel, QueueTypeMutex} {
+		t.Run(string(queueType), func(t *testing.T) {
+			options := WALOptions{Path: filepath.Join(t.TempDir(), "queues.wal")}
+			s, addr := startServerWith(func(s *Server) error {
+				err := s.SetQueueType(queueType)
+				if err != nil {
+					return err
+				}
+				return s.SetWAL(options)
+			})
+			for {
+				s.mu.RLock()
+				opened := s.wal != nil
+				s.mu.RUnlock()
+				if opened {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			c := NewClient()
+			err := c.Connect(addr)
+			if err != nil {
+				t.Fatalf("failed c.Connect: %s", err)
+			}
+			defer c.Disconnect()
+
+			for _, qname := range []string{"test-queue", "test-queue.dead", "test-queue.dead"} {
+				err = c.Put(qname, []byte("message-"+qname))
+				if err != nil {
+					t.Fatalf("failed c.Put: %s", err)
+				}
+			}
+			for _, dst := range []string{"test-queue", "test-queue.dead"} {
+				n, err := c.Move("test-queue.dead", dst, 1)
+				if err != nil || n != 1 {
+					t.Fatalf("failed c.Move: expected 1 message moved, got %d, %v", n, err)
+				}
+			}
+			s.Stop()
+
+			// The log cut at any offset after the puts keeps all the messages.
+			data, err := ioutil.ReadFile(options.Path)
+			if err != nil {
+				t.Fatalf("failed ioutil.ReadFile: %s", err)
+			}
+			var puts []byte
+			puts = appendWALRecord(puts, "test-queue", queueOp{kind: queueOpEnqueue, message: []byte("message-test-queue")})
+			for i := 0; i < 2; i++ {
+				puts = appendWALRecord(puts, "test-queue.dead", queueOp{kind: queueOpEnqueue, message: []byte("message-test-queue.dead")})
+			}
+			if !bytes.HasPrefix(data, puts) {
+				t.Fatalf("failed c.Put: unexpected log %q", data)
+			}
+			for offset := len(puts); offset <= len(data); offset++ {
+				got := make(walModel)
+				_, err := readWAL(bytes.NewReader(data[:offset]), int64(offset), got.apply)
+				if err != nil {
+					t.Fatalf("failed readWAL at %d: %s", offset, err)
+				}
+				if n := len(got["test-queue"]) + len(got["test-queue.dead"]); n < 3 {
+					t.Fatalf("failed c.Move: %d of 3 messages restored from log cut at %d", n, offset)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Package mqmqtest implements the conformance tests of the mqmq extensions.
+package mqmqtest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/disintegration/mqmq"
+)
+
+// TestQueueBackend checks that the backends created by the factory satisfy
+// the mqmq.QueueBackend contract and work with the mqmq server. The factory
+// is called with distinct queue names, and the backends of the queues never
+// used before must be empty.
+func TestQueueBackend(t *testing.T, factory mqmq.QueueFactory) {
+	t.Run("Order", func(t *testing.T) { testBackendOrder(t, factory) })
+	t.Run("Front", func(t *testing.T) { testBackendFront(t, factory) })
+	t.Run("Empty", func(t *testing.T) { testBackendEmpty(t, factory) })
+	t.Run("Messages", func(t *testing.T) { testBackendMessages(t, factory) })
+	t.Run("Server", func(t *testing.T) { testBackendServer(t, factory) })
+}
+
+// newBackend returns the empty backend of the named queue.
+func newBackend(t *testing.T, factory mqmq.QueueFactory, name string) mqmq.QueueBackend {
+	b, err := factory(name)
+	if err != nil {
+		t.Fatalf("failed factory(%q): %s", name, err)
+	}
+	if n := b.Len(); n != 0 {
+		b.Close()
+		t.Fatalf("failed factory(%q): expected empty backend, got %d messages", name, n)
+	}
+	return b
+}
+
+func pushBack(t *testing.T, b mqmq.QueueBackend, message []byte) {
+	err := b.PushBack(message)
+	if err != nil {
+		t.Fatalf("failed b.PushBack: %s", err)
+	}
+}
+
+func pushFront(t *testing.T, b mqmq.QueueBackend, message []byte) {
+	err := b.PushFront(message)
+	if err != nil {
+		t.Fatalf("failed b.PushFront: %s", err)
+	}
+}
+
+// popFront removes the first message and checks that it is the expected one.
+func popFront(t *testing.T, b mqmq.QueueBackend, want []byte) {
+	v, ok, err := b.PopFront()
+	if err != nil {
+		t.Fatalf("failed b.PopFront: %s", err)
+	}
+	if !ok || !bytes.Equal(v, want) {
+		t.Fatalf("failed b.PopFront: expected %q, true, got %q, %v", want, v, ok)
+	}
+}
+
+func checkLen(t *testing.T, b mqmq.QueueBackend, want int) {
+	if n := b.Len(); n != want {
+		t.Fatalf("failed b.Len: expected %d, got %d", want, n)
+	}
+}
+
+func testBackendOrder(t *testing.T, factory mqmq.QueueFactory) {
+	b := newBackend(t, factory, "mqmqtest.order")
+	defer b.Close()
+
+	// Enough messages to make the buffered backends grow and shrink.
+	const n = 1000
+	for i := 0; i < n; i++ {
+		pushBack(t, b, []byte(fmt.Sprintf("message-%d", i)))
+		checkLen(t, b, i+1)
+	}
+	for i := 0; i < n; i++ {
+		popFront(t, b, []byte(fmt.Sprintf("message-%d", i)))
+		checkLen(t, b, n-i-1)
+	}
+}
+
+func testBackendFront(t *testing.T, factory mqmq.QueueFactory) {
+	b := newBackend(t, factory, "mqmqtest.front")
+	defer b.Close()
+
+	pushBack(t, b, []byte("message-2"))
+	pushFront(t, b, []byte("message-1"))
+	pushBack(t, b, []byte("message-3"))
+	pushFront(t, b, []byte("message-0"))
+	checkLen(t, b, 4)
+
+	for i := 0; i < 4; i++ {
+		popFront(t, b, []byte(fmt.Sprintf("message-%d", i)))
+	}
+	checkLen(t, b, 0)
+}
+
+func testBackendEmpty(t *testing.T, factory mqmq.QueueFactory) {
+	b := newBackend(t, factory, "mqmqtest.empty")
+	defer b.Close()
+
+	v, ok, err := b.PopFront()
+	if err != nil || ok {
+		t.Fatalf("failed b.PopFront: expected false, nil, got %q, %v, %v", v, ok, err)
+	}
+
+	// Empty and large messages are stored as is.
+	large := bytes.Repeat([]byte("0123456789"), 100000)
+	pushBack(t, b, []byte{})
+	pushBack(t, b, large)
+	popFront(t, b, []byte{})
+	popFront(t, b, large)
+
+	v, ok, err = b.PopFront()
+	if err != nil || ok {
+		t.Fatalf("failed b.PopFront: expected false, nil, got %q, %v, %v", v, ok, err)
+	}
+}
+
+func testBackendMessages(t *testing.T, factory mqmq.QueueFactory) {
+	b := newBackend(t, factory, "mqmqtest.messages")
+	defer b.Close()
+
+	messages, err := b.Messages()
+	if err != nil || len(messages) != 0 {
+		t.Fatalf("failed b.Messages: expected no messages, got %q, %v", messages, err)
+	}
+
+	pushBack(t, b, []byte("message-1"))
+	pushBack(t, b, []byte("message-2"))
+	pushFront(t, b, []byte("message-0"))
+
+	messages, err = b.Messages()
+	if err != nil {
+		t.Fatalf("failed b.Messages: %s", err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("failed b.Messages: expected 3 messages, got %q", messages)
+	}
+	for i, m := range messages {
+		want := []byte(fmt.Sprintf("message-%d", i))
+		if !bytes.Equal(m, want) {
+			t.Fatalf("failed b.Messages: expected %q, got %q", want, m)
+		}
+	}
+
+	if fb, ok := b.(mqmq.QueueFrontBackend); ok {
+		for _, n := range []int{0, 2, 5} {
+			front, err := fb.Front(n)
+			if err != nil {
+				t.Fatalf("failed b.Front: %s", err)
+			}
+			want := messages
+			if n < len(want) {
+				want = want[:n]
+			}
+			if len(front) != len(want) {
+				t.Fatalf("failed b.Front(%d): expected %q, got %q", n, want, front)
+			}
+			for i, m := range front {
+				if !bytes.Equal(m, messages[i]) {
+					t.Fatalf("failed b.Front(%d): expected %q, got %q", n, messages[i], m)
+				}
+			}
+		}
+	}
+
+	// The messages are not removed.
+	checkLen(t, b, 3)
+	popFront(t, b, []byte("message-0"))
+}
+
+func testBackendServer(t *testing.T, factory mqmq.QueueFactory) {
+	s := mqmq.NewServer()
+	s.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	err := s.SetQueueFactory(factory)
+	if err != nil {
+		t.Fatalf("failed s.SetQueueFactory: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed net.Listen: %s", err)
+	}
+	go s.Serve(listener)
+	defer s.Stop()
+	for s.State() == mqmq.ServerStateNew {
+		time.Sleep(time.Millisecond)
+	}
+
+	c := mqmq.NewClient()
+	err = c.Connect(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	qname := "mqmqtest.server"
+	for i := 0; i < 10; i++ {
+		err = c.Put(qname, []byte(fmt.Sprintf("message-%d", i)))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+
+	info, err := c.Info()
+	if err != nil || info.Queues[qname].NumMessages != 10 {
+		t.Fatalf("failed c.Info: expected 10 messages, got %#v, %v", info, err)
+	}
+
+	for i := 0; i < 5; i++ {
+		want := fmt.Sprintf("message-%d", i)
+		out, err := c.Get(qname, time.Second)
+		if err != nil || string(out) != want {
+			t.Fatalf("failed c.Get: expected %#v, %#v, got %#v, %#v", want, nil, string(out), err)
+		}
+	}
+
+	// A waiting consumer gets the message put later.
+	result := make(chan error, 1)
+	go func() {
+		c2 := mqmq.NewClient()
+		err := c2.Connect(listener.Addr().String())
+		if err != nil {
+			result <- err
+			return
+		}
+		defer c2.Disconnect()
+		_, err = c2.Get(qname+"-wait", 1*time.Minute)
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	err = c.Put(qname+"-wait", []byte("message"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+	err = <-result
+	if err != nil {
+		t.Fatalf("failed c2.Get: %s", err)
+	}
+
+	n, err := c.Purge(qname)
+	if err != nil || n != 5 {
+		t.Fatalf("failed c.Purge: expected 5, nil, got %d, %v", n, err)
+	}
+	_, err = c.Get(qname, 10*time.Millisecond)
+	if err != mqmq.ErrTimeout {
+		t.Fatalf("failed c.Get: expected error %#v, got %#v", mqmq.ErrTimeout, err)
+	}
+}
@@ -0,0 +1,55 @@
+package mqmqtest
+
+import (
+	"testing"
+
+	"github.com/disintegration/mqmq"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	TestQueueBackend(t, func(name string) (mqmq.QueueBackend, error) {
+		return mqmq.NewMemoryBackend(), nil
+	})
+}
+
+// sliceBackend is a minimal custom backend.
+type sliceBackend struct {
+	messages [][]byte
+}
+
+func (b *sliceBackend) PushBack(message []byte) error {
+	b.messages = append(b.messages, message)
+	return nil
+}
+
+func (b *sliceBackend) PushFront(message []byte) error {
+	b.messages = append([][]byte{message}, b.messages...)
+	return nil
+}
+
+func (b *sliceBackend) PopFront() ([]byte, bool, error) {
+	if len(b.messages) == 0 {
+		return nil, false, nil
+	}
+	v := b.messages[0]
+	b.messages = b.messages[1:]
+	return v, true, nil
+}
+
+func (b *sliceBackend) Len() int {
+	return len(b.messages)
+}
+
+func (b *sliceBackend) Messages() ([][]byte, error) {
+	return append([][]byte(nil), b.messages...), nil
+}
+
+func (b *sliceBackend) Close() error {
+	return nil
+}
+
+func TestSliceBackend(t *testing.T) {
+	TestQueueBackend(t, func(name string) (mqmq.QueueBackend, error) {
+		return &sliceBackend{}, nil
+	})
+}
@@ -0,0 +1,216 @@
+package mqmq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Queue names consist of one or more segments separated by dots, e.g.
+// "orders.eu.created". Each segment is a non-empty sequence of ASCII letters,
+// digits, underscores and hyphens. The dots make the queue names hierarchical:
+// the queues sharing the leading segments form a namespace, e.g. "orders".
+//
+// Namespaces are selected by queue patterns. A pattern is either a queue name
+// that matches the queue itself, a namespace followed by ".*" that matches all
+// the queues in the namespace (at any depth), or a single "*" that matches
+// all the queues.
+
+// ValidQueueName reports whether the name satisfies the queue name grammar.
+// The name length is limited separately (see ServerLimits).
+func ValidQueueName(name string) bool {
+	if name == "" {
+		return false
+	}
+	segmentLen := 0
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		switch {
+		case b == '.':
+			if segmentLen == 0 {
+				return false
+			}
+			segmentLen = 0
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9', b == '_', b == '-':
+			segmentLen++
+		default:
+			return false
+		}
+	}
+	return segmentLen > 0
+}
+
+// ValidQueuePattern reports whether the queue pattern is well-formed.
+func ValidQueuePattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	return ValidQueueName(strings.TrimSuffix(pattern, ".*"))
+}
+
+// MatchQueue reports whether the queue name matches the queue pattern.
+func MatchQueue(pattern, name string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, ".*") {
+		return strings.HasPrefix(name, pattern[:len(pattern)-1])
+	}
+	return name == pattern
+}
+
+// NamespaceLimits are the limits applied to the queues matching a pattern
+// in addition to the server limits. The limits with zero values are not enforced.
+type NamespaceLimits struct {
+	MaxQueues      int // Maximum number of queues.
+	MaxMessageSize int // Maximum message size in bytes.
+}
+
+// namespaceLimits are the limits set for a queue pattern.
+type namespaceLimits struct {
+	pattern string
+	limits  NamespaceLimits
+}
+
+var errBadQueuePattern = errors.New("mqmq: bad queue pattern")
+
+// SetNamespaceLimits sets the limits of the queues matching the pattern,
+// e.g. "orders.*". If several patterns match a queue, all their limits apply.
+func (s *Server) SetNamespaceLimits(pattern string, limits NamespaceLimits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != ServerStateNew {
+		return errServerState
+	}
+	if !ValidQueuePattern(pattern) {
+		return errBadQueuePattern
+	}
+	if limits.MaxQueues < 0 || limits.MaxMessageSize < 0 {
+		return errors.New("mqmq: negative namespace limit")
+	}
+
+	for i := range s.namespaceLimits {
+		if s.namespaceLimits[i].pattern == pattern {
+			s.namespaceLimits[i].limits = limits
+			return nil
+		}
+	}
+	s.namespaceLimits = append(s.namespaceLimits, namespaceLimits{pattern: pattern, limits: limits})
+	return nil
+}
+
+// maxMessageSize returns the maximum size of the messages put to the queue.
+func (s *Server) maxMessageSize(qname string) int {
+	max := s.limits.MaxMessageSize
+	for _, ns := range s.namespaceLimits {
+		if ns.limits.MaxMessageSize > 0 && ns.limits.MaxMessageSize < max && MatchQueue(ns.pattern, qname) {
+			max = ns.limits.MaxMessageSize
+		}
+	}
+	return max
+}
+
+// checkMaxQueues returns errMaxQueues if the new queue exceeds the server or
+// the namespace limits. The s.mu must be held.
+func (s *Server) checkMaxQueues(qname string) error {
+	if max := s.limits.MaxQueues; max > 0 && len(s.queues) >= max {
+		return errMaxQueues
+	}
+
+	for _, ns := range s.namespaceLimits {
+		max := ns.limits.MaxQueues
+		if max <= 0 || !MatchQueue(ns.pattern, qname) {
+			continue
+		}
+		n := 0
+		for name := range s.queues {
+			if MatchQueue(ns.pattern, name) {
+				n++
+			}
+		}
+		if n >= max {
+			return errMaxQueues
+		}
+	}
+
+	return nil
+}
+
+var bPurge = []byte("Purge")
+
+// Request handler: Purge <queue pattern>
+//
+// The server removes all the messages from the queues matching the pattern
+// and responds with the number of the messages removed: OK <count>
+func (c *connection) handlePurge(f frame) {
+	if len(f) < 2 {
+		c.sendOrStop(errorFrame(ErrBadParams, "Purge requires queue pattern"))
+		return
+	}
+
+	pattern := string(f[1])
+	if !ValidQueuePattern(pattern) {
+		c.sendOrStop(errorFrame(ErrBadQueueName, "bad queue pattern "+strconv.Quote(pattern)))
+		return
+	}
+
+	term, _, ok := c.acceptRequest(f, true)
+	if !ok {
+		return
+	}
+
+	count := 0
+	for name, q := range c.server.queueList() {
+		if !MatchQueue(pattern, name) {
+			continue
+		}
+		count += q.purge()
+
+		if c.server.raft != nil {
+			err := c.server.raft.commit(q, term, c.done)
+			if err == errCommitAborted {
+				return
+			}
+			if err != nil {
+				c.sendOrStop(errorFrame(ErrClusterNotLeader, "server stopped being cluster leader"))
+				return
+			}
+		}
+	}
+
+	c.sendOrStop(frame{bOK, []byte(strconv.Itoa(count))})
+}
+
+// Purge removes all the messages from the queues matching the pattern (see
+// ValidQueuePattern) and returns the number of the messages removed.
+func (c *Client) Purge(pattern string) (int, error) {
+	return c.PurgeContext(context.Background(), pattern)
+}
+
+// PurgeContext removes all the messages from the queues matching the pattern.
+// If the context is canceled or its deadline is exceeded before the server
+// responds, the connection is closed and the context error is returned.
+func (c *Client) PurgeContext(ctx context.Context, pattern string) (int, error) {
+	response, err := c.cmd(ctx, frame{bPurge, []byte(pattern)})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response) < 1 {
+		return 0, ErrBadResponse
+	}
+	if bytes.Equal(response[0], bError) {
+		return 0, responseError(response)
+	}
+	if !bytes.Equal(response[0], bOK) || len(response) < 2 {
+		return 0, ErrBadResponse
+	}
+
+	count, err := strconv.Atoi(string(response[1]))
+	if err != nil {
+		return 0, ErrBadResponse
+	}
+	return count, nil
+}
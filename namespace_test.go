@@ -0,0 +1,185 @@
+package mqmq
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidQueueName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"q":                 true,
+		"test-queue":        true,
+		"orders.eu.created": true,
+		"Orders_2.x-Y":      true,
+		"":                  false,
+		".":                 false,
+		"orders.":           false,
+		".orders":           false,
+		"orders..eu":        false,
+		"orders eu":         false,
+		"orders/eu":         false,
+		"orders.*":          false,
+		"очередь":           false,
+		"orders\x00":        false,
+	} {
+		if ValidQueueName(name) != valid {
+			t.Errorf("failed ValidQueueName(%q): expected %v", name, valid)
+		}
+	}
+
+	for pattern, valid := range map[string]bool{
+		"*":           true,
+		"orders":      true,
+		"orders.*":    true,
+		"orders.eu.*": true,
+		"":            false,
+		".*":          false,
+		"orders*":     false,
+		"orders.*.*":  false,
+		"*.orders":    false,
+	} {
+		if ValidQueuePattern(pattern) != valid {
+			t.Errorf("failed ValidQueuePattern(%q): expected %v", pattern, valid)
+		}
+	}
+}
+
+func TestMatchQueue(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*", "orders", true},
+		{"*", "orders.eu", true},
+		{"orders", "orders", true},
+		{"orders", "orders.eu", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.eu.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders-eu", false},
+		{"orders.eu.*", "orders.eu.created", true},
+		{"orders.eu.*", "orders.us.created", false},
+	} {
+		if MatchQueue(tc.pattern, tc.name) != tc.match {
+			t.Errorf("failed MatchQueue(%q, %q): expected %v", tc.pattern, tc.name, tc.match)
+		}
+	}
+}
+
+func TestNamespaceLimits(t *testing.T) {
+	s := NewServer()
+	err := s.SetNamespaceLimits("orders.*", NamespaceLimits{MaxQueues: -1})
+	if err == nil {
+		t.Fatalf("failed s.SetNamespaceLimits: expected error for negative limit")
+	}
+	err = s.SetNamespaceLimits("orders*", NamespaceLimits{MaxQueues: 1})
+	if err != errBadQueuePattern {
+		t.Fatalf("failed s.SetNamespaceLimits: expected %v, got %v", errBadQueuePattern, err)
+	}
+
+	s = NewServer()
+	s.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	err = s.SetNamespaceLimits("orders.*", NamespaceLimits{MaxQueues: 2})
+	if err == nil {
+		err = s.SetNamespaceLimits("orders.eu.*", NamespaceLimits{MaxQueues: 1, MaxMessageSize: 4})
+	}
+	if err != nil {
+		t.Fatalf("failed s.SetNamespaceLimits: %s", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed net.Listen: %s", err)
+	}
+	go s.Serve(listener)
+	defer s.Stop()
+	for s.State() == ServerStateNew {
+		time.Sleep(time.Millisecond)
+	}
+	addr := listener.Addr().String()
+
+	checkReplies(t, addr, []replyCase{
+		{frame{bPut, []byte("orders.eu.created"), []byte("m")}, bOK, nil},
+		{frame{bPut, []byte("orders.eu.created"), []byte("large")}, bError, ErrMessageTooLarge},
+		{frame{bPut, []byte("orders.eu.paid"), []byte("m")}, bError, ErrLimitQueues},
+		{frame{bPut, []byte("orders.us.created"), []byte("large")}, bOK, nil},
+		{frame{bPut, []byte("orders.us.paid"), []byte("m")}, bError, ErrLimitQueues},
+		{frame{bPut, []byte("users.created"), []byte("m")}, bOK, nil},
+	})
+}
+
+func TestPurgeAndInfoQueues(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	replica, _ := startReplica(addr)
+	defer replica.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	for _, qname := range []string{"orders.eu", "orders.eu", "orders.us", "users"} {
+		err = c.Put(qname, []byte("test-message"))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+
+	err = c.Put("orders..eu", []byte("test-message"))
+	if !errors.Is(err, ErrBadQueueName) {
+		t.Fatalf("failed c.Put: expected %v, got %v", ErrBadQueueName, err)
+	}
+
+	info, err := c.InfoQueues("orders.*")
+	if err != nil {
+		t.Fatalf("failed c.InfoQueues: %s", err)
+	}
+	if info.NumQueues != 2 || info.NumMessages != 3 || info.Queues["orders.eu"].NumMessages != 2 {
+		t.Fatalf("failed c.InfoQueues: unexpected info %+v", info)
+	}
+
+	_, err = c.InfoQueues("orders.")
+	if !errors.Is(err, ErrBadQueueName) {
+		t.Fatalf("failed c.InfoQueues: expected %v, got %v", ErrBadQueueName, err)
+	}
+
+	n, err := c.Purge("orders.*")
+	if err != nil || n != 3 {
+		t.Fatalf("failed c.Purge: expected 3 messages purged, got %d, %v", n, err)
+	}
+
+	info, err = c.Info()
+	if err != nil || info.NumQueues != 3 || info.NumMessages != 1 {
+		t.Fatalf("failed c.Info: unexpected info %+v, %v", info, err)
+	}
+
+	// The purge is replicated.
+	waitInSync(t, s, replica)
+	contents := queueContents(replica)
+	if len(contents["orders.eu"]) != 0 || len(contents["orders.us"]) != 0 || len(contents["users"]) != 1 {
+		t.Fatalf("failed replication: unexpected replica contents")
+	}
+
+	n, err = c.Purge("users")
+	if err != nil || n != 1 {
+		t.Fatalf("failed c.Purge: expected 1 message purged, got %d, %v", n, err)
+	}
+	_, err = c.Get("users", 10*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("failed c.Get: expected %v, got %v", ErrTimeout, err)
+	}
+
+	_, err = c.Purge(strings.Repeat("*", 2))
+	if !errors.Is(err, ErrBadQueueName) {
+		t.Fatalf("failed c.Purge: expected %v, got %v", ErrBadQueueName, err)
+	}
+}
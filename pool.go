@@ -0,0 +1,263 @@
+package mqmq
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed means that the pool is closed and can't be used anymore.
+var ErrPoolClosed = errors.New("mqmq: pool is closed")
+
+// DefaultPoolSize is the default maximum number of pool connections.
+const DefaultPoolSize = 10
+
+// Pool is a pool of client connections to a single mqmq server.
+// It is safe for concurrent use by multiple goroutines.
+type Pool struct {
+	addr   string
+	sem    chan struct{}
+	mu     sync.Mutex
+	idle   []idleClient
+	closed bool
+	stats  PoolStats
+}
+
+// PoolStats contains the pool usage statistics.
+type PoolStats struct {
+	MaxConns     int           // Maximum number of connections.
+	OpenConns    int           // Number of established connections, both in use and idle.
+	InUse        int           // Number of connections currently in use.
+	Idle         int           // Number of idle connections.
+	Acquired     int64         // Total number of times a connection was handed out.
+	Dials        int64         // Total number of connections established.
+	Closed       int64         // Total number of broken connections closed by the pool.
+	WaitCount    int64         // Total number of times a caller waited for a free connection.
+	WaitDuration time.Duration // Total time spent waiting for a free connection.
+}
+
+type idleClient struct {
+	client *Client
+	stop   func() bool
+}
+
+// NewPool creates a new pool of connections to the server at TCP address addr.
+// If addr is blank, DefaultAddr is used. At most maxConns connections are
+// established at the same time. If maxConns is less than 1, DefaultPoolSize is used.
+// Connections are established lazily.
+func NewPool(addr string, maxConns int) *Pool {
+	if maxConns < 1 {
+		maxConns = DefaultPoolSize
+	}
+	return &Pool{
+		addr:  addr,
+		sem:   make(chan struct{}, maxConns),
+		stats: PoolStats{MaxConns: maxConns},
+	}
+}
+
+// acquire returns a healthy client, establishing a new connection if there are no idle ones.
+// It blocks until a connection is available or the context is done.
+func (p *Pool) acquire(ctx context.Context) (*Client, error) {
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		start := time.Now()
+		var err error
+		select {
+		case p.sem <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		p.mu.Lock()
+		p.stats.WaitCount++
+		p.stats.WaitDuration += time.Since(start)
+		p.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			<-p.sem
+			return nil, ErrPoolClosed
+		}
+
+		if len(p.idle) == 0 {
+			break
+		}
+
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		c := ic.client
+		if ic.stop() {
+			p.mu.Lock()
+			p.stats.Acquired++
+			p.mu.Unlock()
+			return c, nil
+		}
+
+		c.Disconnect()
+		p.mu.Lock()
+		p.stats.OpenConns--
+		p.stats.Closed++
+	}
+	p.mu.Unlock()
+
+	c := NewClient()
+	err := c.ConnectContext(ctx, p.addr)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.stats.OpenConns++
+	p.stats.Dials++
+	p.stats.Acquired++
+	p.mu.Unlock()
+
+	return c, nil
+}
+
+// release returns the client to the pool. The client connection is closed
+// if the last request failed in a way that may leave it broken.
+func (p *Pool) release(c *Client, err error) {
+	p.mu.Lock()
+	if p.closed || brokenConn(err) {
+		p.stats.OpenConns--
+		if !p.closed {
+			p.stats.Closed++
+		}
+		p.mu.Unlock()
+		c.Disconnect()
+	} else {
+		p.idle = append(p.idle, idleClient{client: c, stop: c.watchIdle()})
+		p.mu.Unlock()
+	}
+	<-p.sem
+}
+
+// brokenConn reports whether the request error means that the client connection
+// is broken or out of sync: the network and protocol errors, and the context
+// errors, since the client closes the connection of an abandoned request.
+// The server errors and the requests rejected by the client keep it usable.
+func brokenConn(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || err == io.EOF || err == io.ErrUnexpectedEOF ||
+		err == ErrBadResponse || err == errNotConnected ||
+		err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// Put appends the message to the end of the given queue using one of the pool connections.
+func (p *Pool) Put(queue string, message []byte) error {
+	return p.PutContext(context.Background(), queue, message)
+}
+
+// PutContext appends the message to the end of the given queue using one of the pool connections.
+// The context is used both while waiting for a free connection and during the request.
+func (p *Pool) PutContext(ctx context.Context, queue string, message []byte) error {
+	c, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.PutContext(ctx, queue, message)
+	p.release(c, err)
+	return err
+}
+
+// Get receives the next message from the given queue using one of the pool connections.
+// See Client.Get for the timeout parameter description.
+func (p *Pool) Get(queue string, timeout time.Duration) ([]byte, error) {
+	return p.GetContext(context.Background(), queue, timeout)
+}
+
+// GetContext receives the next message from the given queue using one of the pool connections.
+// The context is used both while waiting for a free connection and during the request.
+func (p *Pool) GetContext(ctx context.Context, queue string, timeout time.Duration) ([]byte, error) {
+	c, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	message, err := c.GetContext(ctx, queue, timeout)
+	p.release(c, err)
+	return message, err
+}
+
+// GetAny receives the next message from any of the given queues using one of the pool connections.
+// See Client.GetAny for the details.
+func (p *Pool) GetAny(queues []string, timeout time.Duration) (string, []byte, error) {
+	return p.GetAnyContext(context.Background(), queues, timeout)
+}
+
+// GetAnyContext receives the next message from any of the given queues using one of the pool connections.
+// The context is used both while waiting for a free connection and during the request.
+func (p *Pool) GetAnyContext(ctx context.Context, queues []string, timeout time.Duration) (string, []byte, error) {
+	c, err := p.acquire(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	queue, message, err := c.GetAnyContext(ctx, queues, timeout)
+	p.release(c, err)
+	return queue, message, err
+}
+
+// Info requests the server information using one of the pool connections.
+func (p *Pool) Info() (*ServerInfo, error) {
+	return p.InfoContext(context.Background())
+}
+
+// InfoContext requests the server information using one of the pool connections.
+// The context is used both while waiting for a free connection and during the request.
+func (p *Pool) InfoContext(ctx context.Context) (*ServerInfo, error) {
+	c, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.InfoContext(ctx)
+	p.release(c, err)
+	return info, err
+}
+
+// Stats returns the pool usage statistics.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Idle = len(p.idle)
+	stats.InUse = stats.OpenConns - stats.Idle
+	return stats
+}
+
+// Close closes the idle connections and prevents new requests.
+// Connections that are currently in use are closed when their requests complete.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.stats.OpenConns -= len(idle)
+	p.mu.Unlock()
+
+	for _, ic := range idle {
+		ic.stop()
+		ic.client.Disconnect()
+	}
+	return nil
+}
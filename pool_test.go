@@ -0,0 +1,212 @@
+package mqmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	p := NewPool(addr, 3)
+	defer p.Close()
+
+	qname := "test-queue"
+	numWorkers := 10
+	numMessages := 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numWorkers)
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < numMessages; i++ {
+				err := p.Put(qname, []byte(fmt.Sprintf("message-%d-%d", w, i)))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("failed p.Put: %s", err)
+	}
+
+	info, err := p.Info()
+	if err != nil {
+		t.Fatalf("failed p.Info: %s", err)
+	}
+	if info.NumMessages != numWorkers*numMessages {
+		t.Fatalf("failed p.Info: expected %d messages, got %d", numWorkers*numMessages, info.NumMessages)
+	}
+	if info.NumConnections > 3 {
+		t.Fatalf("failed p.Info: expected at most 3 connections, got %d", info.NumConnections)
+	}
+
+	for i := 0; i < numWorkers*numMessages; i++ {
+		_, err := p.Get(qname, 1*time.Minute)
+		if err != nil {
+			t.Fatalf("failed p.Get: %s", err)
+		}
+	}
+
+	_, err = p.Get(qname, 10*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("failed p.Get: expected error %#v, got %#v", ErrTimeout, err)
+	}
+
+	stats := p.Stats()
+	if stats.MaxConns != 3 || stats.OpenConns > 3 || stats.OpenConns != stats.Idle || stats.InUse != 0 {
+		t.Fatalf("failed p.Stats: unexpected stats %#v", stats)
+	}
+	if stats.Acquired != int64(2*numWorkers*numMessages+2) {
+		t.Fatalf("failed p.Stats: expected %d acquired, got %d", 2*numWorkers*numMessages+2, stats.Acquired)
+	}
+}
+
+func TestPoolReplaceBroken(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	p := NewPool(addr, 1)
+	defer p.Close()
+
+	err := p.Put("test-queue", []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed p.Put: %s", err)
+	}
+
+	// Drop all the connections on the server side.
+	s.mu.Lock()
+	for c := range s.connections {
+		c.stop()
+	}
+	s.mu.Unlock()
+
+	for s.Info().NumConnections != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	out, err := p.Get("test-queue", 1*time.Minute)
+	if err != nil || string(out) != "test-message" {
+		t.Fatalf("failed p.Get: expected %#v, %#v, got %#v, %#v", "test-message", nil, string(out), err)
+	}
+
+	stats := p.Stats()
+	if stats.Dials != 2 || stats.Closed != 1 || stats.OpenConns != 1 {
+		t.Fatalf("failed p.Stats: unexpected stats %#v", stats)
+	}
+}
+
+func TestPoolKeepValid(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	p := NewPool(addr, 1)
+	defer p.Close()
+
+	// The requests rejected by the client or the server keep the connection.
+	err := p.Put(strings.Repeat("q", MaxQueueNameLen+1), []byte("test-message"))
+	if err != errQueueNameTooLong {
+		t.Fatalf("failed p.Put: expected %v, got %v", errQueueNameTooLong, err)
+	}
+	_, err = p.Get("test-queue", time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("failed p.Get: expected %v, got %v", ErrTimeout, err)
+	}
+	_, _, err = p.GetAny([]string{"test-queue", "bad queue"}, time.Millisecond)
+	if !errors.Is(err, ErrBadQueueName) {
+		t.Fatalf("failed p.GetAny: expected %v, got %v", ErrBadQueueName, err)
+	}
+
+	stats := p.Stats()
+	if stats.Dials != 1 || stats.Closed != 0 || stats.OpenConns != 1 {
+		t.Fatalf("failed p.Stats: unexpected stats %#v", stats)
+	}
+
+	// The client closes the connection of the abandoned request.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = p.GetContext(ctx, "test-queue", time.Minute)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("failed p.GetContext: expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	err = p.Put("test-queue", []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed p.Put: %s", err)
+	}
+
+	stats = p.Stats()
+	if stats.Dials != 2 || stats.Closed != 1 || stats.OpenConns != 1 {
+		t.Fatalf("failed p.Stats: unexpected stats %#v", stats)
+	}
+}
+
+func TestPoolWait(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	p := NewPool(addr, 1)
+	defer p.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := p.Get("test-queue", 1*time.Minute)
+		done <- err
+	}()
+
+	for p.Stats().InUse != 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The only connection is busy, so the request waits until the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := p.PutContext(ctx, "test-queue", []byte("test-message"))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("failed p.PutContext: expected error %#v, got %#v", context.DeadlineExceeded, err)
+	}
+
+	c := NewClient()
+	err = c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	err = c.Put("test-queue", []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatalf("failed p.Get: %s", err)
+	}
+
+	err = p.Put("test-queue", []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed p.Put: %s", err)
+	}
+
+	stats := p.Stats()
+	if stats.WaitCount != 1 || stats.WaitDuration <= 0 {
+		t.Fatalf("failed p.Stats: unexpected stats %#v", stats)
+	}
+
+	p.Close()
+	err = p.Put("test-queue", []byte("test-message"))
+	if err != ErrPoolClosed {
+		t.Fatalf("failed p.Put: expected error %#v, got %#v", ErrPoolClosed, err)
+	}
+}
@@ -4,76 +4,375 @@ import (
 	"container/list"
 )
 
+// queue is a message queue. Messages are passed to the consumers waiting for
+// them in the order the consumers started waiting, and the dequeue method takes
+// the first message only when nobody is waiting.
 type queue interface {
-	enqueue() chan<- []byte
-	requeue() chan<- []byte
-	dequeue() <-chan []byte
+	enqueue(message []byte) error
+	requeue(message []byte) error
+	dequeue() ([]byte, bool)
+	wait() *queueWaiter
+	cancel(w *queueWaiter)
+	waiting() int
 	len() int
+	purge() int
+	snapshot() (queueSnapshot, error)
+	front(n int) ([][]byte, error)
+	dequeueTo(dst queue) (bool, error)
 	stop()
 }
 
+// QueueType is the name of an in-memory queue implementation.
+type QueueType string
+
+// Queue implementations.
+const (
+	// QueueTypeChannel is the queue run by its own goroutine and accessed through channels.
+	QueueTypeChannel QueueType = "channel"
+	// QueueTypeMutex is the queue guarded by a mutex that keeps the messages
+	// in the memory backend (see NewMemoryBackend).
+	QueueTypeMutex QueueType = "mutex"
+)
+
+// newQueue creates a new queue of the given type.
+func newQueue(t QueueType, journal func(queueOp)) queue {
+	if t == QueueTypeMutex {
+		return newMutexQueue(journal)
+	}
+	return newMemoryQueue(journal)
+}
+
+// queueWaiter is a consumer waiting for a message.
+type queueWaiter struct {
+	ch   chan []byte
+	elem *list.Element
+}
+
+// message returns the channel that receives the message for the consumer.
+func (w *queueWaiter) message() <-chan []byte { return w.ch }
+
+// queueOpKind is a kind of the queue content change.
+type queueOpKind int
+
+// Queue content changes.
+const (
+	queueOpEnqueue queueOpKind = iota // The message is appended to the end of the queue.
+	queueOpRequeue                    // The message is inserted into the front of the queue.
+	queueOpDequeue                    // The first message is removed from the queue.
+)
+
+// queueOp is a queue content change reported to the queue journal.
+// Operations of a queue are numbered sequentially starting from 1.
+type queueOp struct {
+	kind    queueOpKind
+	message []byte
+	seq     uint64
+}
+
+// queueSnapshot is a copy of the queue contents.
+// The seq field is the number of the last operation applied to the queue.
+type queueSnapshot struct {
+	messages [][]byte
+	seq      uint64
+}
+
 type memoryQueue struct {
-	chEnqueue chan []byte
-	chRequeue chan []byte
-	chDequeue chan []byte
-	chLen     chan chan int
-	chStop    chan struct{}
-	data      *list.List
+	chEnqueue  chan []byte
+	chRequeue  chan []byte
+	chDequeue  chan chan []byte
+	chWait     chan *queueWaiter
+	chCancel   chan *queueWaiter
+	chWaiting  chan chan int
+	chLen      chan chan int
+	chPurge    chan chan int
+	chSnapshot chan chan queueSnapshot
+	chFront    chan queueFront
+	chTransfer chan queueTransfer
+	chStop     chan struct{}
+	chStopped  chan struct{}
+	data       *list.List
+	waiters    *list.List
+	journal    func(queueOp)
+	seq        uint64
 }
 
-func newMemoryQueue() *memoryQueue {
+// newMemoryQueue creates a new in-memory queue. If journal is not nil,
+// it is called synchronously for every change of the queue contents in
+// the order the changes are applied.
+func newMemoryQueue(journal func(queueOp)) *memoryQueue {
 	q := &memoryQueue{
-		chEnqueue: make(chan []byte),
-		chRequeue: make(chan []byte),
-		chDequeue: make(chan []byte),
-		chLen:     make(chan chan int),
-		chStop:    make(chan struct{}),
-		data:      list.New(),
+		chEnqueue:  make(chan []byte),
+		chRequeue:  make(chan []byte),
+		chDequeue:  make(chan chan []byte),
+		chWait:     make(chan *queueWaiter),
+		chCancel:   make(chan *queueWaiter),
+		chWaiting:  make(chan chan int),
+		chLen:      make(chan chan int),
+		chPurge:    make(chan chan int),
+		chSnapshot: make(chan chan queueSnapshot),
+		chFront:    make(chan queueFront),
+		chTransfer: make(chan queueTransfer),
+		chStop:     make(chan struct{}),
+		chStopped:  make(chan struct{}),
+		data:       list.New(),
+		waiters:    list.New(),
+		journal:    journal,
 	}
 	go q.run()
 	return q
 }
 
 func (q *memoryQueue) run() {
+	defer close(q.chStopped)
+
 	for {
-		if q.data.Len() == 0 {
-			select {
-			case v := <-q.chEnqueue:
-				q.data.PushBack(v)
-			case v := <-q.chRequeue:
-				q.data.PushFront(v)
-			case ch := <-q.chLen:
-				ch <- 0
-			case <-q.chStop:
-				return
-			}
-		} else {
-			select {
-			case v := <-q.chEnqueue:
-				q.data.PushBack(v)
-			case v := <-q.chRequeue:
-				q.data.PushFront(v)
-			case q.chDequeue <- q.data.Front().Value.([]byte):
-				q.data.Remove(q.data.Front())
-			case ch := <-q.chLen:
-				ch <- q.data.Len()
-			case <-q.chStop:
-				return
+		// The longest waiting consumers get the messages first.
+		for q.data.Len() > 0 && q.waiters.Len() > 0 {
+			w := q.waiters.Remove(q.waiters.Front()).(*queueWaiter)
+			w.elem = nil
+			v := q.data.Remove(q.data.Front()).([]byte)
+			q.record(queueOpDequeue, nil)
+			w.ch <- v
+		}
+
+		select {
+		case v := <-q.chEnqueue:
+			q.data.PushBack(v)
+			q.record(queueOpEnqueue, v)
+		case v := <-q.chRequeue:
+			q.data.PushFront(v)
+			q.record(queueOpRequeue, v)
+		case ch := <-q.chDequeue:
+			// Nobody is waiting if there are messages.
+			if q.data.Len() == 0 {
+				close(ch)
+				break
 			}
+			ch <- q.data.Remove(q.data.Front()).([]byte)
+			q.record(queueOpDequeue, nil)
+		case w := <-q.chWait:
+			w.elem = q.waiters.PushBack(w)
+		case w := <-q.chCancel:
+			q.cancelWaiter(w)
+		case ch := <-q.chWaiting:
+			ch <- q.waiters.Len()
+		case ch := <-q.chLen:
+			ch <- q.data.Len()
+		case ch := <-q.chPurge:
+			ch <- q.purgeData()
+		case ch := <-q.chSnapshot:
+			ch <- q.copyData()
+		case r := <-q.chFront:
+			r.ch <- q.copyFront(r.n)
+		case t := <-q.chTransfer:
+			t.ch <- q.transferFront(t.dst)
+		case <-q.chStop:
+			return
+		}
+	}
+}
+
+// cancelWaiter stops the consumer waiting. The message already passed to
+// the consumer is put back to the front of the queue.
+func (q *memoryQueue) cancelWaiter(w *queueWaiter) {
+	if w.elem != nil {
+		q.waiters.Remove(w.elem)
+		w.elem = nil
+		return
+	}
+	select {
+	case v := <-w.ch:
+		q.data.PushFront(v)
+		q.record(queueOpRequeue, v)
+	default:
+	}
+}
+
+func (q *memoryQueue) record(kind queueOpKind, message []byte) {
+	q.seq++
+	if q.journal != nil {
+		q.journal(queueOp{kind: kind, message: message, seq: q.seq})
+	}
+}
+
+// purgeData removes all the messages and returns their number.
+// Every removal is recorded as a separate dequeue operation.
+func (q *memoryQueue) purgeData() int {
+	n := q.data.Len()
+	for q.data.Len() > 0 {
+		q.data.Remove(q.data.Front())
+		q.record(queueOpDequeue, nil)
+	}
+	return n
+}
+
+func (q *memoryQueue) copyData() queueSnapshot {
+	messages := make([][]byte, 0, q.data.Len())
+	for e := q.data.Front(); e != nil; e = e.Next() {
+		messages = append(messages, e.Value.([]byte))
+	}
+	return queueSnapshot{messages: messages, seq: q.seq}
+}
+
+// queueFront is the request of the first messages of the queue.
+type queueFront struct {
+	n  int
+	ch chan [][]byte
+}
+
+func (q *memoryQueue) copyFront(n int) [][]byte {
+	if n > q.data.Len() {
+		n = q.data.Len()
+	}
+	messages := make([][]byte, 0, n)
+	for e := q.data.Front(); e != nil && len(messages) < n; e = e.Next() {
+		messages = append(messages, e.Value.([]byte))
+	}
+	return messages
+}
+
+// queueTransfer is the request to move the first message of the queue to dst.
+type queueTransfer struct {
+	dst queue
+	ch  chan transferResult
+}
+
+type transferResult struct {
+	ok  bool
+	err error
+}
+
+// transferFront moves the first message to dst (see dequeueTo).
+func (q *memoryQueue) transferFront(dst queue) transferResult {
+	// Nobody is waiting if there are messages.
+	if q.data.Len() == 0 {
+		return transferResult{}
+	}
+	front := q.data.Front()
+	v := front.Value.([]byte)
+	if dst == queue(q) {
+		q.data.PushBack(v)
+		q.record(queueOpEnqueue, v)
+	} else {
+		err := appendTo(dst, v)
+		if err != nil {
+			return transferResult{err: err}
 		}
 	}
+	q.data.Remove(front)
+	q.record(queueOpDequeue, nil)
+	return transferResult{ok: true}
+}
+
+// appendTo appends the message to the queue and waits until the queue
+// reports the change (see newMemoryQueue).
+func appendTo(q queue, message []byte) error {
+	err := q.enqueue(message)
+	if err != nil {
+		return err
+	}
+	q.len()
+	return nil
 }
 
 func (q *memoryQueue) stop() {
 	q.chStop <- struct{}{}
 }
 
+// len returns the number of the messages. The queue reports the changes
+// synchronously, so once len returns, the changes made before are reported.
 func (q *memoryQueue) len() int {
 	ch := make(chan int)
-	go func() { q.chLen <- ch }()
+	select {
+	case q.chLen <- ch:
+		return <-ch
+	case <-q.chStopped:
+		return 0
+	}
+}
+
+func (q *memoryQueue) purge() int {
+	ch := make(chan int)
+	go func() { q.chPurge <- ch }()
+	return <-ch
+}
+
+func (q *memoryQueue) snapshot() (queueSnapshot, error) {
+	ch := make(chan queueSnapshot)
+	go func() { q.chSnapshot <- ch }()
+	return <-ch, nil
+}
+
+// front returns up to n first messages of the queue.
+func (q *memoryQueue) front(n int) ([][]byte, error) {
+	ch := make(chan [][]byte)
+	go func() { q.chFront <- queueFront{n: n, ch: ch} }()
+	return <-ch, nil
+}
+
+// dequeueTo removes the first message after it is appended to dst, so the change
+// of dst is journaled first and the message is never lost between the queues.
+// The queue is blocked meanwhile, and dst must not wait for it. It reports
+// false if the queue is empty.
+func (q *memoryQueue) dequeueTo(dst queue) (bool, error) {
+	ch := make(chan transferResult)
+	select {
+	case q.chTransfer <- queueTransfer{dst: dst, ch: ch}:
+	case <-q.chStopped:
+		return false, nil
+	}
+	r := <-ch
+	return r.ok, r.err
+}
+
+// wait registers a consumer waiting for the next message.
+func (q *memoryQueue) wait() *queueWaiter {
+	w := &queueWaiter{ch: make(chan []byte, 1)}
+	select {
+	case q.chWait <- w:
+	case <-q.chStopped:
+	}
+	return w
+}
+
+// cancel unregisters the waiting consumer that hasn't received the message.
+func (q *memoryQueue) cancel(w *queueWaiter) {
+	select {
+	case q.chCancel <- w:
+	case <-q.chStopped:
+	}
+}
+
+func (q *memoryQueue) waiting() int {
+	ch := make(chan int)
+	go func() { q.chWaiting <- ch }()
 	return <-ch
 }
 
-func (q *memoryQueue) enqueue() chan<- []byte { return q.chEnqueue }
-func (q *memoryQueue) requeue() chan<- []byte { return q.chRequeue }
-func (q *memoryQueue) dequeue() <-chan []byte { return q.chDequeue }
+func (q *memoryQueue) enqueue(message []byte) error {
+	select {
+	case q.chEnqueue <- message:
+	case <-q.chStopped:
+	}
+	return nil
+}
+
+func (q *memoryQueue) requeue(message []byte) error {
+	select {
+	case q.chRequeue <- message:
+	case <-q.chStopped:
+	}
+	return nil
+}
+
+// dequeue removes the first message from the queue unless it's empty.
+func (q *memoryQueue) dequeue() ([]byte, bool) {
+	ch := make(chan []byte, 1)
+	select {
+	case q.chDequeue <- ch:
+	case <-q.chStopped:
+		return nil, false
+	}
+	v, ok := <-ch
+	return v, ok
+}
@@ -2,14 +2,72 @@ package mqmq
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 )
 
 func TestMemoryQueue(t *testing.T) {
-	q := newMemoryQueue()
+	q := newMemoryQueue(nil)
 	testQueue(t, q)
 }
 
+func TestMutexQueue(t *testing.T) {
+	q := newMutexQueue(nil)
+	testQueue(t, q)
+}
+
+func TestMemoryQueueJournal(t *testing.T) {
+	testQueueJournal(t, func(journal func(queueOp)) queue { return newMemoryQueue(journal) })
+}
+
+func TestMutexQueueJournal(t *testing.T) {
+	testQueueJournal(t, func(journal func(queueOp)) queue { return newMutexQueue(journal) })
+}
+
+func TestMemoryQueueWaiters(t *testing.T) {
+	q := newMemoryQueue(nil)
+	testQueueWaiters(t, q)
+}
+
+func TestMutexQueueWaiters(t *testing.T) {
+	q := newMutexQueue(nil)
+	testQueueWaiters(t, q)
+}
+
+func testQueueJournal(t *testing.T, newQueue func(journal func(queueOp)) queue) {
+	var ops []queueOp
+	q := newQueue(func(op queueOp) { ops = append(ops, op) })
+
+	q.enqueue([]byte{1})
+	q.enqueue([]byte{2})
+	q.requeue([]byte{0})
+	q.dequeue()
+
+	snap, _ := q.snapshot()
+	expectSnap := queueSnapshot{messages: [][]byte{{1}, {2}}, seq: 4}
+	if !reflect.DeepEqual(snap, expectSnap) {
+		t.Errorf("failed test-snapshot: expected %v, got %v", expectSnap, snap)
+	}
+	for n, expect := range [][][]byte{{}, {{1}}, {{1}, {2}}, {{1}, {2}}} {
+		front, err := q.front(n)
+		if err != nil || !reflect.DeepEqual(front, expect) {
+			t.Errorf("failed test-front(%d): expected %v, got %v, %v", n, expect, front, err)
+		}
+	}
+
+	q.stop()
+
+	expectOps := []queueOp{
+		{kind: queueOpEnqueue, message: []byte{1}, seq: 1},
+		{kind: queueOpEnqueue, message: []byte{2}, seq: 2},
+		{kind: queueOpRequeue, message: []byte{0}, seq: 3},
+		{kind: queueOpDequeue, seq: 4},
+	}
+	if !reflect.DeepEqual(ops, expectOps) {
+		t.Errorf("failed test-journal: expected %v, got %v", expectOps, ops)
+	}
+}
+
 func testQueue(t *testing.T, q queue) {
 	n := q.len()
 	if n != 0 {
@@ -19,7 +77,7 @@ func testQueue(t *testing.T, q queue) {
 	messages := [][]byte{{0}, {1}, {2}, {3}, {4}, {5}, {6}, {7}, {8}, {9}}
 
 	for i, m := range messages {
-		q.enqueue() <- m
+		q.enqueue(m)
 		n = q.len()
 		if n != i+1 {
 			t.Errorf("failed test-put-len: expected %d, got %d", i+1, n)
@@ -27,7 +85,7 @@ func testQueue(t *testing.T, q queue) {
 	}
 
 	for i, m := range messages {
-		v := <-q.dequeue()
+		v, _ := q.dequeue()
 		if bytes.Compare(v, m) != 0 {
 			t.Errorf("failed test-get-value: expected %v, got %v", m, v)
 		}
@@ -38,7 +96,7 @@ func testQueue(t *testing.T, q queue) {
 	}
 
 	for i, m := range messages {
-		q.requeue() <- m
+		q.requeue(m)
 		n = q.len()
 		if n != i+1 {
 			t.Errorf("failed test-put-len: expected %d, got %d", i+1, n)
@@ -46,7 +104,7 @@ func testQueue(t *testing.T, q queue) {
 	}
 
 	for i := range messages {
-		v := <-q.dequeue()
+		v, _ := q.dequeue()
 		if bytes.Compare(v, messages[len(messages)-i-1]) != 0 {
 			t.Errorf("failed test-get-value: expected %v, got %v", messages[len(messages)-i-1], v)
 		}
@@ -56,41 +114,187 @@ func testQueue(t *testing.T, q queue) {
 		}
 	}
 
+	for _, m := range messages {
+		q.enqueue(m)
+	}
+	n = q.purge()
+	if n != len(messages) {
+		t.Errorf("failed test-purge: expected %d, got %d", len(messages), n)
+	}
+	n = q.len()
+	if n != 0 {
+		t.Errorf("failed test-purge-len: expected 0, got %d", n)
+	}
+
+	v, ok := q.dequeue()
+	if ok {
+		t.Errorf("failed test-get-empty: expected no message, got %v", v)
+	}
+
+	// The order is kept while the queue grows and shrinks.
+	for i := 0; i < 1000; i++ {
+		q.enqueue([]byte{byte(i)})
+		if i%3 == 0 {
+			q.dequeue()
+		}
+	}
+	for i := 334; i < 1000; i++ {
+		v, _ := q.dequeue()
+		if !bytes.Equal(v, []byte{byte(i)}) {
+			t.Fatalf("failed test-grow-value: expected %v, got %v", []byte{byte(i)}, v)
+		}
+	}
+	n = q.len()
+	if n != 0 {
+		t.Errorf("failed test-grow-len: expected 0, got %d", n)
+	}
+
 	q.stop()
 }
 
 func BenchmarkMemoryQueueEnqDeq(b *testing.B) {
-	q := newMemoryQueue()
+	q := newMemoryQueue(nil)
 	benchQueueEnqDeq(b, q)
 }
 
 func BenchmarkMemoryQueueReqDeq(b *testing.B) {
-	q := newMemoryQueue()
+	q := newMemoryQueue(nil)
 	benchQueueReqDeq(b, q)
 }
 
+func BenchmarkMemoryQueueParallel(b *testing.B) {
+	q := newMemoryQueue(nil)
+	benchQueueParallel(b, q)
+}
+
+func BenchmarkMemoryQueueLen(b *testing.B) {
+	q := newMemoryQueue(nil)
+	benchQueueLen(b, q)
+}
+
+func BenchmarkMutexQueueEnqDeq(b *testing.B) {
+	q := newMutexQueue(nil)
+	benchQueueEnqDeq(b, q)
+}
+
+func BenchmarkMutexQueueReqDeq(b *testing.B) {
+	q := newMutexQueue(nil)
+	benchQueueReqDeq(b, q)
+}
+
+func BenchmarkMutexQueueParallel(b *testing.B) {
+	q := newMutexQueue(nil)
+	benchQueueParallel(b, q)
+}
+
+func BenchmarkMutexQueueLen(b *testing.B) {
+	q := newMutexQueue(nil)
+	benchQueueLen(b, q)
+}
+
 func benchQueueEnqDeq(b *testing.B, q queue) {
 	data := []byte{0x00}
 	for i := 0; i < 1000; i++ {
-		q.enqueue() <- data
+		q.enqueue(data)
 	}
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		q.enqueue() <- data
-		<-q.dequeue()
+		q.enqueue(data)
+		q.dequeue()
 	}
 }
 
 func benchQueueReqDeq(b *testing.B, q queue) {
 	data := []byte{0x00}
 	for i := 0; i < 1000; i++ {
-		q.enqueue() <- data
+		q.enqueue(data)
 	}
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		q.requeue() <- data
-		<-q.dequeue()
+		q.requeue(data)
+		q.dequeue()
+	}
+}
+
+// benchQueueParallel measures the queue used by many producers and consumers at once.
+func benchQueueParallel(b *testing.B, q queue) {
+	data := []byte{0x00}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			q.enqueue(data)
+			q.dequeue()
+		}
+	})
+	q.stop()
+}
+
+func benchQueueLen(b *testing.B, q queue) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		q.len()
+	}
+	q.stop()
+}
+
+func testQueueWaiters(t *testing.T, q queue) {
+	defer q.stop()
+
+	var waiters []*queueWaiter
+	for i := 0; i < 3; i++ {
+		waiters = append(waiters, q.wait())
+	}
+	n := q.waiting()
+	if n != 3 {
+		t.Errorf("failed test-waiting: expected 3, got %d", n)
+	}
+
+	// The waiters get the messages in the order they started waiting.
+	for i := 0; i < 3; i++ {
+		q.enqueue([]byte{byte(i)})
+	}
+	for i, w := range waiters {
+		v := <-w.message()
+		if !bytes.Equal(v, []byte{byte(i)}) {
+			t.Errorf("failed test-waiter-value: expected %v, got %v", []byte{byte(i)}, v)
+		}
+	}
+	n = q.waiting()
+	if n != 0 {
+		t.Errorf("failed test-waiting: expected 0, got %d", n)
+	}
+	n = q.len()
+	if n != 0 {
+		t.Errorf("failed test-waiter-len: expected 0, got %d", n)
+	}
+
+	// A canceled waiter is skipped.
+	w1 := q.wait()
+	w2 := q.wait()
+	q.cancel(w1)
+	n = q.waiting()
+	if n != 1 {
+		t.Errorf("failed test-cancel-waiting: expected 1, got %d", n)
+	}
+	q.enqueue([]byte{3})
+	v := <-w2.message()
+	if !bytes.Equal(v, []byte{3}) {
+		t.Errorf("failed test-cancel-value: expected %v, got %v", []byte{3}, v)
+	}
+
+	// The message received by a canceled waiter is put back to the front.
+	w3 := q.wait()
+	q.enqueue([]byte{4})
+	q.enqueue([]byte{5})
+	q.cancel(w3)
+	n = q.len()
+	if n != 2 {
+		t.Errorf("failed test-cancel-len: expected 2, got %d", n)
+	}
+	v, _ = q.dequeue()
+	if !bytes.Equal(v, []byte{4}) {
+		t.Errorf("failed test-cancel-requeue: expected %v, got %v", []byte{4}, v)
 	}
 }
@@ -0,0 +1,738 @@
+package mqmq
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The clustered mode.
+//
+// The cluster members elect a leader following the Raft election rules: the
+// members vote once per term, and only for a candidate that has applied at
+// least as many queue changes as the voter. The leader numbers every change of
+// its queues and streams the changes to the followers, which apply them in
+// the same order and acknowledge the last applied index. A Put or Get request
+// is answered only when its change is applied by the majority of the members.
+// A new leader first sends the full contents of its queues to every follower,
+// so the followers drop the changes the previous leader never committed.
+// The full contents are numbered as an empty change of the new term, and the
+// leader doesn't consider any change committed until the majority applies it,
+// so the changes of the previous terms are only committed along with it.
+// Followers proxy the client Put and Get requests to the leader.
+//
+// The terms and votes are not persisted, so a restarted member joins the
+// cluster with empty queues and can't be elected until it is synchronized.
+// A member restarted during an election forgets its vote and may vote again
+// in the same term, so two leaders can be elected in a single term if more
+// than one member restarts at that moment. The members should be restarted
+// one at a time, each after the cluster has elected a leader.
+
+const (
+	raftHeartbeatInterval = 100 * time.Millisecond
+	raftElectionTimeout   = 500 * time.Millisecond
+	raftRequestTimeout    = 300 * time.Millisecond
+)
+
+var (
+	bVote   = []byte("Vote")
+	bFollow = []byte("Follow")
+	bAck    = []byte("Ack")
+)
+
+var (
+	errNotLeader     = errors.New("mqmq: server is not the cluster leader")
+	errCommitAborted = errors.New("mqmq: commit wait aborted")
+)
+
+// raftState is the cluster member state.
+type raftState int
+
+// Cluster member states.
+const (
+	raftFollower raftState = iota
+	raftCandidate
+	raftLeader
+)
+
+var raftStateName = map[raftState]string{
+	raftFollower:  "follower",
+	raftCandidate: "candidate",
+	raftLeader:    "leader",
+}
+
+func (st raftState) String() string {
+	return raftStateName[st]
+}
+
+// ServerClusterInfo contains the cluster information as seen by the server.
+type ServerClusterInfo struct {
+	State       string
+	Term        uint64
+	Leader      string
+	Members     []string
+	LastIndex   uint64
+	CommitIndex uint64
+}
+
+type raftNode struct {
+	server  *Server
+	self    string
+	members []string
+
+	mu           sync.Mutex
+	state        raftState
+	term         uint64
+	votedFor     string
+	leader       string
+	lastTerm     uint64
+	lastIndex    uint64
+	termIndex    uint64 // The index of the first change of the leader term.
+	commitIndex  uint64
+	matchIndex   map[string]uint64
+	lastAck      map[string]time.Time
+	lastHeard    time.Time
+	streams      map[string]net.Conn
+	following    *connection
+	changed      chan struct{}
+	stepDown     chan struct{}
+	stop         chan struct{}
+	stopped      bool
+	electionWait time.Duration
+}
+
+// SetCluster makes the server a member of the cluster.
+// The self parameter is the TCP address other members use to connect to
+// this server and members is the list of addresses of all the members.
+func (s *Server) SetCluster(self string, members []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != ServerStateNew || s.role != ServerRolePrimary {
+		return errServerState
+	}
+
+	r := &raftNode{
+		server:  s,
+		self:    self,
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{self}, members...) {
+		if !seen[addr] {
+			seen[addr] = true
+			r.members = append(r.members, addr)
+		}
+	}
+	sort.Strings(r.members)
+
+	s.raft = r
+	return nil
+}
+
+func (r *raftNode) peers() []string {
+	var peers []string
+	for _, addr := range r.members {
+		if addr != r.self {
+			peers = append(peers, addr)
+		}
+	}
+	return peers
+}
+
+func (r *raftNode) majority() int {
+	return len(r.members)/2 + 1
+}
+
+// notify wakes up everyone waiting for the commit index or state changes.
+// The r.mu must be held.
+func (r *raftNode) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *raftNode) resetElectionTimer() {
+	r.lastHeard = time.Now()
+	r.electionWait = raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout)))
+}
+
+func (r *raftNode) run() {
+	r.mu.Lock()
+	r.resetElectionTimer()
+	r.mu.Unlock()
+
+	ticker := time.NewTicker(raftHeartbeatInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		switch r.state {
+		case raftFollower, raftCandidate:
+			if time.Since(r.lastHeard) > r.electionWait {
+				r.resetElectionTimer()
+				r.state = raftCandidate
+				r.term++
+				r.votedFor = r.self
+				r.leader = ""
+				r.notify()
+				go r.elect(r.term, r.lastTerm, r.lastIndex)
+			}
+		case raftLeader:
+			// Step down if the majority of the members can't be reached,
+			// so a partitioned leader doesn't keep accepting requests.
+			alive := 1
+			for _, t := range r.lastAck {
+				if time.Since(t) < 2*raftElectionTimeout {
+					alive++
+				}
+			}
+			if alive < r.majority() {
+				r.server.logf("INFO: cluster leader lost the majority in term %d", r.term)
+				r.becomeFollower(r.term, "")
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// elect requests the votes from all the peers and makes the member
+// the leader if the majority voted for it.
+func (r *raftNode) elect(term, lastTerm, lastIndex uint64) {
+	request := frame{
+		bVote,
+		[]byte(strconv.FormatUint(term, 10)),
+		[]byte(r.self),
+		[]byte(strconv.FormatUint(lastTerm, 10)),
+		[]byte(strconv.FormatUint(lastIndex, 10)),
+	}
+
+	peers := r.peers()
+	votes := make(chan bool, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			response, err := raftRequest(peer, request)
+			if err != nil || len(response) < 3 || !bytes.Equal(response[0], bOK) {
+				votes <- false
+				return
+			}
+			peerTerm, _ := strconv.ParseUint(string(response[1]), 10, 64)
+			r.observeTerm(peerTerm)
+			votes <- string(response[2]) == "1"
+		}(peer)
+	}
+
+	granted := 1
+	for range peers {
+		if <-votes {
+			granted++
+		}
+		if granted >= r.majority() {
+			break
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped || r.state != raftCandidate || r.term != term || granted < r.majority() {
+		return
+	}
+
+	r.becomeLeader(term)
+}
+
+// becomeLeader switches the member to the leader state. The r.mu must be held.
+func (r *raftNode) becomeLeader(term uint64) {
+	r.server.logf("INFO: cluster leader elected in term %d: %s", term, r.self)
+	r.state = raftLeader
+	r.leader = r.self
+	r.stepDown = make(chan struct{})
+	// The followers get the full contents of the queues first, which is the
+	// first change of the term. Only the changes of the leader term may be
+	// committed by counting the followers that applied them.
+	r.lastIndex++
+	r.lastTerm = term
+	r.termIndex = r.lastIndex
+	r.matchIndex = make(map[string]uint64)
+	r.lastAck = make(map[string]time.Time)
+	r.streams = make(map[string]net.Conn)
+	for _, peer := range r.peers() {
+		r.lastAck[peer] = time.Now()
+		go r.streamTo(peer, term)
+	}
+	r.updateCommit()
+	r.notify()
+}
+
+// raftRequest sends a single request to the cluster member and returns the response.
+func raftRequest(addr string, request frame) (frame, error) {
+	conn, err := net.DialTimeout("tcp", addr, raftRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(raftRequestTimeout))
+
+	writer := bufio.NewWriter(conn)
+	err = writeFrame(writer, request, maxFrameLen)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return readFrame(bufio.NewReader(conn), maxFrameLen)
+}
+
+// observeTerm makes the member a follower if a newer term is seen.
+func (r *raftNode) observeTerm(term uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if term > r.term {
+		r.becomeFollower(term, "")
+	}
+}
+
+// becomeFollower switches the member to the follower state. The r.mu must be held.
+func (r *raftNode) becomeFollower(term uint64, leader string) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+	}
+	if r.state == raftLeader {
+		close(r.stepDown)
+	}
+	r.state = raftFollower
+	r.leader = leader
+	for peer, conn := range r.streams {
+		conn.Close()
+		delete(r.streams, peer)
+	}
+	r.resetElectionTimer()
+	r.notify()
+}
+
+// vote handles the vote request of the candidate.
+func (r *raftNode) vote(term uint64, candidate string, lastTerm, lastIndex uint64) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if term > r.term {
+		r.becomeFollower(term, "")
+	}
+
+	upToDate := lastTerm > r.lastTerm || (lastTerm == r.lastTerm && lastIndex >= r.lastIndex)
+	if term < r.term || !upToDate || (r.votedFor != "" && r.votedFor != candidate) {
+		return r.term, false
+	}
+
+	r.votedFor = candidate
+	r.resetElectionTimer()
+	return r.term, true
+}
+
+// journal numbers the change of the leader queue and passes it to the followers.
+func (r *raftNode) journal(queue string, op queueOp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state != raftLeader {
+		return
+	}
+
+	r.lastIndex++
+	r.lastTerm = r.term
+	r.server.replication.publish(queue, op, r.lastIndex)
+	r.updateCommit()
+}
+
+// subscribe subscribes to the leader queue changes.
+func (r *raftNode) subscribe() (*replicationFeed, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.server.replication.subscribe(), r.lastIndex
+}
+
+// updateCommit advances the commit index to the highest index applied by the majority
+// once it reaches the changes of the leader term. The r.mu must be held.
+func (r *raftNode) updateCommit() {
+	indexes := []uint64{r.lastIndex}
+	for _, peer := range r.peers() {
+		indexes = append(indexes, r.matchIndex[peer])
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] > indexes[j] })
+
+	commitIndex := indexes[r.majority()-1]
+	if commitIndex >= r.termIndex && commitIndex > r.commitIndex {
+		r.commitIndex = commitIndex
+		r.notify()
+	}
+}
+
+// ack records the index applied by the follower.
+func (r *raftNode) ack(peer string, term, index uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state != raftLeader || r.term != term {
+		return
+	}
+	r.lastAck[peer] = time.Now()
+	if index > r.matchIndex[peer] {
+		r.matchIndex[peer] = index
+		r.updateCommit()
+	}
+}
+
+// leaderTerm returns the current term and whether the member is the leader.
+// The returned channel is closed when the leader steps down.
+func (r *raftNode) leaderTerm() (uint64, <-chan struct{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != raftLeader {
+		return r.term, nil, false
+	}
+	return r.term, r.stepDown, true
+}
+
+// leaderAddr returns the address of the current leader or blank if it is unknown.
+func (r *raftNode) leaderAddr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader
+}
+
+// commit waits until the latest change of the queue q is applied by the majority
+// of the members. It fails if the member is no longer the leader of the given term.
+func (r *raftNode) commit(q queue, term uint64, done <-chan struct{}) error {
+	// The queue reports its changes synchronously, so once it responds
+	// the change made by the caller is already numbered.
+	q.len()
+
+	r.mu.Lock()
+	index := r.lastIndex
+	for {
+		if r.state != raftLeader || r.term != term {
+			r.mu.Unlock()
+			return errNotLeader
+		}
+		if r.commitIndex >= index {
+			r.mu.Unlock()
+			return nil
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-done:
+			return errCommitAborted
+		case <-changed:
+		}
+		r.mu.Lock()
+	}
+}
+
+// streamTo keeps streaming the queue changes to the follower while the member
+// is the leader of the given term.
+func (r *raftNode) streamTo(peer string, term uint64) {
+	for {
+		err := r.streamOnce(peer, term)
+
+		if t, _, leader := r.leaderTerm(); !leader || t != term {
+			return
+		}
+
+		r.server.logf("ERROR: cluster stream to %s failed: %s", peer, err)
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(raftHeartbeatInterval):
+		}
+	}
+}
+
+func (r *raftNode) streamOnce(peer string, term uint64) error {
+	conn, err := net.DialTimeout("tcp", peer, raftRequestTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r.mu.Lock()
+	if r.state != raftLeader || r.term != term {
+		r.mu.Unlock()
+		return errNotLeader
+	}
+	r.streams[peer] = conn
+	r.mu.Unlock()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	request := frame{bFollow, []byte(strconv.FormatUint(term, 10)), []byte(r.self)}
+	err = writeFrame(writer, request, maxFrameLen)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(raftRequestTimeout))
+	response, err := readFrame(reader, maxFrameLen)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if len(response) < 1 || !bytes.Equal(response[0], bOK) {
+		if len(response) >= 4 && bytes.Equal(response[0], bError) {
+			peerTerm, _ := strconv.ParseUint(string(response[3]), 10, 64)
+			r.observeTerm(peerTerm)
+		}
+		return ErrBadResponse
+	}
+
+	feed, index := r.subscribe()
+	defer r.server.replication.unsubscribe(feed)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn.SetReadDeadline(time.Now().Add(2 * raftElectionTimeout))
+			f, err := readFrame(reader, maxFrameLen)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if len(f) >= 2 && bytes.Equal(f[0], bAck) {
+				index, _ := strconv.ParseUint(string(f[1]), 10, 64)
+				r.ack(peer, term, index)
+			}
+		}
+	}()
+
+	err = r.server.streamReplication(writer, feed, index, done, raftHeartbeatInterval)
+	conn.Close()
+	<-done
+	return err
+}
+
+// follow makes the member a follower of the leader of the given term
+// that streams the queue changes over the connection c.
+func (r *raftNode) follow(term uint64, leader string, c *connection) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if term < r.term || (term == r.term && r.state == raftLeader) {
+		return r.term, false
+	}
+
+	r.becomeFollower(term, leader)
+	if r.following != nil && r.following != c {
+		r.following.stop()
+	}
+	r.following = c
+	r.lastTerm = 0
+	r.lastIndex = 0
+	return r.term, true
+}
+
+// applied records the index of the last change applied by the follower.
+// It reports false if the leader of the given term is no longer followed.
+func (r *raftNode) applied(term, index uint64, c *connection) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.following != c || r.term != term || r.state != raftFollower {
+		return false
+	}
+	r.resetElectionTimer()
+	if index > 0 {
+		r.lastTerm = term
+		r.lastIndex = index
+	}
+	return true
+}
+
+// replicationIndex returns the index of the queue change frame
+// or zero if the change is a part of the initial contents.
+func replicationIndex(f frame) (uint64, error) {
+	n := 3
+	if bytes.Equal(f[0], bDequeue) {
+		n = 2
+	}
+	if len(f) <= n {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(f[n]), 10, 64)
+}
+
+func (r *raftNode) lastApplied() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastIndex
+}
+
+func (r *raftNode) info() ServerClusterInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return ServerClusterInfo{
+		State:       r.state.String(),
+		Term:        r.term,
+		Leader:      r.leader,
+		Members:     append([]string(nil), r.members...),
+		LastIndex:   r.lastIndex,
+		CommitIndex: r.commitIndex,
+	}
+}
+
+func (r *raftNode) shutdown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	close(r.stop)
+	r.becomeFollower(r.term, "")
+}
+
+// Request handler: Vote <term> <candidate> <last term> <last index>
+func (c *connection) handleVote(f frame) {
+	r := c.server.raft
+	if r == nil {
+		c.sendOrStop(errorFrame(ErrServerNotClustered, "server is not a cluster member"))
+		return
+	}
+
+	if len(f) < 5 {
+		c.sendOrStop(errorFrame(ErrBadParams, "Vote requires term, candidate, last term and last index"))
+		return
+	}
+
+	term, err1 := strconv.ParseUint(string(f[1]), 10, 64)
+	lastTerm, err2 := strconv.ParseUint(string(f[3]), 10, 64)
+	lastIndex, err3 := strconv.ParseUint(string(f[4]), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.sendOrStop(errorFrame(ErrBadParams, "term and index must be non-negative integers"))
+		return
+	}
+
+	currentTerm, granted := r.vote(term, string(f[2]), lastTerm, lastIndex)
+	vote := []byte("0")
+	if granted {
+		vote = []byte("1")
+	}
+	c.sendOrStop(frame{bOK, []byte(strconv.FormatUint(currentTerm, 10)), vote})
+}
+
+// Request handler: Follow <term> <leader>
+//
+// The server responds with OK, resets its queues and applies the stream of
+// the leader queue contents and changes (see handleReplicate), acknowledging
+// the index of the last applied change with the Ack frames.
+func (c *connection) handleFollow(f frame) {
+	r := c.server.raft
+	if r == nil {
+		c.sendOrStop(errorFrame(ErrServerNotClustered, "server is not a cluster member"))
+		return
+	}
+
+	if len(f) < 3 {
+		c.sendOrStop(errorFrame(ErrBadParams, "Follow requires term and leader"))
+		return
+	}
+
+	term, err := strconv.ParseUint(string(f[1]), 10, 64)
+	if err != nil {
+		c.sendOrStop(errorFrame(ErrBadParams, "term must be a non-negative integer"))
+		return
+	}
+
+	currentTerm, ok := r.follow(term, string(f[2]), c)
+	if !ok {
+		// The current term is also sent as a separate item for the leader to parse.
+		termStr := strconv.FormatUint(currentTerm, 10)
+		c.sendOrStop(append(errorFrame(ErrClusterStaleTerm, "current term is "+termStr), []byte(termStr)))
+		return
+	}
+
+	c.server.resetQueues()
+	c.sendOrStop(frame{bOK})
+
+	var chunks []byte
+	for {
+		var b *frameBuffer
+		select {
+		case b = <-c.requests:
+		default:
+			// Nothing else to apply right now, so report the progress.
+			ack := []byte(strconv.FormatUint(r.lastApplied(), 10))
+			err = c.send(frame{bAck, ack})
+			if err != nil {
+				c.stopOnWriteError(err)
+				return
+			}
+			select {
+			case <-c.done:
+				return
+			case b = <-c.requests:
+			}
+		}
+
+		f := b.f
+		if len(f) < 1 {
+			b.release()
+			c.stop()
+			return
+		}
+
+		var index uint64
+		switch {
+		case bytes.Equal(f[0], bHeartbeat):
+		case bytes.Equal(f[0], bSynced):
+			if len(f) >= 2 {
+				index, err = strconv.ParseUint(string(f[1]), 10, 64)
+			}
+		default:
+			err = c.server.applyReplicationFrame(f, &chunks, c.done)
+			if err == nil {
+				index, err = replicationIndex(f)
+			}
+		}
+		b.release()
+
+		if err != nil {
+			if c.running() {
+				c.server.logf("ERROR: cluster stream from %s failed: %s", c.conn.RemoteAddr(), err)
+				c.stop()
+			}
+			return
+		}
+
+		if !r.applied(term, index, c) {
+			c.stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package mqmq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func startCluster(n int) ([]*Server, []string) {
+	var listeners []net.Listener
+	var addrs []string
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			panic("Test cluster start failed: net.Listen: " + err.Error())
+		}
+		listeners = append(listeners, listener)
+		addrs = append(addrs, listener.Addr().String())
+	}
+
+	var servers []*Server
+	for i := 0; i < n; i++ {
+		s := NewServer()
+		s.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+		err := s.SetCluster(addrs[i], addrs)
+		if err != nil {
+			panic("Test cluster start failed: SetCluster: " + err.Error())
+		}
+		go s.Serve(listeners[i])
+		servers = append(servers, s)
+	}
+
+	return servers, addrs
+}
+
+// waitLeader waits until all the given servers agree on the same leader.
+func waitLeader(t *testing.T, servers []*Server) int {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := ""
+		agreed := true
+		for _, s := range servers {
+			info := s.raft.info()
+			if info.Leader == "" || (leader != "" && info.Leader != leader) {
+				agreed = false
+				break
+			}
+			leader = info.Leader
+		}
+		if agreed {
+			for i, s := range servers {
+				if s.raft.self == leader {
+					return i
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("cluster leader is not elected")
+	return -1
+}
+
+func TestCluster(t *testing.T) {
+	servers, addrs := startCluster(3)
+	for _, s := range servers {
+		defer s.Stop()
+	}
+
+	leader := waitLeader(t, servers)
+	follower := (leader + 1) % len(servers)
+
+	// Requests sent to a follower are proxied to the leader.
+	c := NewClient()
+	err := c.Connect(addrs[follower])
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	for i := 0; i < 10; i++ {
+		err = c.Put("test-queue", []byte(fmt.Sprintf("message-%d", i)))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+
+	out, err := c.Get("test-queue", 1*time.Minute)
+	if err != nil || string(out) != "message-0" {
+		t.Fatalf("failed c.Get: expected %#v, %#v, got %#v, %#v", "message-0", nil, string(out), err)
+	}
+
+	err = c.Put("other-queue", []byte("other-message"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+	queue, out, err := c.GetAny([]string{"test-queue", "other-queue"}, 1*time.Minute)
+	if err != nil || queue != "test-queue" || string(out) != "message-1" {
+		t.Fatalf("failed c.GetAny: expected %#v from %#v, got %#v from %#v, %v", "message-1", "test-queue", string(out), queue, err)
+	}
+
+	info, err := c.Info()
+	if err != nil {
+		t.Fatalf("failed c.Info: %s", err)
+	}
+	if info.Cluster == nil || info.Cluster.Leader != addrs[leader] || len(info.Cluster.Members) != 3 {
+		t.Fatalf("failed c.Info: unexpected cluster info %#v", info.Cluster)
+	}
+
+	// The committed changes are applied by all the members.
+	for _, s := range servers {
+		waitInSync(t, servers[leader], s)
+	}
+
+	// Stop the leader and wait for a new one.
+	servers[leader].Stop()
+	var rest []*Server
+	var restAddrs []string
+	for i, s := range servers {
+		if i != leader {
+			rest = append(rest, s)
+			restAddrs = append(restAddrs, addrs[i])
+		}
+	}
+	newLeader := waitLeader(t, rest)
+
+	c2 := NewClient()
+	err = c2.Connect(restAddrs[(newLeader+1)%len(rest)])
+	if err != nil {
+		t.Fatalf("failed c2.Connect: %s", err)
+	}
+	defer c2.Disconnect()
+
+	for i := 2; i < 10; i++ {
+		want := fmt.Sprintf("message-%d", i)
+		out, err := c2.Get("test-queue", 1*time.Minute)
+		if err != nil || string(out) != want {
+			t.Fatalf("failed c2.Get: expected %#v, %#v, got %#v, %#v", want, nil, string(out), err)
+		}
+	}
+
+	err = c2.Put("test-queue", []byte("message-10"))
+	if err != nil {
+		t.Fatalf("failed c2.Put: %s", err)
+	}
+	waitInSync(t, rest[newLeader], rest[(newLeader+1)%len(rest)])
+}
+
+func TestClusterSingleMember(t *testing.T) {
+	servers, addrs := startCluster(1)
+	defer servers[0].Stop()
+
+	waitLeader(t, servers)
+
+	c := NewClient()
+	err := c.Connect(addrs[0])
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	err = c.Put("test-queue", []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+
+	out, err := c.Get("test-queue", 1*time.Minute)
+	if err != nil || string(out) != "test-message" {
+		t.Fatalf("failed c.Get: expected %#v, %#v, got %#v, %#v", "test-message", nil, string(out), err)
+	}
+}
+
+func TestClusterCommitTerm(t *testing.T) {
+	s := NewServer()
+	s.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+
+	// The peers are unreachable, so only the acknowledgements below count.
+	r := &raftNode{
+		server:      s,
+		self:        "127.0.0.1:1",
+		members:     []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"},
+		changed:     make(chan struct{}),
+		stop:        make(chan struct{}),
+		state:       raftCandidate,
+		term:        2,
+		lastTerm:    1,
+		lastIndex:   5,
+		commitIndex: 3,
+	}
+	defer r.shutdown()
+
+	r.mu.Lock()
+	r.becomeLeader(2)
+	r.mu.Unlock()
+
+	info := r.info()
+	if info.LastIndex != 6 || info.CommitIndex != 3 {
+		t.Fatalf("expected last index 6 and commit index 3 after election, got %d and %d", info.LastIndex, info.CommitIndex)
+	}
+
+	// The majority applied the changes of the previous term only.
+	r.ack("127.0.0.1:2", 2, 5)
+	if info := r.info(); info.CommitIndex != 3 {
+		t.Fatalf("expected commit index 3 before a change of the term is applied, got %d", info.CommitIndex)
+	}
+
+	r.ack("127.0.0.1:2", 2, 6)
+	if info := r.info(); info.CommitIndex != 6 {
+		t.Fatalf("expected commit index 6 after a change of the term is applied, got %d", info.CommitIndex)
+	}
+}
+
+func TestClusterVoteRestart(t *testing.T) {
+	newNode := func() *raftNode {
+		return &raftNode{
+			self:    "127.0.0.1:3",
+			members: []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"},
+			changed: make(chan struct{}),
+			stop:    make(chan struct{}),
+		}
+	}
+
+	r := newNode()
+	if _, granted := r.vote(5, "127.0.0.1:1", 0, 0); !granted {
+		t.Fatalf("expected the vote to be granted")
+	}
+	if _, granted := r.vote(5, "127.0.0.1:2", 0, 0); granted {
+		t.Fatalf("expected the second vote in the same term to be refused")
+	}
+
+	// The votes are not persisted, so the restarted member votes again
+	// in the same term (see the clustered mode restrictions).
+	r = newNode()
+	if _, granted := r.vote(5, "127.0.0.1:2", 0, 0); !granted {
+		t.Fatalf("expected the restarted member to grant the vote")
+	}
+}
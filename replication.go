@@ -0,0 +1,469 @@
+package mqmq
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxReplicationBacklog is the maximum number of operations buffered for a replica.
+// A replica that falls further behind is disconnected and has to resynchronize.
+const maxReplicationBacklog = 1 << 20
+
+// replicationRetryDelay is the delay between replica reconnection attempts.
+const replicationRetryDelay = 1 * time.Second
+
+var (
+	bReplicate = []byte("Replicate")
+	bPromote   = []byte("Promote")
+	bEnqueue   = []byte("Enqueue")
+	bRequeue   = []byte("Requeue")
+	bDequeue   = []byte("Dequeue")
+	bSynced    = []byte("Synced")
+	bHeartbeat = []byte("Heartbeat")
+)
+
+var errReplicationBacklog = errors.New("mqmq: replication backlog exceeded")
+
+// ServerRole represents the server role in the replication.
+type ServerRole int
+
+// Server roles.
+const (
+	ServerRolePrimary ServerRole = iota
+	ServerRoleReplica
+)
+
+var serverRoleName = map[ServerRole]string{
+	ServerRolePrimary: "primary",
+	ServerRoleReplica: "replica",
+}
+
+func (r ServerRole) String() string {
+	return serverRoleName[r]
+}
+
+// replicationOp is a queue operation streamed to replicas.
+// Operations are indexed in the clustered mode only.
+type replicationOp struct {
+	queue string
+	op    queueOp
+	index uint64
+}
+
+// replicationHub distributes queue operations to the connected replicas.
+type replicationHub struct {
+	mu    sync.Mutex
+	feeds map[*replicationFeed]struct{}
+}
+
+// replicationFeed is a buffer of queue operations for a single replica.
+type replicationFeed struct {
+	mu       sync.Mutex
+	ops      []replicationOp
+	overflow bool
+	notify   chan struct{}
+}
+
+func (h *replicationHub) subscribe() *replicationFeed {
+	f := &replicationFeed{notify: make(chan struct{}, 1)}
+	h.mu.Lock()
+	if h.feeds == nil {
+		h.feeds = make(map[*replicationFeed]struct{})
+	}
+	h.feeds[f] = struct{}{}
+	h.mu.Unlock()
+	return f
+}
+
+func (h *replicationHub) unsubscribe(f *replicationFeed) {
+	h.mu.Lock()
+	delete(h.feeds, f)
+	h.mu.Unlock()
+}
+
+func (h *replicationHub) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.feeds)
+}
+
+func (h *replicationHub) publish(queue string, op queueOp, index uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for f := range h.feeds {
+		f.mu.Lock()
+		if len(f.ops) >= maxReplicationBacklog {
+			f.overflow = true
+		} else if !f.overflow {
+			f.ops = append(f.ops, replicationOp{queue: queue, op: op, index: index})
+		}
+		f.mu.Unlock()
+
+		select {
+		case f.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take returns the buffered operations and clears the buffer.
+func (f *replicationFeed) take() ([]replicationOp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.overflow {
+		return nil, errReplicationBacklog
+	}
+	ops := f.ops
+	f.ops = nil
+	return ops, nil
+}
+
+// Request handler: Replicate
+//
+// The server responds with OK followed by the contents of all the queues
+// sent as Enqueue frames, then the Synced frame, and then the stream
+// of Enqueue, Requeue and Dequeue frames for every queue change.
+func (c *connection) handleReplicate(f frame) {
+	if c.server.Role() != ServerRolePrimary {
+		c.sendOrStop(errorFrame(ErrServerReplica, "server is a standby replica"))
+		return
+	}
+
+	if r := c.server.raft; r != nil {
+		if _, _, leader := r.leaderTerm(); !leader {
+			c.sendOrStop(errorFrame(ErrClusterNotLeader, "server is not cluster leader"))
+			return
+		}
+	}
+
+	feed, index := c.server.subscribeReplication()
+	defer c.server.replication.unsubscribe(feed)
+
+	err := c.send(frame{bOK})
+	if err != nil {
+		c.stopOnWriteError(err)
+		return
+	}
+
+	err = c.server.streamReplication(c.writer, feed, index, c.done, 0)
+	if err != nil && c.running() {
+		c.server.logf("ERROR: replication to %s failed: %s", c.conn.RemoteAddr(), err)
+		c.stop()
+	}
+}
+
+// subscribeReplication subscribes to the queue changes. The returned index is
+// the index of the last change that is not sent to the feed (zero if the
+// changes are not indexed).
+func (s *Server) subscribeReplication() (*replicationFeed, uint64) {
+	if s.raft != nil {
+		return s.raft.subscribe()
+	}
+	return s.replication.subscribe(), 0
+}
+
+// streamReplication writes the contents of all the queues followed by the queue
+// changes from the feed until done is closed or an error occurs. If heartbeat
+// is positive, the Heartbeat frame is written at least that often.
+func (s *Server) streamReplication(w *bufio.Writer, feed *replicationFeed, index uint64, done <-chan struct{}, heartbeat time.Duration) error {
+	// Operations applied to a queue before its snapshot is taken are
+	// already included in the snapshot and must be skipped.
+	synced := make(map[string]uint64)
+	for name, q := range s.queueList() {
+		snap, err := q.snapshot()
+		if err != nil {
+			return err
+		}
+		synced[name] = snap.seq
+		for _, stored := range snap.messages {
+			message, err := s.loadMessage(stored)
+			if err != nil {
+				return err
+			}
+			err = writeChunked(w, frame{bEnqueue, []byte(name), message})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	f := frame{bSynced}
+	if index > 0 {
+		f = append(f, []byte(strconv.FormatUint(index, 10)))
+	}
+	err := writeFrame(w, f, maxFrameLen)
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-tick:
+			err = writeFrame(w, frame{bHeartbeat}, maxFrameLen)
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		case <-feed.notify:
+		}
+
+		ops, err := feed.take()
+		if err != nil {
+			return err
+		}
+
+		for _, rop := range ops {
+			if rop.op.seq <= synced[rop.queue] {
+				continue
+			}
+
+			// Replicas may store the messages differently,
+			// so the message bodies are sent decoded.
+			var f frame
+			switch rop.op.kind {
+			case queueOpEnqueue, queueOpRequeue:
+				message, err := s.loadMessage(rop.op.message)
+				if err != nil {
+					return err
+				}
+				f = frame{bEnqueue, []byte(rop.queue), message}
+				if rop.op.kind == queueOpRequeue {
+					f[0] = bRequeue
+				}
+			case queueOpDequeue:
+				f = frame{bDequeue, []byte(rop.queue)}
+			}
+			if rop.index > 0 {
+				f = append(f, []byte(strconv.FormatUint(rop.index, 10)))
+			}
+
+			if rop.op.kind == queueOpDequeue {
+				err = writeFrame(w, f, maxFrameLen)
+			} else {
+				err = writeChunked(w, f)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Request handler: Promote
+func (c *connection) handlePromote(f frame) {
+	err := c.server.Promote()
+	if err != nil {
+		c.sendOrStop(errorFrame(ErrServerNotReplica, "server is not a standby replica"))
+		return
+	}
+	c.sendOrStop(frame{bOK})
+}
+
+// SetReplicaOf makes the server a standby replica of the primary server at TCP address addr.
+// The replica receives the contents of all the primary queues and keeps them up to date.
+// It rejects Put and Get requests until it is promoted to primary.
+func (s *Server) SetReplicaOf(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != ServerStateNew || s.raft != nil {
+		return errServerState
+	}
+	s.role = ServerRoleReplica
+	s.primaryAddr = addr
+	s.replicaStop = make(chan struct{})
+	return nil
+}
+
+// Promote stops the replication and makes the replica server a primary one.
+func (s *Server) Promote() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == ServerStateStopped {
+		return errServerState
+	}
+	if s.role != ServerRoleReplica {
+		return errors.New("mqmq: server is not a replica")
+	}
+	s.role = ServerRolePrimary
+
+	if s.replicaConn != nil {
+		s.replicaConn.Close()
+	}
+	close(s.replicaStop)
+
+	return nil
+}
+
+// Role returns the current server role.
+func (s *Server) Role() ServerRole {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.role
+}
+
+// replicate keeps the replica in sync with the primary until the server is promoted or stopped.
+func (s *Server) replicate() {
+	for {
+		err := s.replicateOnce()
+
+		s.mu.RLock()
+		replicating := s.state == ServerStateActive && s.role == ServerRoleReplica
+		s.mu.RUnlock()
+		if !replicating {
+			return
+		}
+
+		s.logf("ERROR: replication from %s failed: %s retrying in %v", s.primaryAddr, err, replicationRetryDelay)
+		select {
+		case <-s.replicaStop:
+			return
+		case <-time.After(replicationRetryDelay):
+		}
+	}
+}
+
+func (s *Server) replicateOnce() error {
+	conn, err := net.Dial("tcp", s.primaryAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	if s.state != ServerStateActive || s.role != ServerRoleReplica {
+		s.mu.Unlock()
+		return errServerState
+	}
+	s.replicaConn = conn
+	s.mu.Unlock()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	err = writeFrame(writer, frame{bReplicate}, maxFrameLen)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := readFrame(reader, maxFrameLen)
+	if err != nil {
+		return err
+	}
+	if len(f) < 1 || !bytes.Equal(f[0], bOK) {
+		return ErrBadResponse
+	}
+
+	// The primary sends the full contents first, so start from scratch.
+	s.resetQueues()
+
+	var chunks []byte
+	for {
+		f, err := readFrame(reader, maxFrameLen)
+		if err != nil {
+			return err
+		}
+
+		err = s.applyReplicationFrame(f, &chunks, s.replicaStop)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// applyReplicationFrame applies the queue change received from the primary server.
+// The leading parts of large messages received in the Chunk frames are collected
+// in chunks. It gives up waiting for the queue when done is closed.
+func (s *Server) applyReplicationFrame(f frame, chunks *[]byte, done <-chan struct{}) error {
+	if len(f) < 1 {
+		return ErrBadResponse
+	}
+
+	if bytes.Equal(f[0], bSynced) {
+		s.logf("INFO: replica is in sync with %s", s.primaryAddr)
+		return nil
+	}
+
+	if len(f) < 2 {
+		return ErrBadResponse
+	}
+
+	if bytes.Equal(f[0], bChunk) {
+		*chunks = append(*chunks, f[1]...)
+		return nil
+	}
+
+	q, err := s.getQueue(string(f[1]), true)
+	if err != nil {
+		return err
+	}
+
+	var put func(message []byte) error
+	switch {
+	case bytes.Equal(f[0], bEnqueue) && len(f) >= 3:
+		put = q.enqueue
+	case bytes.Equal(f[0], bRequeue) && len(f) >= 3:
+		put = q.requeue
+	case bytes.Equal(f[0], bDequeue):
+		// Nobody else takes messages from the replica queues,
+		// so the first message is available right away unless
+		// the queue is out of sync. The consumers left waiting
+		// by the former leader put their messages back.
+		w := q.wait()
+		timer := time.NewTimer(replicationRetryDelay)
+		defer timer.Stop()
+		select {
+		case <-w.message():
+		case <-done:
+			q.cancel(w)
+			return errServerState
+		case <-timer.C:
+			q.cancel(w)
+			return errors.New("mqmq: replica queue is out of sync: " + string(f[1]))
+		}
+		return nil
+	default:
+		return ErrBadResponse
+	}
+
+	var message []byte
+	if len(*chunks) > 0 {
+		message = s.storeOwnedMessage(append(*chunks, f[2]...))
+		*chunks = nil
+	} else {
+		message = s.storeMessage(f[2])
+	}
+
+	return put(message)
+}
@@ -0,0 +1,168 @@
+package mqmq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func startReplica(primaryAddr string) (*Server, string) {
+	s := NewServer()
+	s.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+
+	err := s.SetReplicaOf(primaryAddr)
+	if err != nil {
+		panic("Test replica start failed: SetReplicaOf: " + err.Error())
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("Test replica start failed: net.Listen: " + err.Error())
+	}
+	go s.Serve(listener)
+
+	for s.State() == ServerStateNew {
+		time.Sleep(time.Millisecond)
+	}
+
+	return s, listener.Addr().String()
+}
+
+func queueContents(s *Server) map[string][][]byte {
+	contents := make(map[string][][]byte)
+	for name, q := range s.queueList() {
+		snap, _ := q.snapshot()
+		contents[name] = snap.messages
+	}
+	return contents
+}
+
+func waitInSync(t *testing.T, primary, replica *Server) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		want := queueContents(primary)
+		got := queueContents(replica)
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replica is not in sync: expected %q, got %q", want, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primary, primaryAddr := startServer()
+	defer primary.Stop()
+
+	c := NewClient()
+	err := c.Connect(primaryAddr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	// Messages that exist before the replica is connected.
+	for i := 0; i < 10; i++ {
+		err = c.Put(fmt.Sprintf("test-queue-%d", i%3), []byte(fmt.Sprintf("message-%d", i)))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+
+	replica, replicaAddr := startReplica(primaryAddr)
+	defer replica.Stop()
+
+	waitInSync(t, primary, replica)
+
+	// Messages that are put and taken while the replica is connected.
+	for i := 10; i < 20; i++ {
+		err = c.Put(fmt.Sprintf("test-queue-%d", i%4), []byte(fmt.Sprintf("message-%d", i)))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		_, err = c.Get("test-queue-0", 1*time.Minute)
+		if err != nil {
+			t.Fatalf("failed c.Get: %s", err)
+		}
+	}
+
+	waitInSync(t, primary, replica)
+
+	info := primary.Info()
+	if info.Role != "primary" || info.NumReplicas != 1 {
+		t.Fatalf("failed primary.Info: unexpected info %#v", info)
+	}
+
+	rc := NewClient()
+	err = rc.Connect(replicaAddr)
+	if err != nil {
+		t.Fatalf("failed rc.Connect: %s", err)
+	}
+	defer rc.Disconnect()
+
+	err = rc.Put("test-queue-0", []byte("message"))
+	if err == nil {
+		t.Fatalf("failed rc.Put: expected error on replica")
+	}
+
+	expectContents := queueContents(primary)
+
+	// Promote the replica and check it has the same contents.
+	primary.Stop()
+	err = rc.Promote()
+	if err != nil {
+		t.Fatalf("failed rc.Promote: %s", err)
+	}
+	if replica.Role() != ServerRolePrimary {
+		t.Fatalf("failed rc.Promote: expected role %v, got %v", ServerRolePrimary, replica.Role())
+	}
+
+	for qname, messages := range expectContents {
+		for _, m := range messages {
+			out, err := rc.Get(qname, 1*time.Minute)
+			if err != nil || string(out) != string(m) {
+				t.Fatalf("failed rc.Get: expected %#v, %#v, got %#v, %#v", string(m), nil, string(out), err)
+			}
+		}
+	}
+
+	err = rc.Put("test-queue-0", []byte("message"))
+	if err != nil {
+		t.Fatalf("failed rc.Put: %s", err)
+	}
+
+	err = rc.Promote()
+	if err == nil {
+		t.Fatalf("failed rc.Promote: expected error on primary")
+	}
+}
+
+func TestReplicationRequeue(t *testing.T) {
+	primary, primaryAddr := startServer()
+	defer primary.Stop()
+
+	replica, _ := startReplica(primaryAddr)
+	defer replica.Stop()
+
+	q, err := primary.getQueue("test-queue", false)
+	if err != nil {
+		t.Fatalf("failed getQueue: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		q.enqueue([]byte(fmt.Sprintf("message-%d", i)))
+	}
+	m, _ := q.dequeue()
+	q.dequeue()
+	q.requeue(m)
+	q.enqueue([]byte("message-5"))
+
+	waitInSync(t, primary, replica)
+}
@@ -0,0 +1,258 @@
+package mqmq
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The request/reply messages are the frames encoded as the message bodies:
+// the request is Request <reply queue> <correlation ID> <body> and the reply
+// is Reply <correlation ID> <body>.
+
+var (
+	bReplyQueue = []byte("ReplyQueue")
+	bRequest    = []byte("Request")
+	bReply      = []byte("Reply")
+)
+
+// replyQueuePrefix is the prefix of the temporary reply queue names.
+const replyQueuePrefix = "_reply."
+
+// isReplyQueue reports whether the queue is a temporary reply queue.
+func isReplyQueue(qname string) bool {
+	return strings.HasPrefix(qname, replyQueuePrefix)
+}
+
+// replyQueue is the temporary queue that only its owner connection takes
+// the messages from.
+type replyQueue struct {
+	q     queue
+	owner *connection
+}
+
+// Request handler: ReplyQueue
+//
+// The server creates the temporary reply queue of the connection, unless it
+// already exists, and responds with its name: OK <queue name>
+// Any client can put the messages to the queue, but only the owner connection
+// takes them. The queue is deleted with its messages when the connection is
+// closed. It is not replicated, written to the write-ahead log or shown
+// in the server information. The cluster followers don't proxy the request,
+// since the queue belongs to the connection, and respond with the
+// CLUSTER_NOT_LEADER error.
+func (c *connection) handleReplyQueue(f frame) {
+	_, _, ok := c.acceptRequest(f, false)
+	if !ok {
+		return
+	}
+
+	name, err := c.server.createReplyQueue(c)
+	if err != nil {
+		c.sendOrStop(errorFrame(ErrServerStopping, "server is stopping"))
+		return
+	}
+	c.sendOrStop(frame{bOK, []byte(name)})
+}
+
+// createReplyQueue returns the reply queue of the connection, creating it if necessary.
+func (s *Server) createReplyQueue(c *connection) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == ServerStateStopped || s.queues == nil {
+		return "", errServerState
+	}
+
+	if c.replyQueue != "" {
+		return c.replyQueue, nil
+	}
+
+	var id [8]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return "", err
+	}
+	name := replyQueuePrefix + hex.EncodeToString(id[:])
+
+	if s.replyQueues == nil {
+		s.replyQueues = make(map[string]*replyQueue)
+	}
+	s.replyQueues[name] = &replyQueue{q: newQueue(s.queueType, nil), owner: c}
+	c.replyQueue = name
+	return name, nil
+}
+
+// deleteReplyQueue deletes the reply queue of the closed connection.
+// The s.mu must be held.
+func (s *Server) deleteReplyQueue(c *connection) {
+	if c.replyQueue == "" {
+		return
+	}
+	if rq, ok := s.replyQueues[c.replyQueue]; ok && rq.owner == c {
+		delete(s.replyQueues, c.replyQueue)
+		rq.q.stop()
+	}
+}
+
+// lookupReplyQueue returns the existing reply queue or the error response frame.
+// Only the owner connection can consume the messages.
+func (c *connection) lookupReplyQueue(qname string, consume bool) (queue, frame) {
+	c.server.mu.RLock()
+	rq, ok := c.server.replyQueues[qname]
+	c.server.mu.RUnlock()
+
+	if !ok {
+		return nil, errorFrame(ErrReplyQueue, "reply queue "+strconv.Quote(qname)+" doesn't exist")
+	}
+	if consume && rq.owner != c {
+		return nil, errorFrame(ErrReplyQueue, "reply queue "+strconv.Quote(qname)+" belongs to another connection")
+	}
+	return rq.q, nil
+}
+
+var errBadRequestMessage = errors.New("mqmq: message is not a request")
+
+// encodeEnvelope encodes the request or reply frame as the message body.
+func encodeEnvelope(f frame) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeFrame(&buf, f, maxFrameLen)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeEnvelope decodes the message body encoded by encodeEnvelope. It fails
+// unless the frame of the given kind has n items.
+func decodeEnvelope(message []byte, kind []byte, n int) (frame, error) {
+	f, err := readFrame(bytes.NewReader(message), uint32(len(message)))
+	if err != nil || len(f) != n || !bytes.Equal(f[0], kind) {
+		return nil, errBadRequestMessage
+	}
+	return f, nil
+}
+
+// RequestBody returns the body of the request message sent by Client.Request.
+func RequestBody(request []byte) ([]byte, error) {
+	f, err := decodeEnvelope(request, bRequest, 4)
+	if err != nil {
+		return nil, err
+	}
+	return f[3], nil
+}
+
+// Request sends the request message to the given queue and waits for the reply
+// sent by Client.Reply for the given timeout. The ErrTimeout error is returned
+// if no reply is received in time; the replies received later are discarded.
+//
+// The replies are received from the temporary reply queue that the server
+// creates for the connection on the first request and deletes when the
+// connection is closed. The requests on the same client are sent one at a time.
+// The ErrClusterNotLeader error is returned if the server is a cluster follower,
+// and the ErrFrameLen error if the message doesn't fit into the request frame.
+func (c *Client) Request(queue string, message []byte, timeout time.Duration) ([]byte, error) {
+	return c.RequestContext(context.Background(), queue, message, timeout)
+}
+
+// RequestContext sends the request message to the given queue and waits for the reply.
+// It works like Request but the wait can be abandoned early by canceling the context.
+func (c *Client) RequestContext(ctx context.Context, queue string, message []byte, timeout time.Duration) ([]byte, error) {
+	c.requestMu.Lock()
+	defer c.requestMu.Unlock()
+
+	replyTo, err := c.replyQueueName(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.requestID++
+	id := []byte(strconv.FormatUint(c.requestID, 10))
+	c.mu.Unlock()
+
+	request, err := encodeEnvelope(frame{bRequest, []byte(replyTo), id, message})
+	if err != nil {
+		return nil, err
+	}
+	err = c.PutContext(ctx, queue, request)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, ErrTimeout
+		}
+		m, err := c.GetContext(ctx, replyTo, remaining)
+		if err != nil {
+			return nil, err
+		}
+
+		// The replies to the earlier requests that timed out are discarded.
+		f, err := decodeEnvelope(m, bReply, 3)
+		if err == nil && bytes.Equal(f[1], id) {
+			return f[2], nil
+		}
+	}
+}
+
+// replyQueueName returns the name of the reply queue of the connection,
+// requesting the server to create it if necessary.
+func (c *Client) replyQueueName(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.replyQueue != "" {
+		return c.replyQueue, nil
+	}
+
+	response, err := c.cmdLocked(ctx, frame{bReplyQueue})
+	if err != nil {
+		return "", err
+	}
+
+	if len(response) < 1 {
+		return "", ErrBadResponse
+	}
+	if bytes.Equal(response[0], bError) {
+		return "", responseError(response)
+	}
+	if !bytes.Equal(response[0], bOK) || len(response) < 2 {
+		return "", ErrBadResponse
+	}
+
+	c.replyQueue = string(response[1])
+	return c.replyQueue, nil
+}
+
+// Reply sends the reply body to the client waiting for the reply to the request
+// message received from a queue (see Client.Request). It fails if the message
+// is not a request. The ErrReplyQueue error is returned if the requesting client
+// is disconnected, and the ErrFrameLen error if the body doesn't fit into
+// the reply frame.
+func (c *Client) Reply(request []byte, body []byte) error {
+	return c.ReplyContext(context.Background(), request, body)
+}
+
+// ReplyContext sends the reply body to the client waiting for the reply to the request.
+// If the context is canceled or its deadline is exceeded before the server
+// responds, the connection is closed and the context error is returned.
+func (c *Client) ReplyContext(ctx context.Context, request []byte, body []byte) error {
+	f, err := decodeEnvelope(request, bRequest, 4)
+	if err != nil {
+		return err
+	}
+	reply, err := encodeEnvelope(frame{bReply, f[2], body})
+	if err != nil {
+		return err
+	}
+	return c.PutContext(ctx, string(f[1]), reply)
+}
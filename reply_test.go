@@ -0,0 +1,212 @@
+package mqmq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// serveRequests replies to the requests from the queue with the upper-cased
+// request bodies until it is stopped.
+func serveRequests(addr, queue string) (stop func()) {
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		panic("Test worker start failed: Connect: " + err.Error())
+	}
+	chStop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer c.Disconnect()
+		for {
+			select {
+			case <-chStop:
+				return
+			default:
+			}
+			request, err := c.Get(queue, 10*time.Millisecond)
+			if err != nil {
+				continue
+			}
+			body, err := RequestBody(request)
+			if err != nil {
+				continue
+			}
+			c.Reply(request, bytes.ToUpper(body))
+		}
+	}()
+	return func() {
+		close(chStop)
+		<-stopped
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	// The request that no one serves times out, and its late reply is discarded.
+	_, err = c.Request("test-rpc", []byte("stale"), 50*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("failed c.Request: expected %v, got %v", ErrTimeout, err)
+	}
+
+	stop := serveRequests(addr, "test-rpc")
+	defer stop()
+
+	for _, body := range []string{"hello", "", "world"} {
+		reply, err := c.Request("test-rpc", []byte(body), 5*time.Second)
+		if err != nil {
+			t.Fatalf("failed c.Request: %s", err)
+		}
+		if want := bytes.ToUpper([]byte(body)); !bytes.Equal(reply, want) {
+			t.Fatalf("failed c.Request: expected %q, got %q", want, reply)
+		}
+	}
+
+	_, err = RequestBody([]byte("test-message"))
+	if err == nil {
+		t.Fatalf("failed RequestBody: expected error for plain message")
+	}
+	err = c.Reply([]byte("test-message"), []byte("reply"))
+	if err == nil {
+		t.Fatalf("failed c.Reply: expected error for plain message")
+	}
+
+	// The messages that don't fit into the request or reply frame are not sent.
+	large := make([]byte, maxFrameLen)
+	_, err = c.Request("test-rpc", large, 5*time.Second)
+	if err != ErrFrameLen {
+		t.Fatalf("failed c.Request: expected %v, got %v", ErrFrameLen, err)
+	}
+	request, err := encodeEnvelope(frame{bRequest, []byte("test-reply"), []byte("1"), nil})
+	if err != nil {
+		t.Fatalf("failed encodeEnvelope: %s", err)
+	}
+	err = c.Reply(request, large)
+	if err != ErrFrameLen {
+		t.Fatalf("failed c.Reply: expected %v, got %v", ErrFrameLen, err)
+	}
+
+	// The reply queues are not shown in the server information.
+	info := s.Info()
+	if info.NumQueues != 1 {
+		t.Fatalf("failed s.Info: expected 1 queue, got %+v", info.Queues)
+	}
+}
+
+func TestReplyQueue(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	owner := NewClient()
+	err := owner.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed owner.Connect: %s", err)
+	}
+	replyTo, err := owner.replyQueueName(context.Background())
+	if err != nil {
+		t.Fatalf("failed owner.replyQueueName: %s", err)
+	}
+	if !isReplyQueue(replyTo) || !ValidQueueName(replyTo) {
+		t.Fatalf("failed owner.replyQueueName: bad queue name %q", replyTo)
+	}
+
+	c := NewClient()
+	err = c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	// Only the owner takes the messages from the reply queue.
+	err = c.Put(replyTo, []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+	_, err = c.Get(replyTo, time.Millisecond)
+	if !errors.Is(err, ErrReplyQueue) {
+		t.Fatalf("failed c.Get: expected %v, got %v", ErrReplyQueue, err)
+	}
+	_, err = c.Move(replyTo, "test-queue", 1)
+	if !errors.Is(err, ErrReplyQueue) {
+		t.Fatalf("failed c.Move: expected %v, got %v", ErrReplyQueue, err)
+	}
+	m, err := owner.Get(replyTo, time.Second)
+	if err != nil || string(m) != "test-message" {
+		t.Fatalf("failed owner.Get: expected %q, got %q, %v", "test-message", m, err)
+	}
+
+	// The reply queue is deleted when the owner disconnects.
+	owner.Disconnect()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.RLock()
+		n := len(s.replyQueues)
+		s.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed owner.Disconnect: reply queue is not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = c.Put(replyTo, []byte("test-message"))
+	if !errors.Is(err, ErrReplyQueue) {
+		t.Fatalf("failed c.Put: expected %v, got %v", ErrReplyQueue, err)
+	}
+	if queues := queueContents(s); len(queues) != 0 {
+		t.Fatalf("failed c.Put: unexpected queues %q", queues)
+	}
+}
+
+func TestClusterRequestReply(t *testing.T) {
+	servers, addrs := startCluster(3)
+	for _, s := range servers {
+		defer s.Stop()
+	}
+
+	leader := waitLeader(t, servers)
+	follower := (leader + 1) % len(servers)
+
+	// The worker is served by the follower that proxies its requests.
+	stop := serveRequests(addrs[follower], "test-rpc")
+	defer stop()
+
+	c := NewClient()
+	err := c.Connect(addrs[leader])
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	reply, err := c.Request("test-rpc", []byte("hello"), 5*time.Second)
+	if err != nil || string(reply) != "HELLO" {
+		t.Fatalf("failed c.Request: expected %q, got %q, %v", "HELLO", reply, err)
+	}
+
+	// The reply queue belongs to the connection, so the followers don't proxy it.
+	fc := NewClient()
+	err = fc.Connect(addrs[follower])
+	if err != nil {
+		t.Fatalf("failed fc.Connect: %s", err)
+	}
+	defer fc.Disconnect()
+
+	_, err = fc.Request("test-rpc", []byte("hello"), 5*time.Second)
+	if !errors.Is(err, ErrClusterNotLeader) {
+		t.Fatalf("failed fc.Request: expected %v, got %v", ErrClusterNotLeader, err)
+	}
+}
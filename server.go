@@ -3,6 +3,7 @@ package mqmq
 
 import (
 	"errors"
+	"io"
 	"log"
 	"net"
 	"sync"
@@ -17,9 +18,30 @@ type Server struct {
 	logger      *log.Logger
 	mu          sync.RWMutex
 	state       ServerState
+	role        ServerRole
 	listener    net.Listener
 	queues      map[string]queue
 	connections map[*connection]struct{}
+	// Number of connections from each IP address.
+	connectionsPerIP map[string]int
+	replication      replicationHub
+	primaryAddr      string
+	replicaConn      net.Conn
+	replicaStop      chan struct{}
+	raft             *raftNode
+
+	compressThreshold int
+	storageCodec      Codec
+	queueType         QueueType
+	queueFactory      QueueFactory
+	walOptions        WALOptions
+	wal               *wal
+	limits            ServerLimits
+	namespaceLimits   []namespaceLimits
+	dedupWindows      []dedupWindow
+	dedup             dedupTable
+	replyQueues       map[string]*replyQueue
+	moveMu            sync.Mutex // Serializes the Move requests.
 }
 
 // ServerState represents the current server state.
@@ -46,7 +68,11 @@ var errServerState = errors.New("mqmq: insufficient server state")
 
 // NewServer creates a new mqmq server.
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		compressThreshold: DefaultCompressionThreshold,
+		limits:            DefaultServerLimits(),
+		queueType:         QueueTypeChannel,
+	}
 }
 
 // SetLogger sets the server logger.
@@ -60,6 +86,75 @@ func (s *Server) SetLogger(logger *log.Logger) error {
 	return nil
 }
 
+// SetCompressionThreshold sets the minimum size of the message body that is
+// compressed when sent to the clients that negotiated the compression or stored
+// in the queues (see SetStorageCodec). The default is DefaultCompressionThreshold.
+func (s *Server) SetCompressionThreshold(threshold int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != ServerStateNew {
+		return errServerState
+	}
+	s.compressThreshold = threshold
+	return nil
+}
+
+// SetStorageCodec makes the server keep the large message bodies compressed by
+// the registered codec in the queues to reduce the server memory usage.
+// Compressed messages are passed to the clients that negotiated the same codec
+// without recompression.
+func (s *Server) SetStorageCodec(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != ServerStateNew {
+		return errServerState
+	}
+	codec := codecByName(name)
+	if codec == nil {
+		return errors.New("mqmq: unknown codec: " + name)
+	}
+	s.storageCodec = codec
+	return nil
+}
+
+// SetQueueType sets the implementation of the server queues.
+// The default is QueueTypeChannel.
+func (s *Server) SetQueueType(t QueueType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != ServerStateNew {
+		return errServerState
+	}
+	if t != QueueTypeChannel && t != QueueTypeMutex {
+		return errors.New("mqmq: unknown queue type: " + string(t))
+	}
+	s.queueType = t
+	return nil
+}
+
+// storeMessage converts the message body to the queue storage format.
+// The result never shares memory with the message.
+func (s *Server) storeMessage(message []byte) []byte {
+	if s.storageCodec == nil {
+		return append([]byte(nil), message...)
+	}
+	return encodeMessage(s.storageCodec, s.compressThreshold, message)
+}
+
+// storeOwnedMessage is like storeMessage but the result may share memory with
+// the message, so it's used for the messages not referenced by anything else.
+func (s *Server) storeOwnedMessage(message []byte) []byte {
+	if s.storageCodec == nil {
+		return message
+	}
+	return encodeMessage(s.storageCodec, s.compressThreshold, message)
+}
+
+// loadMessage converts the stored message to the message body.
+func (s *Server) loadMessage(stored []byte) ([]byte, error) {
+	return decodeMessage(s.storageCodec, stored)
+}
+
 // ListenAndServe listens on the TCP network address addr and handles client requests.
 // If addr is blank, DefaultAddr is used.
 func (s *Server) ListenAndServe(addr string) error {
@@ -84,13 +179,32 @@ func (s *Server) Serve(l net.Listener) error {
 		return errServerState
 	}
 	s.state = ServerStateActive
+	s.listener = l
+	if s.queues == nil {
+		// The queues may be already restored (see Restore).
+		s.queues = make(map[string]queue)
+	}
+	s.connections = make(map[*connection]struct{})
+	s.connectionsPerIP = make(map[string]int)
+	replica := s.role == ServerRoleReplica
 	s.mu.Unlock()
 
 	defer s.Stop()
 
-	s.listener = l
-	s.queues = make(map[string]queue)
-	s.connections = make(map[*connection]struct{})
+	if s.walOptions.Path != "" {
+		err := s.openWAL()
+		if err != nil {
+			s.logf("ERROR: failed to open write-ahead log: %s", err)
+			return err
+		}
+	}
+
+	if replica {
+		go s.replicate()
+	}
+	if s.raft != nil {
+		go s.raft.run()
+	}
 
 	for {
 		conn, err := s.listener.Accept()
@@ -114,20 +228,29 @@ func (s *Server) Serve(l net.Listener) error {
 		}
 
 		c := newConnection(s, conn)
-		s.connections[c] = struct{}{}
+		errf := s.acceptConnection(c)
 		s.mu.Unlock()
 
+		if errf != nil {
+			go s.rejectConnection(conn, errf)
+			continue
+		}
+
 		go func() {
 			c.run()
-			s.mu.Lock()
-			delete(s.connections, c)
-			s.mu.Unlock()
+			s.removeConnection(c)
 		}()
 	}
 }
 
 // Stop stops the server.
 func (s *Server) Stop() error {
+	return s.stop(nil)
+}
+
+// stop stops the server. Unless w is nil, the snapshot of the queues is written
+// to w after the connections are closed and before the queues are dropped.
+func (s *Server) stop(w io.Writer) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -140,6 +263,17 @@ func (s *Server) Stop() error {
 		s.listener.Close()
 	}
 
+	if s.raft != nil {
+		s.raft.shutdown()
+	}
+
+	if s.role == ServerRoleReplica {
+		close(s.replicaStop)
+		if s.replicaConn != nil {
+			s.replicaConn.Close()
+		}
+	}
+
 	if s.connections != nil {
 		for c := range s.connections {
 			delete(s.connections, c)
@@ -147,6 +281,11 @@ func (s *Server) Stop() error {
 		}
 	}
 
+	var err error
+	if w != nil {
+		err = s.writeSnapshot(w, s.queues, "*")
+	}
+
 	if s.queues != nil {
 		for name, q := range s.queues {
 			delete(s.queues, name)
@@ -154,7 +293,19 @@ func (s *Server) Stop() error {
 		}
 	}
 
-	return nil
+	for name, rq := range s.replyQueues {
+		delete(s.replyQueues, name)
+		rq.q.stop()
+	}
+
+	if s.wal != nil {
+		err := s.wal.close()
+		if err != nil {
+			s.logf("ERROR: failed to close write-ahead log: %s", err)
+		}
+	}
+
+	return err
 }
 
 // State returns the current server state.
@@ -164,11 +315,17 @@ func (s *Server) State() ServerState {
 	return s.state
 }
 
-func (s *Server) getQueue(name string) (q queue, err error) {
+var errQueueBackend = errors.New("mqmq: failed to create queue backend")
+
+// getQueue returns the queue, creating it if necessary. Unless the queue is
+// replicated, it fails with errMaxQueues if the server or the namespace limits
+// don't allow a new queue. It fails with errQueueBackend if the queue factory
+// fails.
+func (s *Server) getQueue(name string, replicated bool) (q queue, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.state != ServerStateActive {
+	if s.state == ServerStateStopped || s.queues == nil {
 		return nil, errServerState
 	}
 
@@ -176,12 +333,68 @@ func (s *Server) getQueue(name string) (q queue, err error) {
 		return q, nil
 	}
 
-	q = newMemoryQueue()
+	if !replicated {
+		err = s.checkMaxQueues(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	journal := func(op queueOp) { s.journal(name, op) }
+	if s.queueFactory != nil {
+		backend, err := s.queueFactory(name)
+		if err != nil {
+			s.logf("ERROR: failed to create queue backend (%s): %s", name, err)
+			return nil, errQueueBackend
+		}
+		q = newBackendQueue(backend, journal, func(msg string, err error) {
+			s.logf("ERROR: %s (%s): %s", msg, name, err)
+		})
+	} else {
+		q = newQueue(s.queueType, journal)
+	}
 
 	s.queues[name] = q
 	return q, nil
 }
 
+// journal writes the queue change to the write-ahead log and passes it to the replicas.
+func (s *Server) journal(name string, op queueOp) {
+	if s.wal != nil {
+		s.wal.append(name, op)
+	}
+	if s.raft != nil {
+		s.raft.journal(name, op)
+		return
+	}
+	s.replication.publish(name, op, 0)
+}
+
+// queueList returns a copy of the current queues map.
+func (s *Server) queueList() map[string]queue {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	queues := make(map[string]queue, len(s.queues))
+	for name, q := range s.queues {
+		queues[name] = q
+	}
+	return queues
+}
+
+// resetQueues removes all the queues. The messages are removed first,
+// so the queue backends don't keep them.
+func (s *Server) resetQueues() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, q := range s.queues {
+		delete(s.queues, name)
+		q.purge()
+		q.stop()
+	}
+}
+
 func (s *Server) logf(format string, args ...interface{}) {
 	if s.logger != nil {
 		s.logger.Printf(format, args...)
@@ -192,35 +405,56 @@ func (s *Server) logf(format string, args ...interface{}) {
 
 // ServerInfo contains a server information.
 type ServerInfo struct {
+	Role           string
 	NumConnections int
+	NumReplicas    int
 	NumQueues      int
 	NumMessages    int
 	Queues         map[string]ServerQueueInfo
+	Cluster        *ServerClusterInfo
 }
 
 // ServerQueueInfo contains a message queue information.
 type ServerQueueInfo struct {
-	NumMessages int
+	NumMessages  int
+	NumWaiting   int // Number of consumers waiting for a message.
+	NumDedupHits int // Number of duplicate messages discarded (see Client.PutDedup).
 }
 
 // Info returns the current server information.
 func (s *Server) Info() ServerInfo {
+	return s.info("*")
+}
+
+// info returns the current server information. Only the queues matching
+// the pattern are included in the queue information.
+func (s *Server) info(pattern string) ServerInfo {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	info := ServerInfo{
+		Role:           s.role.String(),
 		NumConnections: len(s.connections),
-		NumQueues:      len(s.queues),
+		NumReplicas:    s.replication.len(),
 		Queues:         make(map[string]ServerQueueInfo),
 	}
 
 	numMessages := 0
 	for name, q := range s.queues {
+		if !MatchQueue(pattern, name) {
+			continue
+		}
 		qlen := q.len()
 		numMessages += qlen
-		info.Queues[name] = ServerQueueInfo{NumMessages: qlen}
+		info.Queues[name] = ServerQueueInfo{NumMessages: qlen, NumWaiting: q.waiting(), NumDedupHits: s.dedup.hits(name)}
 	}
+	info.NumQueues = len(info.Queues)
 	info.NumMessages = numMessages
 
+	if s.raft != nil {
+		clusterInfo := s.raft.info()
+		info.Cluster = &clusterInfo
+	}
+
 	return info
 }
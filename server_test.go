@@ -1,17 +1,32 @@
 package mqmq
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 )
 
 func startServer() (*Server, string) {
+	return startServerWith(nil)
+}
+
+// startServerWith starts a test server configured by the given function.
+func startServerWith(configure func(s *Server) error) (*Server, string) {
 	s := NewServer()
 
+	if configure != nil {
+		err := configure(s)
+		if err != nil {
+			panic("Test server start failed: configure: " + err.Error())
+		}
+	}
+
 	err := s.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
 	if err != nil {
 		panic("Test server start failed: SetLogger: " + err.Error())
@@ -30,6 +45,10 @@ func startServer() (*Server, string) {
 		}
 	}()
 
+	for s.State() == ServerStateNew {
+		time.Sleep(time.Millisecond)
+	}
+
 	return s, addr
 }
 
@@ -59,6 +78,7 @@ func TestRequests(t *testing.T) {
 		t.Fatalf("failed c.Info: %s", err)
 	}
 	expectInfo := &ServerInfo{
+		Role:           "primary",
 		NumConnections: 1,
 		NumQueues:      1,
 		NumMessages:    1,
@@ -89,6 +109,411 @@ func TestRequests(t *testing.T) {
 	}
 }
 
+func TestRequestsContext(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	qname := "test-queue"
+	msg := "test-message"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := NewClient()
+	err := c.ConnectContext(ctx, addr)
+	if err != nil {
+		t.Fatalf("failed c.ConnectContext: %s", err)
+	}
+
+	err = c.PutContext(ctx, qname, []byte(msg))
+	if err != nil {
+		t.Fatalf("failed c.PutContext: %s", err)
+	}
+
+	info, err := c.InfoContext(ctx)
+	if err != nil {
+		t.Fatalf("failed c.InfoContext: %s", err)
+	}
+	if info.NumMessages != 1 {
+		t.Fatalf("failed c.InfoContext: expected 1 message, got %d", info.NumMessages)
+	}
+
+	out, err := c.GetContext(ctx, qname, 1*time.Minute)
+	if err != nil || string(out) != msg {
+		t.Fatalf("failed c.GetContext: expected %#v, %#v, got %#v, %#v", msg, nil, string(out), err)
+	}
+
+	err = c.Disconnect()
+	if err != nil {
+		t.Fatalf("failed c.Disconnect: %s", err)
+	}
+}
+
+func TestCancelAfterResponse(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	// The context without deadline is canceled after the response is received
+	// but before the exchange finishes.
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	err = c.exchangeLocked(ctx, func() error {
+		_, err := c.roundTrip(frame{bInfo})
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+		return err
+	})
+	c.mu.Unlock()
+	if err != nil {
+		t.Fatalf("failed c.exchangeLocked: %s", err)
+	}
+
+	// The connection is still usable.
+	_, err = c.Info()
+	if err != nil {
+		t.Fatalf("failed c.Info: %s", err)
+	}
+}
+
+func TestGetContextCancel(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	qname := "test-queue"
+	msg := "test-message"
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = c.GetContext(ctx, qname, 1*time.Minute)
+	if err != context.Canceled {
+		t.Fatalf("failed c.GetContext: expected error %#v, got %#v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("failed c.GetContext: canceled request took %v", elapsed)
+	}
+
+	// The abandoned connection is closed.
+	_, err = c.Get(qname, 10*time.Millisecond)
+	if err != errNotConnected {
+		t.Fatalf("failed c.Get: expected error %#v, got %#v", errNotConnected, err)
+	}
+
+	// Wait for the server to drop the abandoned connection.
+	for s.Info().NumConnections != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The message put after the cancellation must not be lost.
+	c2 := NewClient()
+	err = c2.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c2.Connect: %s", err)
+	}
+	defer c2.Disconnect()
+
+	err = c2.Put(qname, []byte(msg))
+	if err != nil {
+		t.Fatalf("failed c2.Put: %s", err)
+	}
+
+	out, err := c2.Get(qname, 1*time.Minute)
+	if err != nil || string(out) != msg {
+		t.Fatalf("failed c2.Get: expected %#v, %#v, got %#v, %#v", msg, nil, string(out), err)
+	}
+}
+
+func TestGetFairness(t *testing.T) {
+	for _, queueType := range []QueueType{QueueTypeChannel, QueueTypeMutex} {
+		t.Run(string(queueType), func(t *testing.T) {
+			testGetFairness(t, queueType)
+		})
+	}
+}
+
+func testGetFairness(t *testing.T, queueType QueueType) {
+	s, addr := startServerWith(func(s *Server) error { return s.SetQueueType(queueType) })
+	defer s.Stop()
+
+	qname := "test-queue"
+	const numConsumers = 5
+
+	// The consumers start waiting one after another.
+	results := make([]chan string, numConsumers)
+	for i := range results {
+		c := NewClient()
+		err := c.Connect(addr)
+		if err != nil {
+			t.Fatalf("failed c.Connect: %s", err)
+		}
+		defer c.Disconnect()
+
+		results[i] = make(chan string, 1)
+		go func(ch chan string) {
+			out, err := c.Get(qname, 1*time.Minute)
+			if err != nil {
+				ch <- err.Error()
+				return
+			}
+			ch <- string(out)
+		}(results[i])
+
+		for s.Info().Queues[qname].NumWaiting != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	// The consumer waiting longest gets the next message.
+	for i := 0; i < numConsumers; i++ {
+		err = c.Put(qname, []byte("message-"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+	for i, ch := range results {
+		want := "message-" + strconv.Itoa(i)
+		if out := <-ch; out != want {
+			t.Fatalf("failed c.Get of consumer %d: expected %#v, got %#v", i, want, out)
+		}
+	}
+
+	// The consumers that stop waiting are not counted.
+	_, err = c.Get(qname, 10*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("failed c.Get: expected error %#v, got %#v", ErrTimeout, err)
+	}
+	info := s.Info()
+	if info.Queues[qname].NumWaiting != 0 {
+		t.Fatalf("failed s.Info: expected no waiting consumers, got %d", info.Queues[qname].NumWaiting)
+	}
+}
+
+func TestSetQueueType(t *testing.T) {
+	s := NewServer()
+	err := s.SetQueueType("unknown")
+	if err == nil {
+		t.Fatalf("failed s.SetQueueType: expected error for unknown queue type")
+	}
+	err = s.SetQueueType(QueueTypeMutex)
+	if err != nil {
+		t.Fatalf("failed s.SetQueueType: %s", err)
+	}
+}
+
+func TestGetContextDeadline(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = c.GetContext(ctx, "test-queue", 1*time.Minute)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("failed c.GetContext: expected error %#v, got %#v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	if c.ProtocolVersion() != ProtocolVersion {
+		t.Fatalf("failed c.ProtocolVersion: expected %d, got %d", ProtocolVersion, c.ProtocolVersion())
+	}
+	if c.ServerVersion() != Version {
+		t.Fatalf("failed c.ServerVersion: expected %q, got %q", Version, c.ServerVersion())
+	}
+	if !c.HasCapability(CapabilityReplication) || c.HasCapability(CapabilityCluster) {
+		t.Fatalf("failed c.HasCapability: unexpected capabilities %v", c.capabilities)
+	}
+
+	// A client of a newer protocol version gets the server version.
+	response, err := c.cmd(context.Background(), frame{bHello, []byte("100"), []byte("unknown-feature")})
+	if err != nil {
+		t.Fatalf("failed c.cmd: %s", err)
+	}
+	if len(response) < 3 || string(response[0]) != "OK" || string(response[1]) != strconv.Itoa(ProtocolVersion) {
+		t.Fatalf("failed c.cmd: unexpected response %q", response)
+	}
+}
+
+func TestHandshakeLegacyServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed net.Listen: %s", err)
+	}
+	defer listener.Close()
+
+	// The legacy server closes the connection on unknown commands.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					f, err := readFrame(conn, maxFrameLen)
+					if err != nil {
+						return
+					}
+					if string(f[0]) != "Put" {
+						writeFrame(conn, frame{bError, []byte("REQUEST_UNKNOWN_COMMAND")}, maxFrameLen)
+						return
+					}
+					writeFrame(conn, frame{bOK}, maxFrameLen)
+				}
+			}()
+		}
+	}()
+
+	c := NewClient()
+	err = c.Connect(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	if c.ProtocolVersion() != 0 || c.ServerVersion() != "" {
+		t.Fatalf("failed c.Connect: expected legacy protocol, got %d %q", c.ProtocolVersion(), c.ServerVersion())
+	}
+
+	err = c.Put("test-queue", []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+}
+
+func TestSetConnection(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+	_, err = c.replyQueueName(context.Background())
+	if err != nil {
+		t.Fatalf("failed c.replyQueueName: %s", err)
+	}
+
+	// The state negotiated on the previous connection is reset.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed net.Dial: %s", err)
+	}
+	old := c.conn
+	err = c.SetConnection(conn)
+	if err != nil {
+		t.Fatalf("failed c.SetConnection: %s", err)
+	}
+	old.Close()
+	if c.ProtocolVersion() != 0 || c.ServerVersion() != "" || c.capabilities != nil || c.codec != nil || c.replyQueue != "" {
+		t.Fatalf("failed c.SetConnection: negotiated state is kept")
+	}
+	if c.Limits() != DefaultServerLimits() {
+		t.Fatalf("failed c.SetConnection: expected default limits, got %+v", c.Limits())
+	}
+
+	// The reply queue of the new connection is created.
+	stop := serveRequests(addr, "test-rpc")
+	defer stop()
+	reply, err := c.Request("test-rpc", []byte("hello"), 5*time.Second)
+	if err != nil || string(reply) != "HELLO" {
+		t.Fatalf("failed c.Request: expected %q, got %q, %v", "HELLO", reply, err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	err = c.Promote()
+	if !errors.Is(err, ErrServerNotReplica) {
+		t.Fatalf("failed c.Promote: expected %v, got %v", ErrServerNotReplica, err)
+	}
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != "SERVER_NOT_REPLICA" || serverErr.Detail == "" {
+		t.Fatalf("failed c.Promote: unexpected error %#v", err)
+	}
+	if errors.Is(err, ErrServerReplica) {
+		t.Fatalf("failed c.Promote: error %v matches %v", err, ErrServerReplica)
+	}
+
+	requests := []struct {
+		request frame
+		err     error
+	}{
+		{frame{bPut, []byte("test-queue")}, ErrBadParams},
+		{frame{bGet, []byte("test-queue"), []byte("1s")}, ErrBadTimeout},
+		{frame{bGet, make([]byte, MaxQueueNameLen+1)}, ErrBadQueueName},
+		{frame{[]byte("Unknown")}, ErrUnknownCommand},
+	}
+	for _, r := range requests {
+		response, err := c.cmd(context.Background(), r.request)
+		if err != nil {
+			t.Fatalf("failed c.cmd: %s", err)
+		}
+		err = responseError(response)
+		if !errors.Is(err, r.err) {
+			t.Fatalf("failed c.cmd %q: expected %v, got %v", r.request[0], r.err, err)
+		}
+	}
+
+	// The connection stays usable after the error responses.
+	err = c.Put("test-queue", []byte("test-message"))
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+}
+
 func BenchmarkServerPutGet(b *testing.B) {
 	s, addr := startServer()
 	defer s.Stop()
@@ -0,0 +1,230 @@
+package mqmq
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// The snapshot of the server queues is a sequence of frames (see the protocol
+// description): the Snapshot <version> header frame, an Enqueue <queue> <message>
+// frame for every message in the queue order and the End frame. The leading
+// parts of the messages larger than 256 KB are written in the Chunk <data> frames
+// preceding the Enqueue frame with the rest of the message. The messages are
+// not compressed.
+
+var (
+	bSnapshot    = []byte("Snapshot")
+	bSnapshotEnd = []byte("End")
+)
+
+// snapshotVersion is the version of the snapshot format.
+const snapshotVersion = "1"
+
+var errBadSnapshot = errors.New("mqmq: bad snapshot")
+
+var errRestoreSource = errors.New("mqmq: snapshot can't be restored with write-ahead log or queue factory")
+
+// Snapshot writes the contents of all the queues to w. The messages put to
+// the queues or taken from them while the snapshot is written may or may not
+// be included.
+func (s *Server) Snapshot(w io.Writer) error {
+	return s.snapshot(w, "*")
+}
+
+// StopSnapshot stops the server like Stop and writes the contents of all the
+// queues to w after the listener and the client connections are closed, so
+// the snapshot has every message put before the server stopped responding.
+func (s *Server) StopSnapshot(w io.Writer) error {
+	return s.stop(w)
+}
+
+// snapshot writes the contents of the queues matching the pattern to w.
+func (s *Server) snapshot(w io.Writer, pattern string) error {
+	return s.writeSnapshot(w, s.queueList(), pattern)
+}
+
+// writeSnapshot writes the contents of the given queues matching the pattern to w.
+func (s *Server) writeSnapshot(w io.Writer, queues map[string]queue, pattern string) error {
+	var names []string
+	for name := range queues {
+		if MatchQueue(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	err := writeFrame(bw, frame{bSnapshot, []byte(snapshotVersion)}, maxFrameLen)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		snap, err := queues[name].snapshot()
+		if err != nil {
+			return err
+		}
+		for _, stored := range snap.messages {
+			message, err := s.loadMessage(stored)
+			if err != nil {
+				return err
+			}
+			err = writeChunked(bw, frame{bEnqueue, []byte(name), message})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = writeFrame(bw, frame{bSnapshotEnd}, maxFrameLen)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore appends the messages of the snapshot read from r to the queues.
+// It can be called before the server is started to restore the queues
+// before any client connects. If the snapshot is malformed or truncated,
+// the messages read before the error are kept.
+//
+// The queues restored before the start have a single source: Restore fails
+// if the server has the write-ahead log or the queue factory (see SetWAL and
+// SetQueueFactory), and they can't be set after Restore, since the restored
+// messages would be added to the ones the log or the backends already keep.
+func (s *Server) Restore(r io.Reader) error {
+	s.mu.Lock()
+	if s.state == ServerStateStopped {
+		s.mu.Unlock()
+		return errServerState
+	}
+	if s.state == ServerStateNew && (s.walOptions.Path != "" || s.queueFactory != nil) {
+		s.mu.Unlock()
+		return errRestoreSource
+	}
+	if s.queues == nil {
+		s.queues = make(map[string]queue)
+	}
+	s.mu.Unlock()
+
+	return ReadSnapshot(r, func(queue string, message []byte) error {
+		q, err := s.getQueue(queue, true)
+		if err != nil {
+			return err
+		}
+		return q.enqueue(s.storeOwnedMessage(message))
+	})
+}
+
+// ReadSnapshot reads the snapshot written by Server.Snapshot or Client.Snapshot
+// and calls fn for every message in the queue order. The message is owned by fn.
+func ReadSnapshot(r io.Reader, fn func(queue string, message []byte) error) error {
+	br := bufio.NewReader(r)
+	f, err := readFrame(br, maxFrameLen)
+	if err != nil {
+		return err
+	}
+	if len(f) != 2 || !bytes.Equal(f[0], bSnapshot) {
+		return errBadSnapshot
+	}
+	if string(f[1]) != snapshotVersion {
+		return errors.New("mqmq: unsupported snapshot version: " + string(f[1]))
+	}
+
+	var chunks []byte
+	for {
+		f, err := readFrame(br, maxFrameLen)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(f) == 2 && bytes.Equal(f[0], bChunk):
+			chunks = append(chunks, f[1]...)
+		case len(f) == 3 && bytes.Equal(f[0], bEnqueue):
+			message := f[2]
+			if len(chunks) > 0 {
+				message = append(chunks, message...)
+				chunks = nil
+			}
+			err = fn(string(f[1]), message)
+			if err != nil {
+				return err
+			}
+		case len(f) == 1 && bytes.Equal(f[0], bSnapshotEnd) && len(chunks) == 0:
+			return nil
+		default:
+			return errBadSnapshot
+		}
+	}
+}
+
+// Request handler: Snapshot [<queue pattern>]
+//
+// The server responds with OK followed by the Chunk <data> frames with
+// the snapshot of the queues matching the pattern and the ChunkEnd frame.
+func (c *connection) handleSnapshot(f frame) {
+	pattern := "*"
+	if len(f) >= 2 {
+		pattern = string(f[1])
+		if !ValidQueuePattern(pattern) {
+			c.sendOrStop(errorFrame(ErrBadQueueName, "bad queue pattern "+strconv.Quote(pattern)))
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	err := c.server.snapshot(&buf, pattern)
+	if err != nil {
+		c.server.logf("ERROR: failed to take snapshot: %s", err)
+		c.sendOrStop(errorFrame(ErrServerInternal, "failed to take snapshot"))
+		return
+	}
+
+	err = c.sendChunks(buf.Bytes())
+	if err != nil {
+		c.stopOnWriteError(err)
+	}
+}
+
+// Snapshot writes the snapshot of the server queues to w (see Server.Snapshot).
+// The snapshot is received in chunks and can be restored with Server.Restore
+// or read with ReadSnapshot.
+func (c *Client) Snapshot(w io.Writer) error {
+	return c.SnapshotContext(context.Background(), w, "*")
+}
+
+// SnapshotContext writes the snapshot of the server queues matching the pattern
+// (see ValidQueuePattern) to w. If the context is canceled or its deadline is
+// exceeded before the snapshot is received, the connection is closed and
+// the context error is returned.
+func (c *Client) SnapshotContext(ctx context.Context, w io.Writer, pattern string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil && !c.capabilities[CapabilityChunked] {
+		return errChunkedNotSupported
+	}
+
+	response, _, err := c.streamLocked(ctx, frame{bSnapshot, []byte(pattern)}, w)
+	if err != nil {
+		return err
+	}
+
+	if len(response) < 1 {
+		return ErrBadResponse
+	}
+	if bytes.Equal(response[0], bError) {
+		return responseError(response)
+	}
+	if !bytes.Equal(response[0], bOK) {
+		return ErrBadResponse
+	}
+	return nil
+}
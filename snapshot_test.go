@@ -0,0 +1,264 @@
+package mqmq
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// equalContents reports whether the queues have the same messages. The empty
+// messages may be nil or not.
+func equalContents(a, b map[string][][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, messages := range a {
+		if len(messages) != len(b[name]) {
+			return false
+		}
+		for i, m := range messages {
+			if !bytes.Equal(m, b[name][i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	s, addr := startServer()
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	for i := 0; i < 10; i++ {
+		err = c.Put(fmt.Sprintf("test-queue-%d", i%3), []byte(fmt.Sprintf("message-%d", i)))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+	err = c.Put("test-queue-empty", []byte{})
+	if err != nil {
+		t.Fatalf("failed c.Put: %s", err)
+	}
+	large := bytes.Repeat([]byte("0123456789"), messageChunkSize/4)
+	err = c.PutReader("test-queue-large", bytes.NewReader(large))
+	if err != nil {
+		t.Fatalf("failed c.PutReader: %s", err)
+	}
+
+	var buf bytes.Buffer
+	err = s.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf("failed s.Snapshot: %s", err)
+	}
+	want := queueContents(s)
+
+	// The snapshot is restored before the server is started.
+	s2, _ := startServerWith(func(s *Server) error { return s.Restore(bytes.NewReader(buf.Bytes())) })
+	defer s2.Stop()
+	got := queueContents(s2)
+	if !equalContents(got, want) {
+		t.Fatalf("failed s.Restore: expected %q, got %q", want, got)
+	}
+
+	// The client receives the same snapshot.
+	var buf2 bytes.Buffer
+	err = c.Snapshot(&buf2)
+	if err != nil {
+		t.Fatalf("failed c.Snapshot: %s", err)
+	}
+	if !bytes.Equal(buf2.Bytes(), buf.Bytes()) {
+		t.Fatalf("failed c.Snapshot: snapshot differs from s.Snapshot")
+	}
+
+	// The snapshot is restored to the running server, appending the messages.
+	err = s2.Restore(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed s.Restore: %s", err)
+	}
+	got = queueContents(s2)
+	for name, messages := range want {
+		w := append(append([][]byte{}, messages...), messages...)
+		if !equalContents(map[string][][]byte{name: got[name]}, map[string][][]byte{name: w}) {
+			t.Fatalf("failed s.Restore of %s: expected %q, got %q", name, w, got[name])
+		}
+	}
+
+	// The snapshot taken with a pattern only includes the matching queues.
+	buf.Reset()
+	err = c.SnapshotContext(context.Background(), &buf, "test-queue-1")
+	if err != nil {
+		t.Fatalf("failed c.SnapshotContext: %s", err)
+	}
+	var messages []string
+	err = ReadSnapshot(&buf, func(queue string, message []byte) error {
+		if queue != "test-queue-1" {
+			t.Fatalf("failed ReadSnapshot: unexpected queue %s", queue)
+		}
+		messages = append(messages, string(message))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed ReadSnapshot: %s", err)
+	}
+	if w := []string{"message-1", "message-4", "message-7"}; !reflect.DeepEqual(messages, w) {
+		t.Fatalf("failed ReadSnapshot: expected %q, got %q", w, messages)
+	}
+
+	// The snapshot doesn't remove the messages.
+	if got := queueContents(s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("failed c.Snapshot: expected %q, got %q", want, got)
+	}
+}
+
+func TestStopSnapshot(t *testing.T) {
+	s, addr := startServer()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	// The messages put until the server stops are in the snapshot.
+	acked := make(chan int)
+	go func() {
+		n := 0
+		for c.Put("test-queue", []byte(fmt.Sprintf("message-%d", n))) == nil {
+			n++
+		}
+		acked <- n
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	var buf bytes.Buffer
+	err = s.StopSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("failed s.StopSnapshot: %s", err)
+	}
+	n := <-acked
+	if s.State() != ServerStateStopped {
+		t.Fatalf("failed s.StopSnapshot: server is not stopped")
+	}
+
+	var messages []string
+	err = ReadSnapshot(&buf, func(queue string, message []byte) error {
+		messages = append(messages, string(message))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed ReadSnapshot: %s", err)
+	}
+	if n == 0 || len(messages) < n {
+		t.Fatalf("failed s.StopSnapshot: %d messages acknowledged, %d saved", n, len(messages))
+	}
+	for i := 0; i < n; i++ {
+		if want := fmt.Sprintf("message-%d", i); messages[i] != want {
+			t.Fatalf("failed s.StopSnapshot: expected %q, got %q", want, messages[i])
+		}
+	}
+
+	if err := s.StopSnapshot(&buf); err != errServerState {
+		t.Fatalf("failed s.StopSnapshot: expected error %v, got %v", errServerState, err)
+	}
+}
+
+func TestReadSnapshotErrors(t *testing.T) {
+	s, _ := startServer()
+	q, err := s.getQueue("test-queue", true)
+	if err != nil {
+		t.Fatalf("failed s.getQueue: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		q.enqueue([]byte(fmt.Sprintf("message-%d", i)))
+	}
+	var buf bytes.Buffer
+	err = s.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf("failed s.Snapshot: %s", err)
+	}
+	s.Stop()
+	data := buf.Bytes()
+
+	// The truncated snapshot fails after the whole messages are read.
+	for offset := 0; offset < len(data); offset++ {
+		n := 0
+		err = ReadSnapshot(bytes.NewReader(data[:offset]), func(string, []byte) error {
+			n++
+			return nil
+		})
+		if err == nil {
+			t.Fatalf("failed ReadSnapshot at %d: expected error", offset)
+		}
+		if n > 3 {
+			t.Fatalf("failed ReadSnapshot at %d: %d messages read", offset, n)
+		}
+	}
+
+	var bad bytes.Buffer
+	writeFrame(&bad, frame{bSnapshot, []byte("2")}, maxFrameLen)
+	err = ReadSnapshot(&bad, func(string, []byte) error { return nil })
+	if err == nil {
+		t.Fatalf("failed ReadSnapshot: expected error for unsupported version")
+	}
+
+	bad.Reset()
+	writeFrame(&bad, frame{bSnapshot, []byte(snapshotVersion)}, maxFrameLen)
+	writeFrame(&bad, frame{bPut, []byte("test-queue"), []byte("message")}, maxFrameLen)
+	err = ReadSnapshot(&bad, func(string, []byte) error { return nil })
+	if err != errBadSnapshot {
+		t.Fatalf("failed ReadSnapshot: expected error %v, got %v", errBadSnapshot, err)
+	}
+
+	err = ReadSnapshot(bytes.NewReader(data), func(string, []byte) error { return io.ErrShortWrite })
+	if err != io.ErrShortWrite {
+		t.Fatalf("failed ReadSnapshot: expected error %v, got %v", io.ErrShortWrite, err)
+	}
+
+	err = s.Restore(bytes.NewReader(data))
+	if err != errServerState {
+		t.Fatalf("failed s.Restore: expected error %v, got %v", errServerState, err)
+	}
+}
+
+func TestRestoreSource(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrame(&buf, frame{bSnapshot, []byte(snapshotVersion)}, maxFrameLen)
+	writeFrame(&buf, frame{bEnqueue, []byte("test-queue"), []byte("message")}, maxFrameLen)
+	writeFrame(&buf, frame{bSnapshotEnd}, maxFrameLen)
+	data := buf.Bytes()
+	factory := func(name string) (QueueBackend, error) { return NewMemoryBackend(), nil }
+
+	s := NewServer()
+	s.SetWAL(WALOptions{Path: "queues.wal"})
+	if err := s.Restore(bytes.NewReader(data)); err != errRestoreSource {
+		t.Fatalf("failed s.Restore with WAL: expected error %v, got %v", errRestoreSource, err)
+	}
+	s = NewServer()
+	s.SetQueueFactory(factory)
+	if err := s.Restore(bytes.NewReader(data)); err != errRestoreSource {
+		t.Fatalf("failed s.Restore with queue factory: expected error %v, got %v", errRestoreSource, err)
+	}
+
+	s = NewServer()
+	if err := s.Restore(bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed s.Restore: %s", err)
+	}
+	if err := s.SetWAL(WALOptions{Path: "queues.wal"}); err != errRestoreSource {
+		t.Fatalf("failed s.SetWAL after s.Restore: expected error %v, got %v", errRestoreSource, err)
+	}
+	if err := s.SetQueueFactory(factory); err != errRestoreSource {
+		t.Fatalf("failed s.SetQueueFactory after s.Restore: expected error %v, got %v", errRestoreSource, err)
+	}
+}
@@ -0,0 +1,395 @@
+package mqmq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WALSync is the policy of syncing the write-ahead log to the disk.
+type WALSync string
+
+// Write-ahead log sync policies.
+const (
+	// WALSyncAlways syncs every queue change before the next one is made.
+	WALSyncAlways WALSync = "always"
+	// WALSyncBatch syncs the queue changes in batches every WALOptions.Interval.
+	WALSyncBatch WALSync = "batch"
+	// WALSyncOS leaves it to the operating system to write the queue changes
+	// to the disk. The changes survive the server crashes but not the OS ones.
+	WALSyncOS WALSync = "os"
+)
+
+// DefaultWALInterval is the default interval of the WALSyncBatch syncs.
+const DefaultWALInterval = 10 * time.Millisecond
+
+// WALOptions are the write-ahead log options.
+type WALOptions struct {
+	Path     string        // Log file path.
+	Sync     WALSync       // Sync policy, WALSyncAlways by default.
+	Interval time.Duration // Interval of the WALSyncBatch syncs, DefaultWALInterval by default.
+}
+
+// SetWAL makes the server write every queue change to the write-ahead log and
+// restore the queues from the log when it starts. The Put requests are answered
+// after the message reaches the durability point of the sync policy.
+//
+// The log is compacted when the server starts: it is replaced by the current
+// contents of the queues. The log can't be used with a queue factory (see
+// SetQueueFactory): the backends keep their messages on their own, and the
+// replayed log would add them again. For the same reason it can't be used with
+// the snapshot restored before the start (see Restore).
+func (s *Server) SetWAL(options WALOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != ServerStateNew {
+		return errServerState
+	}
+	if s.queueFactory != nil {
+		return errWALQueueFactory
+	}
+	if s.queues != nil {
+		// The queues are restored from a snapshot (see Restore).
+		return errRestoreSource
+	}
+	if options.Path == "" {
+		return errors.New("mqmq: no write-ahead log path")
+	}
+	if options.Sync == "" {
+		options.Sync = WALSyncAlways
+	}
+	if options.Sync != WALSyncAlways && options.Sync != WALSyncBatch && options.Sync != WALSyncOS {
+		return errors.New("mqmq: unknown write-ahead log sync policy: " + string(options.Sync))
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultWALInterval
+	}
+	s.walOptions = options
+	return nil
+}
+
+// The log is a sequence of records. Each record is the payload length and
+// the CRC-32C checksum of the payload (4-byte big-endian integers) followed
+// by the payload: the operation kind byte, the queue name length (uvarint),
+// the queue name and the message. The first record that is truncated or
+// doesn't match its checksum ends the log.
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walHeaderLen is the length of the record header.
+const walHeaderLen = 8
+
+// appendWALRecord appends the record of the queue change to buf.
+func appendWALRecord(buf []byte, name string, op queueOp) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, walHeaderLen)...)
+	buf = append(buf, byte(op.kind))
+	var nameLen [binary.MaxVarintLen64]byte
+	buf = append(buf, nameLen[:binary.PutUvarint(nameLen[:], uint64(len(name)))]...)
+	buf = append(buf, name...)
+	buf = append(buf, op.message...)
+
+	payload := buf[start+walHeaderLen:]
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, walTable))
+	return buf
+}
+
+// readWAL reads the log records of the log of the given size and passes them to
+// apply. It returns the length of the valid part of the log. The operations have
+// no sequence numbers.
+func readWAL(r io.Reader, size int64, apply func(name string, op queueOp) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var valid int64
+	header := make([]byte, walHeaderLen)
+	for {
+		_, err := io.ReadFull(br, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, nil
+		}
+		if err != nil {
+			return valid, err
+		}
+
+		n := binary.BigEndian.Uint32(header)
+		if int64(n) > size-valid-walHeaderLen {
+			return valid, nil
+		}
+		payload := make([]byte, n)
+		_, err = io.ReadFull(br, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, nil
+		}
+		if err != nil {
+			return valid, err
+		}
+		if crc32.Checksum(payload, walTable) != binary.BigEndian.Uint32(header[4:]) {
+			return valid, nil
+		}
+
+		name, op, ok := parseWALPayload(payload)
+		if !ok {
+			return valid, nil
+		}
+		err = apply(name, op)
+		if err != nil {
+			return valid, err
+		}
+		valid += walHeaderLen + int64(n)
+	}
+}
+
+func parseWALPayload(payload []byte) (string, queueOp, bool) {
+	if len(payload) < 1 {
+		return "", queueOp{}, false
+	}
+	kind := queueOpKind(payload[0])
+	if kind != queueOpEnqueue && kind != queueOpRequeue && kind != queueOpDequeue {
+		return "", queueOp{}, false
+	}
+	nameLen, n := binary.Uvarint(payload[1:])
+	if n <= 0 || nameLen > uint64(len(payload)-1-n) {
+		return "", queueOp{}, false
+	}
+	rest := payload[1+n:]
+	op := queueOp{kind: kind}
+	if kind != queueOpDequeue {
+		op.message = rest[nameLen:]
+	}
+	return string(rest[:nameLen]), op, true
+}
+
+var errWALQueueFactory = errors.New("mqmq: write-ahead log can't be used with queue factory")
+
+var (
+	errWALClosed  = errors.New("mqmq: write-ahead log is closed")
+	errWALAborted = errors.New("mqmq: write-ahead log wait aborted")
+)
+
+// wal is the write-ahead log of the queue changes.
+type wal struct {
+	mu       sync.Mutex
+	file     *os.File
+	policy   WALSync
+	buf      []byte
+	written  uint64 // Number of records written.
+	synced   uint64 // Number of records synced.
+	err      error  // The first write or sync error.
+	chSynced chan struct{}
+	chStop   chan struct{}
+	stopped  chan struct{}
+}
+
+// newWAL starts writing the log to the file opened for appending.
+func newWAL(file *os.File, options WALOptions) *wal {
+	w := &wal{
+		file:     file,
+		policy:   options.Sync,
+		chSynced: make(chan struct{}),
+		chStop:   make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if w.policy == WALSyncBatch {
+		go w.run(options.Interval)
+	} else {
+		close(w.stopped)
+	}
+	return w
+}
+
+// run syncs the log in batches until the log is closed.
+func (w *wal) run(interval time.Duration) {
+	defer close(w.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.sync()
+		case <-w.chStop:
+			return
+		}
+	}
+}
+
+// sync syncs the records written so far and wakes up the waiters.
+func (w *wal) sync() {
+	w.mu.Lock()
+	n := w.written
+	if n == w.synced || w.err != nil {
+		w.mu.Unlock()
+		return
+	}
+	w.mu.Unlock()
+
+	err := w.file.Sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	w.synced = n
+	close(w.chSynced)
+	w.chSynced = make(chan struct{})
+}
+
+// append writes the record of the queue change to the log.
+func (w *wal) append(name string, op queueOp) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+
+	w.buf = appendWALRecord(w.buf[:0], name, op)
+	_, err := w.file.Write(w.buf)
+	if err == nil && w.policy == WALSyncAlways {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		w.err = err
+		return
+	}
+	w.written++
+	if w.policy != WALSyncBatch {
+		w.synced = w.written
+	}
+}
+
+// wait waits until all the records written so far, including the changes
+// already made to the given queues, reach the durability point of the sync
+// policy. It fails with errWALAborted if done is closed first.
+func (w *wal) wait(done <-chan struct{}, queues ...queue) error {
+	// The queues report their changes synchronously, so once they respond
+	// the changes made by the caller are already written.
+	for _, q := range queues {
+		q.len()
+	}
+
+	w.mu.Lock()
+	index := w.written
+	for w.err == nil && w.synced < index {
+		ch := w.chSynced
+		w.mu.Unlock()
+		select {
+		case <-ch:
+		case <-done:
+			return errWALAborted
+		}
+		w.mu.Lock()
+	}
+	err := w.err
+	w.mu.Unlock()
+	return err
+}
+
+// close syncs and closes the log.
+func (w *wal) close() error {
+	close(w.chStop)
+	<-w.stopped
+	w.sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.file.Close()
+	if w.err == nil {
+		w.err = errWALClosed
+	}
+	close(w.chSynced)
+	w.chSynced = make(chan struct{})
+	return err
+}
+
+// openWAL restores the queues from the write-ahead log, compacts the log and
+// starts writing the queue changes to it. The queues must not be used yet.
+func (s *Server) openWAL() error {
+	path := s.walOptions.Path
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if f != nil {
+		var valid int64
+		info, err := f.Stat()
+		if err == nil {
+			valid, err = readWAL(f, info.Size(), s.replayWAL)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+		s.logf("INFO: restored queues from write-ahead log %s (%d bytes)", path, valid)
+	}
+
+	// The restored queues replace the log.
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	var buf []byte
+	for name, q := range s.queueList() {
+		snap, err := q.snapshot()
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		for _, message := range snap.messages {
+			buf = appendWALRecord(buf[:0], name, queueOp{kind: queueOpEnqueue, message: message})
+			bw.Write(buf)
+		}
+	}
+	err = bw.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.wal = newWAL(f, s.walOptions)
+	s.mu.Unlock()
+	return nil
+}
+
+// replayWAL applies the queue change restored from the write-ahead log.
+func (s *Server) replayWAL(name string, op queueOp) error {
+	q, err := s.getQueue(name, true)
+	if err != nil {
+		return err
+	}
+	switch op.kind {
+	case queueOpEnqueue:
+		return q.enqueue(op.message)
+	case queueOpRequeue:
+		return q.requeue(op.message)
+	default:
+		if _, ok := q.dequeue(); !ok {
+			s.logf("ERROR: write-ahead log removes message from empty queue: %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package mqmq
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// walModel applies the log records to a map of the queue contents.
+type walModel map[string][][]byte
+
+func (m walModel) apply(name string, op queueOp) error {
+	switch op.kind {
+	case queueOpEnqueue:
+		m[name] = append(m[name], op.message)
+	case queueOpRequeue:
+		m[name] = append([][]byte{op.message}, m[name]...)
+	case queueOpDequeue:
+		if len(m[name]) > 0 {
+			m[name] = m[name][1:]
+		}
+	}
+	return nil
+}
+
+func TestWALTruncate(t *testing.T) {
+	type record struct {
+		name string
+		op   queueOp
+	}
+	records := []record{
+		{"queue-1", queueOp{kind: queueOpEnqueue, message: []byte("message-1")}},
+		{"queue-2", queueOp{kind: queueOpEnqueue, message: []byte("message-2")}},
+		{"queue-1", queueOp{kind: queueOpEnqueue, message: []byte{}}},
+		{"queue-1", queueOp{kind: queueOpDequeue}},
+		{"queue-2", queueOp{kind: queueOpRequeue, message: bytes.Repeat([]byte("x"), 1000)}},
+		{"queue-1", queueOp{kind: queueOpRequeue, message: []byte("message-1")}},
+	}
+
+	var buf []byte
+	ends := []int{0}
+	for _, r := range records {
+		buf = appendWALRecord(buf, r.name, r.op)
+		ends = append(ends, len(buf))
+	}
+
+	// The log truncated at any offset is restored up to the last whole record.
+	for offset := 0; offset <= len(buf); offset++ {
+		k := 0
+		for k+1 < len(ends) && ends[k+1] <= offset {
+			k++
+		}
+		want := make(walModel)
+		for _, r := range records[:k] {
+			want.apply(r.name, r.op)
+		}
+
+		got := make(walModel)
+		valid, err := readWAL(bytes.NewReader(buf[:offset]), int64(offset), got.apply)
+		if err != nil {
+			t.Fatalf("failed readWAL at %d: %s", offset, err)
+		}
+		if valid != int64(ends[k]) {
+			t.Fatalf("failed readWAL at %d: expected %d valid bytes, got %d", offset, ends[k], valid)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("failed readWAL at %d: expected %q, got %q", offset, want, got)
+		}
+	}
+
+	// The log ends at the first corrupted record.
+	for i := range records {
+		corrupted := append([]byte(nil), buf...)
+		corrupted[ends[i]+walHeaderLen] ^= 0xff
+		got := make(walModel)
+		valid, err := readWAL(bytes.NewReader(corrupted), int64(len(corrupted)), got.apply)
+		if err != nil || valid != int64(ends[i]) {
+			t.Fatalf("failed readWAL of corrupted record %d: expected %d, nil, got %d, %v", i, ends[i], valid, err)
+		}
+	}
+}
+
+func TestWALWait(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "queues.wal"))
+	if err != nil {
+		t.Fatalf("failed os.Create: %s", err)
+	}
+	w := newWAL(f, WALOptions{Sync: WALSyncBatch, Interval: time.Millisecond})
+	defer w.close()
+
+	// The queue journals its changes after enqueue returns, so the
+	// record is only written when the queue is flushed.
+	q := newMemoryQueue(func(op queueOp) {
+		time.Sleep(50 * time.Millisecond)
+		w.append("test-queue", op)
+	})
+	defer q.stop()
+
+	q.enqueue([]byte("test-message"))
+	err = w.wait(nil, q)
+	if err != nil {
+		t.Fatalf("failed w.wait: %s", err)
+	}
+	w.mu.Lock()
+	synced, written := w.synced, w.written
+	w.mu.Unlock()
+	if written != 1 || synced != 1 {
+		t.Fatalf("failed w.wait: expected 1 record synced, got %d of %d", synced, written)
+	}
+}
+
+func startServerWithWAL(options WALOptions) (*Server, string) {
+	s, addr := startServerWith(func(s *Server) error { return s.SetWAL(options) })
+
+	// The queues are restored before the log is opened for writing.
+	for {
+		s.mu.RLock()
+		opened := s.wal != nil
+		s.mu.RUnlock()
+		if opened {
+			return s, addr
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	for _, policy := range []WALSync{WALSyncAlways, WALSyncBatch, WALSyncOS} {
+		t.Run(string(policy), func(t *testing.T) {
+			options := WALOptions{Path: filepath.Join(t.TempDir(), "queues.wal"), Sync: policy}
+			s, addr := startServerWithWAL(options)
+
+			c := NewClient()
+			err := c.Connect(addr)
+			if err != nil {
+				t.Fatalf("failed c.Connect: %s", err)
+			}
+			defer c.Disconnect()
+
+			for i := 0; i < 10; i++ {
+				err = c.Put(fmt.Sprintf("test-queue-%d", i%2), []byte(fmt.Sprintf("message-%d", i)))
+				if err != nil {
+					t.Fatalf("failed c.Put: %s", err)
+				}
+			}
+			if policy == WALSyncBatch {
+				// Put is answered after the message is synced.
+				s.wal.mu.Lock()
+				synced, written := s.wal.synced, s.wal.written
+				s.wal.mu.Unlock()
+				if written != 10 || synced != written {
+					t.Fatalf("failed c.Put: %d of %d records are synced, expected 10", synced, written)
+				}
+			}
+			_, err = c.Get("test-queue-0", 1*time.Minute)
+			if err != nil {
+				t.Fatalf("failed c.Get: %s", err)
+			}
+			want := queueContents(s)
+			s.Stop()
+
+			// The restarted server restores the queues, and the compacted
+			// log keeps them after another restart.
+			for i := 0; i < 2; i++ {
+				s, _ = startServerWithWAL(options)
+				got := queueContents(s)
+				s.Stop()
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("failed restart %d: expected %q, got %q", i, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWALCrash(t *testing.T) {
+	dir := t.TempDir()
+	options := WALOptions{Path: filepath.Join(dir, "queues.wal")}
+	s, addr := startServerWithWAL(options)
+	defer s.Stop()
+
+	c := NewClient()
+	err := c.Connect(addr)
+	if err != nil {
+		t.Fatalf("failed c.Connect: %s", err)
+	}
+	defer c.Disconnect()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		err = c.Put("test-queue", []byte(fmt.Sprintf("message-%d", i)))
+		if err != nil {
+			t.Fatalf("failed c.Put: %s", err)
+		}
+	}
+
+	// The log of the running server is cut at various offsets as if
+	// the server crashed while writing it.
+	data, err := ioutil.ReadFile(options.Path)
+	if err != nil {
+		t.Fatalf("failed ioutil.ReadFile: %s", err)
+	}
+	restored := -1
+	for offset := 0; offset <= len(data); offset += 7 {
+		if len(data)-offset < 7 {
+			offset = len(data)
+		}
+		crashed := WALOptions{Path: filepath.Join(dir, fmt.Sprintf("crashed-%d.wal", offset))}
+		err = ioutil.WriteFile(crashed.Path, data[:offset], 0600)
+		if err != nil {
+			t.Fatalf("failed ioutil.WriteFile: %s", err)
+		}
+
+		s2, _ := startServerWithWAL(crashed)
+		messages := queueContents(s2)["test-queue"]
+		s2.Stop()
+		os.Remove(crashed.Path)
+
+		// The messages put before the crash point are restored in order.
+		if len(messages) < restored {
+			t.Fatalf("failed recovery at %d: %d messages restored after %d", offset, len(messages), restored)
+		}
+		for i, m := range messages {
+			if want := fmt.Sprintf("message-%d", i); string(m) != want {
+				t.Fatalf("failed recovery at %d: expected %q, got %q", offset, want, m)
+			}
+		}
+		restored = len(messages)
+	}
+	if restored != n {
+		t.Fatalf("failed recovery: expected %d messages, got %d", n, restored)
+	}
+}
+
+func TestSetWAL(t *testing.T) {
+	s := NewServer()
+	err := s.SetWAL(WALOptions{})
+	if err == nil {
+		t.Fatalf("failed s.SetWAL: expected error for no path")
+	}
+	err = s.SetWAL(WALOptions{Path: "queues.wal", Sync: "never"})
+	if err == nil {
+		t.Fatalf("failed s.SetWAL: expected error for unknown sync policy")
+	}
+	err = s.SetWAL(WALOptions{Path: "queues.wal"})
+	if err != nil || s.walOptions.Sync != WALSyncAlways || s.walOptions.Interval != DefaultWALInterval {
+		t.Fatalf("failed s.SetWAL: unexpected options %#v, %v", s.walOptions, err)
+	}
+
+	factory := func(name string) (QueueBackend, error) { return NewMemoryBackend(), nil }
+	err = s.SetQueueFactory(factory)
+	if err != errWALQueueFactory {
+		t.Fatalf("failed s.SetQueueFactory: expected %v, got %v", errWALQueueFactory, err)
+	}
+	s = NewServer()
+	err = s.SetQueueFactory(factory)
+	if err != nil {
+		t.Fatalf("failed s.SetQueueFactory: %s", err)
+	}
+	err = s.SetWAL(WALOptions{Path: "queues.wal"})
+	if err != errWALQueueFactory {
+		t.Fatalf("failed s.SetWAL: expected %v, got %v", errWALQueueFactory, err)
+	}
+}